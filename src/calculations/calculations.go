@@ -6,37 +6,22 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"io/ioutil"
+	"flag"
 	"log"
 	"math"
 	"os"
-	"path/filepath"
-	"strings"
 	"time"
 
+	"jsonscada"
+
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-var configFileName string = "json-scada.json"
 var realtimeDataConnectionName string = "realtimeData"
 var defaultPeriodOfCalculation float64 = 2.0
 
-type config struct {
-	NodeName                 string `json: "nodeName"`
-	MongoConnectionString    string `json: "mongoConnectionString"`
-	MongoDatabaseName        string `json: "mongoDatabaseName"`
-	TlsCaPemFile             string `json: "tlsCaPemFile"`
-	TlsClientPemFile         string `json: "tlsClientPemFile"`
-	TlsClientPfxFile         string `json: "tlsClientPfxFile"`
-	TlsClientKeyPassword     string `json: "tlsClientKeyPassword"`
-	TlsAllowInvalidHostnames bool   `json: "tlsAllowInvalidHostnames"`
-	TlsAllowChainErrors      bool   `json: "tlsAllowChainErrors"`
-	TlsInsecure              bool   `json: "tlsInsecure"`
-}
-
 type pointCalc struct {
 	calc      int
 	idParcels []int
@@ -63,61 +48,18 @@ func checkError(err error) {
 }
 
 // Reads the config file and connects to MongoDB server
-func mongoConnect() (client *mongo.Client, colRTD *mongo.Collection, err error) {
+func mongoConnect(configFile string) (client *mongo.Client, colRTD *mongo.Collection, err error) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
 
-	// tries to open and read the json config file
-	jsonFile, err := os.Open(filepath.Join("..", "conf", configFileName))
+	cfg, err := jsonscada.ReadConfig(configFile)
 	if err != nil {
-		log.Printf("Fail to read file: %v", err)
+		log.Println(err)
 		os.Exit(1)
 	}
-	byteValue, _ := ioutil.ReadAll(jsonFile)
 
-	// unmarshals the json file's content into a config structure
-	var cfg config
-	err = json.Unmarshal(byteValue, &cfg)
-	if err != nil {
-		log.Printf("Error parsing json config file: %v", err)
-		os.Exit(1)
-	}
-
-	cfg.MongoConnectionString = strings.TrimSpace(cfg.MongoConnectionString)
-	cfg.MongoDatabaseName = strings.TrimSpace(cfg.MongoDatabaseName)
-	cfg.NodeName = strings.TrimSpace(cfg.NodeName)
-	if cfg.MongoConnectionString == "" || cfg.MongoDatabaseName == "" || cfg.NodeName == "" {
-		log.Printf("Empty string in config file.")
-		os.Exit(1)
-	}
-	if cfg.TlsCaPemFile != "" || cfg.TlsClientPemFile != "" {
-		cfg.MongoConnectionString = cfg.MongoConnectionString + "&tls=true"
-	}
-	if cfg.TlsCaPemFile != "" {
-		cfg.MongoConnectionString = cfg.MongoConnectionString + "&tlsCAFile=" + cfg.TlsCaPemFile
-	}
-	if cfg.TlsClientPemFile != "" {
-		cfg.MongoConnectionString = cfg.MongoConnectionString + "&tlsCertificateKeyFile=" + cfg.TlsClientPemFile
-	}
-	if cfg.TlsClientKeyPassword != "" {
-		cfg.MongoConnectionString = cfg.MongoConnectionString + "&tlsCertificateKeyFilePassword=" + cfg.TlsClientKeyPassword
-	}
-	if cfg.TlsInsecure {
-		cfg.MongoConnectionString = cfg.MongoConnectionString + "&tlsInsecure=true"
-	}
-	if cfg.TlsAllowChainErrors {
-		cfg.MongoConnectionString = cfg.MongoConnectionString + "&tlsInsecure=true"
-	}
-	if cfg.TlsAllowInvalidHostnames {
-		cfg.MongoConnectionString = cfg.MongoConnectionString + "&tlsAllowInvalidHostnames=true"
-	}
-
-	client, err = mongo.NewClient(options.Client().ApplyURI(cfg.MongoConnectionString))
-	if err != nil {
-		return client, colRTD, err
-	}
-	err = client.Connect(ctx)
+	client, err = jsonscada.Connect(ctx, cfg)
 	if err != nil {
 		return client, colRTD, err
 	}
@@ -128,7 +70,10 @@ func mongoConnect() (client *mongo.Client, colRTD *mongo.Collection, err error)
 
 func main() {
 
-	client, collection, err := mongoConnect()
+	configFile := flag.String("config", jsonscada.EnvString("JS_CONFIG_FILE", jsonscada.DefaultConfigFile), "json-scada config file (env JS_CONFIG_FILE)")
+	flag.Parse()
+
+	client, collection, err := mongoConnect(*configFile)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -205,7 +150,7 @@ func main() {
 		if errp != nil {
 			log.Printf("%s \n", err)
 			client.Disconnect(context.TODO())
-			client, collection, errp = mongoConnect()
+			client, collection, errp = mongoConnect(*configFile)
 		}
 
 		// find all parcel and current calculated values
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"i104mproto"
+)
+
+// Authenticated datagrams (see i104mproto): HMAC-SHA256 with a key id and a sequence derived from the sender clock
+const authReplayMaxSequences = 1 << 20 // sequences remembered per key inside the time window
+const authMinKeySize = 16
+
+// authentication modes of a connection ("authMode")
+const (
+	AuthModeNone     = "none"     // legacy OSHMI peers, no authentication (default)
+	AuthModeOptional = "optional" // accept authenticated and legacy datagrams (migration), commands are sent unsigned
+	AuthModeRequired = "required" // accept only authenticated datagrams, commands are signed
+)
+
+// HMAC key of a connection, "key" is the secret as hex string (16 bytes or more)
+type AuthKey struct {
+	KeyId int    `bson:"keyId"`
+	Key   string `bson:"key"`
+}
+
+// sequences received with a key inside the time window, datagrams may arrive out of order by up to the clock skew
+type replayState struct {
+	seen      map[uint64]struct{}
+	forgotten uint64 // sequences below were removed from seen (left the time window)
+	nextPrune uint64 // time (sequence units) of the next removal
+}
+
+// Signs and verifies authenticated datagrams of a connection
+type Authenticator struct {
+	mode      string
+	keys      map[uint32][]byte
+	sendKeyId uint32
+	maxSkew   time.Duration
+	sendSeq   i104mproto.Sequence
+	mutex     sync.Mutex
+	replay    map[uint32]*replayState
+}
+
+// nil (no authentication) for mode "none"
+func NewAuthenticator(protCon *ProtocolConnection) (*Authenticator, error) {
+	mode := strings.ToLower(strings.TrimSpace(protCon.AuthMode))
+	switch mode {
+	case "", AuthModeNone:
+		return nil, nil
+	case AuthModeOptional, AuthModeRequired:
+	default:
+		return nil, fmt.Errorf("invalid authMode '%s'", protCon.AuthMode)
+	}
+
+	a := &Authenticator{
+		mode:      mode,
+		keys:      map[uint32][]byte{},
+		sendKeyId: uint32(protCon.AuthSendKeyId),
+		maxSkew:   time.Duration(protCon.AuthMaxClockSkew) * time.Second,
+		replay:    map[uint32]*replayState{},
+	}
+	for _, k := range protCon.AuthKeys {
+		key, err := hex.DecodeString(strings.TrimSpace(k.Key))
+		if err != nil {
+			return nil, fmt.Errorf("invalid authKeys key id %d: %v", k.KeyId, err)
+		}
+		if len(key) < authMinKeySize {
+			return nil, fmt.Errorf("invalid authKeys key id %d: key must have %d bytes or more", k.KeyId, authMinKeySize)
+		}
+		a.keys[uint32(k.KeyId)] = key
+	}
+	if len(a.keys) == 0 {
+		return nil, errors.New("authMode '" + mode + "' requires authKeys")
+	}
+	// received sequences are remembered only inside the time window and are lost on a restart
+	if a.maxSkew <= 0 {
+		return nil, errors.New("authMode '" + mode + "' requires authMaxClockSkew greater than 0")
+	}
+	if mode == AuthModeRequired {
+		if _, ok := a.keys[a.sendKeyId]; !ok {
+			return nil, fmt.Errorf("authSendKeyId %d not found in authKeys", a.sendKeyId)
+		}
+	}
+	return a, nil
+}
+
+// verify an authenticated datagram and return the I104M packet, legacy datagrams are returned as is unless
+// authentication is required
+func (a *Authenticator) Open(datagram []byte, now time.Time) ([]byte, error) {
+	if a == nil {
+		return datagram, nil
+	}
+	if !i104mproto.IsAuthenticated(datagram) {
+		if a.mode == AuthModeRequired {
+			return nil, errors.New("unauthenticated datagram")
+		}
+		return datagram, nil
+	}
+	keyId, seq, payload, err := i104mproto.Verify(datagram, func(keyId uint32) ([]byte, bool) {
+		key, ok := a.keys[keyId]
+		return key, ok
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// sequences far from the local clock are old (replayed) datagrams or a peer with wrong clock
+	skew := time.Duration(int64(seq)-now.UnixNano()/1000) * time.Microsecond
+	if skew > a.maxSkew || skew < -a.maxSkew {
+		return nil, fmt.Errorf("sequence %d out of time window (key id %d)", seq, keyId)
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	state := a.replay[keyId]
+	if state == nil {
+		state = &replayState{seen: map[uint64]struct{}{}}
+		a.replay[keyId] = state
+	}
+	if err := state.accept(seq, uint64(now.UnixNano()/1000), uint64(a.maxSkew/time.Microsecond)); err != nil {
+		return nil, fmt.Errorf("sequence %d (key id %d): %v", seq, keyId, err)
+	}
+	return payload, nil
+}
+
+// sign a frame to send, frames are sent unsigned unless authentication is required
+func (a *Authenticator) Seal(frame []byte, now time.Time) []byte {
+	if a == nil || a.mode != AuthModeRequired {
+		return frame
+	}
+	return i104mproto.Sign(a.sendKeyId, a.keys[a.sendKeyId], a.sendSeq.Next(now), frame)
+}
+
+// check and record a received sequence already checked against the time window (now +- maxSkew),
+// sequences older than the time window are forgotten once a second (still refused if the local clock steps back)
+func (s *replayState) accept(seq uint64, now uint64, maxSkew uint64) error {
+	if now >= s.nextPrune && now > maxSkew {
+		if oldest := now - maxSkew; oldest > s.forgotten {
+			s.forgotten = oldest
+			for old := range s.seen {
+				if old < oldest {
+					delete(s.seen, old)
+				}
+			}
+		}
+		s.nextPrune = now + 1000000
+	}
+	if seq < s.forgotten {
+		return errors.New("older than the replay window")
+	}
+	if _, found := s.seen[seq]; found {
+		return errors.New("replayed")
+	}
+	if len(s.seen) >= authReplayMaxSequences {
+		return errors.New("too many sequences in the time window")
+	}
+	s.seen[seq] = struct{}{}
+	return nil
+}
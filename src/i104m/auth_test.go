@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"i104mproto"
+)
+
+var testAuthKey = bytes.Repeat([]byte{0x5a}, 32)
+
+func newTestAuthenticator(t *testing.T, mode string) *Authenticator {
+	t.Helper()
+	a, err := NewAuthenticator(&ProtocolConnection{
+		AuthMode:         mode,
+		AuthKeys:         []AuthKey{{KeyId: 1, Key: hex.EncodeToString(testAuthKey)}},
+		AuthSendKeyId:    1,
+		AuthMaxClockSkew: 30,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// authenticated datagram with the given key and sequence
+func signedDatagram(keyId uint32, key []byte, seq uint64, frame []byte) []byte {
+	return i104mproto.Sign(keyId, key, seq, frame)
+}
+
+func sequenceAt(t time.Time) uint64 {
+	return uint64(t.UnixNano() / 1000)
+}
+
+func TestAuthSealOpen(t *testing.T) {
+	now := time.Now()
+	sender := newTestAuthenticator(t, AuthModeRequired)
+	receiver := newTestAuthenticator(t, AuthModeRequired)
+	frame := []byte{0x53, 0x53, 0x53, 0x53, 1, 2, 3, 4}
+
+	first := sender.Seal(frame, now)
+	second := sender.Seal(frame, now) // same clock, sequence incremented
+	if len(first) != i104mproto.AuthHeaderSize+len(frame)+i104mproto.AuthMacSize {
+		t.Fatalf("sealed datagram with %d bytes", len(first))
+	}
+	if binary.LittleEndian.Uint64(second[8:]) <= binary.LittleEndian.Uint64(first[8:]) {
+		t.Error("sequence not increased")
+	}
+	for _, datagram := range [][]byte{first, second} {
+		payload, err := receiver.Open(datagram, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(payload, frame) {
+			t.Errorf("payload % x, want % x", payload, frame)
+		}
+	}
+
+	// frames are sent unsigned in optional mode
+	if sealed := newTestAuthenticator(t, AuthModeOptional).Seal(frame, now); !bytes.Equal(sealed, frame) {
+		t.Error("frame signed in optional mode")
+	}
+}
+
+func TestAuthOpenRejected(t *testing.T) {
+	now := time.Now()
+	frame := []byte{0x53, 0x53, 0x53, 0x53, 1, 2, 3, 4}
+	seq := sequenceAt(now)
+
+	badMac := signedDatagram(1, testAuthKey, seq, frame)
+	badMac[len(badMac)-1] ^= 1
+	tampered := signedDatagram(1, testAuthKey, seq, frame)
+	tampered[i104mproto.AuthHeaderSize] ^= 1
+	otherKey := bytes.Repeat([]byte{0x11}, 32)
+
+	tests := []struct {
+		name     string
+		datagram []byte
+		err      string
+	}{
+		{"bad HMAC", badMac, "invalid HMAC"},
+		{"tampered payload", tampered, "invalid HMAC"},
+		{"signed with other key", signedDatagram(1, otherKey, seq, frame), "invalid HMAC"},
+		{"unknown key id", signedDatagram(2, testAuthKey, seq, frame), "unknown key id 2"},
+		{"too short", signedDatagram(1, testAuthKey, seq, nil), "too short"},
+		{"sequence in the past", signedDatagram(1, testAuthKey, sequenceAt(now.Add(-31*time.Second)), frame), "out of time window"},
+		{"sequence in the future", signedDatagram(1, testAuthKey, sequenceAt(now.Add(31*time.Second)), frame), "out of time window"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := newTestAuthenticator(t, AuthModeRequired).Open(test.datagram, now)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("error %v, want %q", err, test.err)
+			}
+		})
+	}
+
+	// within the skew
+	a := newTestAuthenticator(t, AuthModeRequired)
+	if _, err := a.Open(signedDatagram(1, testAuthKey, sequenceAt(now.Add(-29*time.Second)), frame), now); err != nil {
+		t.Errorf("sequence within the skew rejected: %v", err)
+	}
+}
+
+func TestAuthReplay(t *testing.T) {
+	now := time.Now()
+	base := sequenceAt(now)
+	ms := uint64(time.Millisecond / time.Microsecond)
+	frame := []byte{0x53, 0x53, 0x53, 0x53, 1, 2, 3, 4}
+
+	steps := []struct {
+		at     time.Duration // local clock, relative to now
+		seq    uint64        // relative to base
+		accept bool
+	}{
+		{0, 100 * ms, true},
+		{0, 100 * ms, false}, // same sequence
+		{0, 110 * ms, true},
+		{0, 105 * ms, true},             // reordered by milliseconds
+		{0, 105 * ms, false},            // replay of a reordered datagram
+		{0, 100 * ms, false},            // replay of the first
+		{time.Second, 0, true},          // behind the highest by more than a second, within the skew
+		{time.Second, 110*ms + 1, true}, // another sender on the same key id, interleaved
+		{2 * time.Second, 0, false},
+		{20 * time.Second, 105 * ms, false}, // still remembered inside the time window
+		{35 * time.Second, 6000 * ms, true},
+		{35 * time.Second, 100 * ms, false}, // out of the time window
+		{time.Second, 110 * ms, false},      // clock stepped back: forgotten sequences are still refused
+		{time.Second, 5500 * ms, true},
+	}
+	a := newTestAuthenticator(t, AuthModeRequired)
+	for i, step := range steps {
+		_, err := a.Open(signedDatagram(1, testAuthKey, base+step.seq, frame), now.Add(step.at))
+		if (err == nil) != step.accept {
+			t.Errorf("step %d sequence +%dus at +%v: error %v, want accepted %v", i, step.seq, step.at, err, step.accept)
+		}
+	}
+	// sequences that left the time window are forgotten
+	if n := len(a.replay[1].seen); n != 2 {
+		t.Errorf("%d sequences remembered, want 2", n)
+	}
+
+	// sequences are tracked per key
+	b, err := NewAuthenticator(&ProtocolConnection{
+		AuthMode:         AuthModeRequired,
+		AuthKeys:         []AuthKey{{KeyId: 1, Key: hex.EncodeToString(testAuthKey)}, {KeyId: 2, Key: hex.EncodeToString(testAuthKey)}},
+		AuthSendKeyId:    1,
+		AuthMaxClockSkew: 30,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, keyId := range []uint32{1, 2} {
+		if _, err := b.Open(signedDatagram(keyId, testAuthKey, base, frame), now); err != nil {
+			t.Errorf("key id %d: %v", keyId, err)
+		}
+	}
+}
+
+func TestAuthUnsignedFrames(t *testing.T) {
+	now := time.Now()
+	frame := []byte{0x53, 0x53, 0x53, 0x53, 1, 2, 3, 4}
+
+	if payload, err := newTestAuthenticator(t, AuthModeOptional).Open(frame, now); err != nil || !bytes.Equal(payload, frame) {
+		t.Errorf("optional: unsigned frame %v % x", err, payload)
+	}
+	if _, err := newTestAuthenticator(t, AuthModeRequired).Open(frame, now); err == nil {
+		t.Error("required: unsigned frame accepted")
+	}
+	// a signed frame is verified also in optional mode
+	badMac := signedDatagram(1, testAuthKey, sequenceAt(now), frame)
+	badMac[len(badMac)-1] ^= 1
+	if _, err := newTestAuthenticator(t, AuthModeOptional).Open(badMac, now); err == nil {
+		t.Error("optional: bad HMAC accepted")
+	}
+	var none *Authenticator
+	if payload, err := none.Open(frame, now); err != nil || !bytes.Equal(none.Seal(payload, now), frame) {
+		t.Error("no authentication: frame changed")
+	}
+}
+
+func TestNewAuthenticator(t *testing.T) {
+	key := AuthKey{KeyId: 1, Key: hex.EncodeToString(testAuthKey)}
+	tests := []struct {
+		name    string
+		protCon ProtocolConnection
+		err     string // "" if valid
+	}{
+		{"none", ProtocolConnection{AuthMode: "none"}, ""},
+		{"default", ProtocolConnection{}, ""},
+		{"required", ProtocolConnection{AuthMode: " Required ", AuthKeys: []AuthKey{key}, AuthSendKeyId: 1, AuthMaxClockSkew: 30}, ""},
+		{"invalid mode", ProtocolConnection{AuthMode: "strict"}, "invalid authMode"},
+		{"no keys", ProtocolConnection{AuthMode: "optional", AuthMaxClockSkew: 30}, "requires authKeys"},
+		{"short key", ProtocolConnection{AuthMode: "optional", AuthKeys: []AuthKey{{KeyId: 1, Key: "00112233"}}, AuthMaxClockSkew: 30}, "16 bytes or more"},
+		{"key not hex", ProtocolConnection{AuthMode: "optional", AuthKeys: []AuthKey{{KeyId: 1, Key: "xyz"}}, AuthMaxClockSkew: 30}, "invalid authKeys"},
+		{"send key missing", ProtocolConnection{AuthMode: "required", AuthKeys: []AuthKey{key}, AuthSendKeyId: 2, AuthMaxClockSkew: 30}, "authSendKeyId 2"},
+		{"no clock skew", ProtocolConnection{AuthMode: "required", AuthKeys: []AuthKey{key}, AuthSendKeyId: 1}, "authMaxClockSkew"},
+		{"no clock skew, optional", ProtocolConnection{AuthMode: "optional", AuthKeys: []AuthKey{key}}, "authMaxClockSkew"},
+	}
+	for _, test := range tests {
+		_, err := NewAuthenticator(&test.protCon)
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
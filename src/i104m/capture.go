@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// One received I104M packet in a capture file (JSON lines)
+type CaptureRecord struct {
+	Time time.Time `json:"time"`
+	From string    `json:"from"`
+	Data string    `json:"data"` // packet bytes as hex
+}
+
+// Records received packets with timestamps to a capture file
+type CaptureWriter struct {
+	mutex   sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// open capture file for append, nil when no file name
+func NewCaptureWriter(fileName string) (*CaptureWriter, error) {
+	if fileName == "" {
+		return nil, nil
+	}
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Capturing packets to ", fileName)
+	return &CaptureWriter{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+func (w *CaptureWriter) Write(from string, packet []byte, t time.Time) {
+	if w == nil {
+		return
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if err := w.encoder.Encode(CaptureRecord{Time: t, From: from, Data: hex.EncodeToString(packet)}); err != nil {
+		log.Println("Capture write error: ", err)
+	}
+}
+
+func (w *CaptureWriter) Close() error {
+	if w == nil {
+		return nil
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.file.Close()
+}
+
+// read the records of a capture file in order, stops at the first error returned by handle
+func readCapture(fileName string, handle func(rec CaptureRecord, packet []byte) error) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 256*1024), 256*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var rec CaptureRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return fmt.Errorf("%s line %d: %v", fileName, line, err)
+		}
+		packet, err := hex.DecodeString(rec.Data)
+		if err != nil {
+			return fmt.Errorf("%s line %d: %v", fileName, line, err)
+		}
+		if err := handle(rec, packet); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// authenticator to sign replayed packets for a connection with authMode "required", nil when no key is given.
+// Captured packets are recorded after authentication, so they are signed again with new sequences.
+func newReplayAuthenticator(keyId int, hexKey string) (*Authenticator, error) {
+	if hexKey == "" {
+		return nil, nil
+	}
+	auth, err := NewAuthenticator(&ProtocolConnection{
+		AuthMode:         AuthModeRequired,
+		AuthKeys:         []AuthKey{{KeyId: keyId, Key: hexKey}},
+		AuthSendKeyId:    keyId,
+		AuthMaxClockSkew: 1, // not used to sign
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid replay authentication key: %v", err)
+	}
+	return auth, nil
+}
+
+// send the packets of a capture file via UDP to a driver instance (address:port), keeping the original intervals
+// divided by speed (speed 0 = no delay). Packets are signed when auth is not nil.
+func replayCapture(ctx context.Context, fileName string, target string, speed float64, auth *Authenticator) error {
+	addr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	log.Printf("Replaying %s to %s, speed %g", fileName, target, speed)
+	var first time.Time
+	start := time.Now()
+	count := 0
+	errCanceled := errors.New("replay canceled")
+	err = readCapture(fileName, func(rec CaptureRecord, packet []byte) error {
+		if first.IsZero() {
+			first = rec.Time
+		}
+		if speed > 0 {
+			due := start.Add(time.Duration(float64(rec.Time.Sub(first)) / speed))
+			select {
+			case <-ctx.Done():
+				return errCanceled
+			case <-time.After(time.Until(due)):
+			}
+		} else if ctx.Err() != nil {
+			return errCanceled
+		}
+
+		if _, err := conn.Write(auth.Seal(packet, time.Now())); err != nil {
+			return err
+		}
+		count++
+		if LogLevel >= LogLevelDetailed {
+			log.Printf("Replayed %d bytes captured at %s from %s", len(packet), rec.Time.Format(time.RFC3339Nano), rec.From)
+		}
+		return nil
+	})
+	if err == errCanceled {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Replay finished, %d packets sent.", count)
+	return nil
+}
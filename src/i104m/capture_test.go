@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCaptureRoundTrip(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "capture.jsonl")
+	t0 := time.Date(2024, 3, 1, 10, 0, 0, 123456789, time.UTC)
+	packets := [][]byte{
+		singlePacket(t, COT_SPONTANEOUS, PointUpdate{ObjAddr: 100, Asdu: 1, Value: 1}),
+		sequencePacket(t, 13, COT_INTERROGATED_BY_STATION, PointUpdate{ObjAddr: 200, Value: 2.5}),
+	}
+
+	// appended across writers
+	for i, packet := range packets {
+		w, err := NewCaptureWriter(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write("10.0.0.1", packet, t0.Add(time.Duration(i)*time.Second))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var recs []CaptureRecord
+	var read [][]byte
+	err := readCapture(fileName, func(rec CaptureRecord, packet []byte) error {
+		recs = append(recs, rec)
+		read = append(read, packet)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != len(packets) {
+		t.Fatalf("%d packets read, want %d", len(read), len(packets))
+	}
+	for i := range packets {
+		if !bytes.Equal(read[i], packets[i]) || recs[i].From != "10.0.0.1" || !recs[i].Time.Equal(t0.Add(time.Duration(i)*time.Second)) {
+			t.Errorf("record %d: %+v", i, recs[i])
+		}
+	}
+
+	if w, err := NewCaptureWriter(""); w != nil || err != nil {
+		t.Error("capture writer without file")
+	}
+	var none *CaptureWriter
+	none.Write("10.0.0.1", packets[0], t0) // disabled
+}
+
+func TestReadCaptureErrors(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{"invalid json", `{"time": "2024-03-01T10:00:00Z", "data": "0102"}` + "\n" + `{"time": `, "line 2"},
+		{"invalid hex", `{"time": "2024-03-01T10:00:00Z", "data": "zz"}`, "line 1"},
+	}
+	for _, test := range tests {
+		fileName := filepath.Join(dir, test.name)
+		if err := os.WriteFile(fileName, []byte(test.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := readCapture(fileName, func(rec CaptureRecord, packet []byte) error { return nil })
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error %v, want %q", test.name, err, test.err)
+		}
+	}
+	if err := readCapture(filepath.Join(dir, "none"), nil); err == nil {
+		t.Error("missing file read")
+	}
+}
+
+// replay to a driver with authMode "required": packets are signed again and accepted
+func TestReplayCaptureSigned(t *testing.T) {
+	driver, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip("UDP loopback not available: ", err)
+	}
+	defer driver.Close()
+
+	fileName := filepath.Join(t.TempDir(), "capture.jsonl")
+	w, err := NewCaptureWriter(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := singlePacket(t, COT_SPONTANEOUS, PointUpdate{ObjAddr: 100, Asdu: 1, Value: 1})
+	t0 := time.Now().Add(-time.Hour) // captured long ago, out of the time window of the original sequence
+	w.Write("10.0.0.1", packet, t0)
+	w.Write("10.0.0.1", packet, t0.Add(time.Millisecond)) // same packet again, signed with a new sequence
+	w.Close()
+
+	auth, err := newReplayAuthenticator(1, hex.EncodeToString(testAuthKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replayCapture(context.Background(), fileName, driver.LocalAddr().String(), 0, auth); err != nil {
+		t.Fatal(err)
+	}
+
+	receiver := newTestAuthenticator(t, AuthModeRequired)
+	buf := make([]byte, 2048)
+	for i := 0; i < 2; i++ {
+		driver.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := driver.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, err := receiver.Open(buf[:n], time.Now())
+		if err != nil {
+			t.Fatalf("packet %d not accepted: %v", i, err)
+		}
+		if !bytes.Equal(payload, packet) {
+			t.Errorf("packet %d: % x", i, payload)
+		}
+	}
+
+	if _, err := newReplayAuthenticator(1, "0011"); err == nil {
+		t.Error("short key accepted")
+	}
+	if auth, err := newReplayAuthenticator(1, ""); auth != nil || err != nil {
+		t.Error("authenticator without key")
+	}
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"i104mproto"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const CommandExpiration = 10 * time.Second
+const DefaultCommandTimeout = 30 // seconds
+const CommandsArchiveCollectionName = "commandsQueueArchive"
+const CommandsArchiveBatchSize = 1000
+
+type Command struct {
+	Id                             primitive.ObjectID `json:"_id" bson:"_id"`
+	ProtocolSourceConnectionNumber int                `json: "protocolSourceConnectionNumber"`
+	ProtocolSourceCommonAddress    int                `json: "protocolSourceCommonAddress"`
+	ProtocolSourceObjectAddress    int                `json: "protocolSourceObjectAddress"`
+	ProtocolSourceASDU             int                `json: "protocolSourceASDU"`
+	ProtocolSourceCommandDuration  int                `json: "protocolSourceCommandDuration"`
+	ProtocolSourceCommandUseSBO    bool               `json: "protocolSourceCommandUseSBO"`
+	PointKey                       int                `json: "pointKey"`
+	Tag                            string             `json: "tag"`
+	TimeTag                        time.Time          `json: "timeTag"`
+	Value                          float64            `json: "value"`
+	ValueString                    string             `json: "valueString"`
+	OriginatorUserName             string             `json: "originatorUserName"`
+	OriginatorIpAddress            string             `json: "originatorIpAddress"`
+}
+
+type InsertChange struct {
+	FullDocument  Command `json: "fullDocument"`
+	OperationType string  `json: "operationType"`
+}
+
+// States of the command lifecycle, written to "state" on commandsQueue with the time of each transition ("<state>TimeTag")
+const (
+	CommandQueued     = "queued"     // received by the driver
+	CommandSelected   = "selected"   // select confirmed by the peer (select before operate)
+	CommandSent       = "sent"       // frame delivered to the peers
+	CommandConfirmed  = "confirmed"  // activation confirmed by the peer, final unless a termination follows
+	CommandTerminated = "terminated" // activation terminated by the peer
+	CommandFailed     = "failed"     // not delivered or rejected by the peer
+	CommandExpired    = "expired"    // too old to be sent or not confirmed in time
+	CommandCancelled  = "cancelled"  // refused by the driver or deactivated
+)
+
+// states a command can come from for each state ("" = state not set, as inserted by the HMI).
+// Late confirmations do not move commands already in a final state.
+var commandTransitions = map[string][]string{
+	CommandQueued:     {""},
+	CommandSent:       {CommandQueued},
+	CommandSelected:   {CommandSent},
+	CommandConfirmed:  {CommandSent, CommandSelected},
+	CommandTerminated: {CommandSent, CommandSelected, CommandConfirmed},
+	CommandFailed:     {CommandQueued, CommandSent, CommandSelected},
+	CommandExpired:    {"", CommandQueued, CommandSent, CommandSelected},
+	CommandCancelled:  {"", CommandQueued, CommandSent, CommandSelected},
+}
+
+// states waiting for the driver or the peer, expired by the reconciler when stuck.
+// Confirmed commands are not expired: the termination (cause 10) is optional and many peers never send it.
+var commandPendingStates = []string{CommandQueued, CommandSent, CommandSelected}
+
+func validCommandTransition(from string, to string) bool {
+	for _, state := range commandTransitions[to] {
+		if state == from {
+			return true
+		}
+	}
+	return false
+}
+
+// Lifecycle of commands (commandsQueue)
+type CommandStore interface {
+	// record a transition of a command, reason is written as cancelReason
+	SetState(id primitive.ObjectID, state string, reason string, t time.Time)
+	// expire commands of the connection waiting in a pending state (not confirmed) for more than timeout, returns the number expired
+	ExpireStale(connectionNumber int, timeout time.Duration, now time.Time) (int, error)
+	// move commands of the connection finished for more than age to the archive collection, returns the number archived
+	Archive(connectionNumber int, age time.Duration, now time.Time) (int, error)
+}
+
+type mongoCommandStore struct {
+	collection        *mongo.Collection
+	collectionArchive *mongo.Collection
+}
+
+func newMongoCommandStore(collection *mongo.Collection) *mongoCommandStore {
+	return &mongoCommandStore{
+		collection:        collection,
+		collectionArchive: collection.Database().Collection(CommandsArchiveCollectionName),
+	}
+}
+
+// filter for commands in one of the states (missing state for "")
+func commandStatesFilter(states []string) bson.D {
+	in := bson.A{}
+	for _, state := range states {
+		if state == "" {
+			in = append(in, nil)
+		} else {
+			in = append(in, state)
+		}
+	}
+	return bson.D{{"$in", in}}
+}
+
+// write a state transition of a command, also the fields of older versions read by the HMI
+// ("delivered", "ack", "ackTimeTag" and "cancelReason")
+func (s *mongoCommandStore) SetState(id primitive.ObjectID, state string, reason string, t time.Time) {
+	set := bson.D{
+		{"state", state},
+		{"stateTimeTag", t},
+		{state + "TimeTag", t},
+	}
+	switch state {
+	case CommandSent:
+		set = append(set, bson.E{"delivered", true}, bson.E{"ack", true}, bson.E{"ackTimeTag", t})
+	case CommandFailed:
+		set = append(set, bson.E{"ack", false}, bson.E{"ackTimeTag", t})
+	}
+	if reason != "" {
+		set = append(set, bson.E{"cancelReason", reason})
+	}
+	res, err := s.collection.UpdateOne(
+		context.TODO(),
+		bson.D{{"_id", id}, {"state", commandStatesFilter(commandTransitions[state])}},
+		bson.D{{"$set", set}},
+	)
+	if err != nil {
+		log.Println(err)
+		log.Println("Can not write update to command on mongo!")
+		return
+	}
+	if res.MatchedCount == 0 && LogLevel >= LogLevelDetailed {
+		log.Printf("Command %s not moved to %s, already finished.", id.Hex(), state)
+	}
+}
+
+func (s *mongoCommandStore) ExpireStale(connectionNumber int, timeout time.Duration, now time.Time) (int, error) {
+	limit := now.Add(-timeout)
+	expire := func(filter bson.D, reason string) (int, error) {
+		res, err := s.collection.UpdateMany(context.TODO(), filter, bson.D{{"$set", bson.D{
+			{"state", CommandExpired},
+			{"stateTimeTag", now},
+			{"expiredTimeTag", now},
+			{"cancelReason", reason},
+		}}})
+		if err != nil {
+			return 0, err
+		}
+		return int(res.ModifiedCount), nil
+	}
+
+	// sent, not confirmed by the peer
+	nSent, err := expire(bson.D{
+		{"protocolSourceConnectionNumber", connectionNumber},
+		{"state", commandStatesFilter([]string{CommandSent, CommandSelected})},
+		{"stateTimeTag", bson.D{{"$lt", limit}}},
+	}, "no confirmation")
+	if err != nil {
+		return 0, err
+	}
+	// never sent (driver stopped or inactive), older versions did not write a state
+	nQueued, err := expire(bson.D{
+		{"protocolSourceConnectionNumber", connectionNumber},
+		{"$or", bson.A{
+			bson.D{
+				{"state", CommandQueued},
+				{"stateTimeTag", bson.D{{"$lt", limit}}},
+			},
+			bson.D{
+				{"state", bson.D{{"$exists", false}}},
+				{"delivered", bson.D{{"$ne", true}}},
+				{"cancelReason", bson.D{{"$exists", false}}},
+				{"timeTag", bson.D{{"$lt", limit}}},
+			},
+		}},
+	}, "expired")
+	return nSent + nQueued, err
+}
+
+func (s *mongoCommandStore) Archive(connectionNumber int, age time.Duration, now time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var commands []bson.Raw
+	cursor, err := s.collection.Find(ctx,
+		bson.D{
+			{"protocolSourceConnectionNumber", connectionNumber},
+			{"state", bson.D{{"$nin", commandPendingStates}}},
+			{"timeTag", bson.D{{"$lt", now.Add(-age)}}},
+		},
+		options.Find().SetLimit(CommandsArchiveBatchSize))
+	if err != nil {
+		return 0, err
+	}
+	if err = cursor.All(ctx, &commands); err != nil {
+		return 0, err
+	}
+	if len(commands) == 0 {
+		return 0, nil
+	}
+
+	docs := make([]interface{}, 0, len(commands))
+	ids := bson.A{}
+	for _, command := range commands {
+		docs = append(docs, command)
+		ids = append(ids, command.Lookup("_id"))
+	}
+	// commands already archived by an interrupted run are duplicates
+	if _, err = s.collectionArchive.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false)); err != nil && !mongo.IsDuplicateKeyError(err) {
+		return 0, err
+	}
+	res, err := s.collection.DeleteMany(ctx, bson.D{{"_id", bson.D{{"$in", ids}}}})
+	if err != nil {
+		return 0, err
+	}
+	return int(res.DeletedCount), nil
+}
+
+// Commands sent to the peers waiting for confirmation, by object address.
+// Confirmations (ASDUs 45-64 received with causes 7, 9, 10 and 44-47) move the commands to the next state.
+// The pending commands are changed under the mutex, the states are written to the store after releasing it.
+type CommandTracker struct {
+	store       CommandStore
+	mutex       sync.Mutex
+	pending     map[uint32]pendingCommand
+	commandDefs *CommandDefs
+	stats       *TrafficStats
+	timeout     time.Duration // confirmations received later are ignored
+}
+
+type pendingCommand struct {
+	id       primitive.ObjectID
+	asdu     uint32
+	sbo      bool
+	sentTime time.Time
+	writes   *sync.Mutex // orders the state writes of the command (sent first)
+}
+
+func NewCommandTracker(store CommandStore) *CommandTracker {
+	return &CommandTracker{store: store, pending: map[uint32]pendingCommand{}, timeout: DefaultCommandTimeout * time.Second}
+}
+
+// time to wait for the confirmation of a command ("commandTimeout")
+func commandTimeout(protCon *ProtocolConnection) time.Duration {
+	if protCon.CommandTimeout <= 0 {
+		return DefaultCommandTimeout * time.Second
+	}
+	return time.Duration(protCon.CommandTimeout) * time.Second
+}
+
+// replace command point definitions (reloaded)
+func (tr *CommandTracker) SetCommandDefs(defs *CommandDefs) {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	tr.commandDefs = defs
+}
+
+// resolve the protocol address of a command from its point definition (by point key, or by tag when the key is not set).
+// Addresses copied to the command by the client must match the configuration, a stale client can not operate other device.
+func (tr *CommandTracker) resolve(cmd Command) (Command, error) {
+	tr.mutex.Lock()
+	defs := tr.commandDefs
+	tr.mutex.Unlock()
+	if defs == nil {
+		return cmd, errors.New("command points not loaded")
+	}
+
+	tag := strings.TrimSpace(cmd.Tag)
+	var def *PointDef
+	switch {
+	case cmd.PointKey != 0:
+		def = defs.byKey[cmd.PointKey]
+		if def != nil && tag != "" && tag != strings.TrimSpace(def.Tag) {
+			return cmd, fmt.Errorf("tag %s does not match point key %d", tag, cmd.PointKey)
+		}
+	case tag != "":
+		def = defs.byTag[tag]
+	default:
+		return cmd, errors.New("command without tag or point key")
+	}
+	if def == nil {
+		return cmd, errors.New("command point not found")
+	}
+
+	objAddr := int(def.ProtocolSourceObjectAddress)
+	asdu := int(def.ProtocolSourceASDU)
+	commonAddr := int(def.ProtocolSourceCommonAddress)
+	if cmd.ProtocolSourceObjectAddress != 0 && cmd.ProtocolSourceObjectAddress != objAddr ||
+		cmd.ProtocolSourceASDU != 0 && cmd.ProtocolSourceASDU != asdu ||
+		cmd.ProtocolSourceCommonAddress != 0 && cmd.ProtocolSourceCommonAddress != commonAddr {
+		return cmd, fmt.Errorf("address mismatch: command %d/%d ASDU %d, configured %d/%d ASDU %d",
+			cmd.ProtocolSourceCommonAddress, cmd.ProtocolSourceObjectAddress, cmd.ProtocolSourceASDU,
+			commonAddr, objAddr, asdu)
+	}
+	cmd.ProtocolSourceObjectAddress = objAddr
+	cmd.ProtocolSourceASDU = asdu
+	cmd.ProtocolSourceCommonAddress = commonAddr
+	cmd.ProtocolSourceCommandDuration = int(def.ProtocolSourceCommandDuration)
+	cmd.ProtocolSourceCommandUseSBO = def.ProtocolSourceCommandUseSBO
+	return cmd, nil
+}
+
+// record a command sent and wait for its confirmation, replaces a previous command to the same address.
+// A fast confirmation waits for the write of the sent state (writes of the command are ordered).
+func (tr *CommandTracker) sent(cmd Command, now time.Time) {
+	writes := &sync.Mutex{}
+	writes.Lock()
+	defer writes.Unlock()
+	tr.mutex.Lock()
+	tr.pending[uint32(cmd.ProtocolSourceObjectAddress)] = pendingCommand{
+		id:       cmd.Id,
+		asdu:     uint32(cmd.ProtocolSourceASDU),
+		sbo:      cmd.ProtocolSourceCommandUseSBO,
+		sentTime: now,
+		writes:   writes,
+	}
+	tr.mutex.Unlock()
+	tr.store.SetState(cmd.Id, CommandSent, "", now)
+	tr.stats.CommandSent()
+}
+
+// process a command confirmation from the peer, info is the information object received (qualifier first)
+func (tr *CommandTracker) Confirm(objAddr uint32, iecAsdu uint32, cot CauseOfTransmission, info []byte, now time.Time) {
+	tr.mutex.Lock()
+	cmd, found := tr.pending[objAddr]
+	if found && now.Sub(cmd.sentTime) > tr.timeout { // expired (or confirmed and final), not yet pruned
+		delete(tr.pending, objAddr)
+		found = false
+	}
+	if !found || cmd.asdu != iecAsdu {
+		tr.mutex.Unlock()
+		if LogLevel >= LogLevelDetailed {
+			log.Println("Confirmation of unknown command ", objAddr, " ", iecAsdu, " ", cot)
+		}
+		return
+	}
+
+	state, reason := "", ""
+	switch {
+	case cot.Cause >= 44 && cot.Cause <= 47: // unknown type, cause, common address or object address
+		state, reason = CommandFailed, "rejected by peer: "+cot.String()
+		delete(tr.pending, objAddr)
+	case cot.Cause == COT_ACTIVATION_CON && cot.Negative:
+		state, reason = CommandFailed, "negative confirmation"
+		delete(tr.pending, objAddr)
+	case cot.Cause == COT_ACTIVATION_CON && cmd.sbo && isSelect(iecAsdu, info):
+		state = CommandSelected
+	case cot.Cause == COT_ACTIVATION_CON:
+		state = CommandConfirmed
+	case cot.Cause == COT_ACTIVATION_TERMINATION:
+		state = CommandTerminated
+		delete(tr.pending, objAddr)
+	case cot.Cause == COT_DEACTIVATION_CON:
+		state, reason = CommandCancelled, "deactivated"
+		delete(tr.pending, objAddr)
+	}
+	tr.mutex.Unlock()
+	if state == "" {
+		return
+	}
+
+	cmd.writes.Lock()
+	defer cmd.writes.Unlock()
+	tr.store.SetState(cmd.id, state, reason, now)
+	switch state {
+	case CommandFailed:
+		tr.stats.CommandFailed()
+	case CommandConfirmed:
+		tr.stats.CommandConfirmed()
+	}
+}
+
+// forget commands sent before the limit, they are expired by the reconciler
+func (tr *CommandTracker) prune(limit time.Time) {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	for objAddr, cmd := range tr.pending {
+		if cmd.sentTime.Before(limit) {
+			delete(tr.pending, objAddr)
+		}
+	}
+}
+
+// command ASDUs (45-51 and with time tag 58-64)
+func isCommandAsdu(iecAsdu uint32) bool {
+	return iecAsdu >= 45 && iecAsdu <= 51 || iecAsdu >= 58 && iecAsdu <= 64
+}
+
+// S/E bit of the qualifier of single, double and step commands, set on select confirmations
+func isSelect(iecAsdu uint32, info []byte) bool {
+	switch iecAsdu {
+	case 45, 46, 47, 58, 59, 60:
+		return len(info) > 0 && info[0]&0x80 == 0x80
+	}
+	return false
+}
+
+// process commands from change stream, forward commands to the peers. Returns when the context is canceled,
+// a command being processed is finished before.
+func iterateChangeStream(routineCtx context.Context, stream *mongo.ChangeStream, protCon *ProtocolConnection, tracker *CommandTracker) error {
+	defer stream.Close(context.Background())
+	for stream.Next(routineCtx) {
+		if !isActive() { // commands are handled by the active node
+			continue
+		}
+
+		var insDoc InsertChange
+		if err := stream.Decode(&insDoc); err != nil {
+			log.Println(err)
+			continue
+		}
+
+		if insDoc.OperationType == "insert" && insDoc.FullDocument.ProtocolSourceConnectionNumber == protCon.ProtocolConnectionNumber {
+			forwardCommand(insDoc.FullDocument, protCon, tracker, time.Now())
+		}
+	}
+	if routineCtx.Err() != nil {
+		return nil
+	}
+	return fmt.Errorf("commands change stream closed: %v", stream.Err())
+}
+
+// send a command of the connection to the I104M peers, the state of the command is written to the store
+func forwardCommand(cmd Command, protCon *ProtocolConnection, tracker *CommandTracker, now time.Time) {
+	log.Printf("Command received on connection %d, %s %f", cmd.ProtocolSourceConnectionNumber, cmd.Tag, cmd.Value)
+	store := tracker.store
+
+	// test for time expired, if too old command (> 10s) then cancel it
+	if now.Sub(cmd.TimeTag) > CommandExpiration {
+		log.Println("Command expired ", now.Sub(cmd.TimeTag))
+		store.SetState(cmd.Id, CommandExpired, "expired", now)
+		return
+	}
+
+	cmd, err := tracker.resolve(cmd)
+	if err != nil {
+		log.Println("Command rejected: ", err)
+		store.SetState(cmd.Id, CommandCancelled, err.Error(), now)
+		return
+	}
+	store.SetState(cmd.Id, CommandQueued, "", now)
+
+	// All is ok, so send command to I104M peers
+	var sbo uint32 = 0
+	if cmd.ProtocolSourceCommandUseSBO {
+		sbo = 1
+	}
+	buf := i104mproto.CommandFrame(i104mproto.Command{
+		Addr:   uint32(cmd.ProtocolSourceObjectAddress),
+		TiType: uint32(cmd.ProtocolSourceASDU),
+		Value:  uint32(cmd.Value),
+		Sbo:    sbo,
+		Qu:     uint32(cmd.ProtocolSourceCommandDuration),
+		Ca:     uint32(cmd.ProtocolSourceCommonAddress),
+	})
+
+	ok, err_msg := i104mSendToPeers(protCon, buf)
+	if ok == true {
+		tracker.sent(cmd, now)
+	} else {
+		store.SetState(cmd.Id, CommandFailed, err_msg, now)
+		tracker.stats.CommandFailed()
+		log.Println("Command canceled!")
+	}
+}
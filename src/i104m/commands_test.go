@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"i104mproto"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func newTestCommand(now time.Time) Command {
+	return Command{
+		Id:                             primitive.NewObjectID(),
+		ProtocolSourceConnectionNumber: 1,
+		ProtocolSourceCommonAddress:    7,
+		ProtocolSourceObjectAddress:    6001,
+		ProtocolSourceASDU:             46,
+		ProtocolSourceCommandDuration:  1,
+		ProtocolSourceCommandUseSBO:    true,
+		Tag:                            "BRK1",
+		TimeTag:                        now.Add(-time.Second),
+		Value:                          2,
+	}
+}
+
+// fields of a command frame, after the signature
+func commandFrameFields(t *testing.T, frame []byte) []uint32 {
+	t.Helper()
+	if len(frame) != 28 || binary.LittleEndian.Uint32(frame) != i104mproto.CommandSignature {
+		t.Fatalf("not a command frame: % x", frame)
+	}
+	fields := make([]uint32, 6)
+	for i := range fields {
+		fields[i] = binary.LittleEndian.Uint32(frame[4+4*i:])
+	}
+	return fields
+}
+
+// command points BRK1 (point key 101, address 6001) and BRK2 (102, 6002)
+func testCommandDefs() *CommandDefs {
+	return newCommandDefs([]*PointDef{
+		{Id: 101, Tag: "BRK1", Origin: "command", ProtocolSourceObjectAddress: 6001, ProtocolSourceCommonAddress: 7,
+			ProtocolSourceASDU: 46, ProtocolSourceCommandDuration: 1, ProtocolSourceCommandUseSBO: true},
+		{Id: 102, Tag: "BRK2", Origin: "command", ProtocolSourceObjectAddress: 6002, ProtocolSourceCommonAddress: 7,
+			ProtocolSourceASDU: 46, ProtocolSourceCommandDuration: 1, ProtocolSourceCommandUseSBO: true},
+	})
+}
+
+// tracker with the test command points, commands inserted on the fake store are sent on the fake transport
+func newTestTracker(t *testing.T, failMsg string) (*CommandTracker, *fakeCommandStore, *ProtocolConnection, *fakeTransport) {
+	t.Helper()
+	store := newFakeCommandStore()
+	transport := &fakeTransport{failMsg: failMsg}
+	tracker := NewCommandTracker(store)
+	tracker.SetCommandDefs(testCommandDefs())
+	return tracker, store, &ProtocolConnection{ProtocolConnectionNumber: 1, transport: transport}, transport
+}
+
+func checkCommandState(t *testing.T, store *fakeCommandStore, id primitive.ObjectID, state string, reason string) {
+	t.Helper()
+	c := store.commands[id]
+	if c == nil {
+		t.Fatalf("command %s not found", id.Hex())
+	}
+	if c.state != state || c.reason != reason {
+		t.Errorf("command state %q reason %q, want %q %q", c.state, c.reason, state, reason)
+	}
+	if _, found := c.timeTags[state]; state != "" && !found {
+		t.Errorf("time of transition to %s not recorded", state)
+	}
+}
+
+func TestForwardCommand(t *testing.T) {
+	now := time.Now()
+	tracker, store, protCon, transport := newTestTracker(t, "")
+	cmd := newTestCommand(now)
+	store.insert(cmd)
+
+	forwardCommand(cmd, protCon, tracker, now)
+	checkCommandState(t, store, cmd.Id, CommandSent, "")
+	if _, found := store.commands[cmd.Id].timeTags[CommandQueued]; !found {
+		t.Error("command not queued before sent")
+	}
+	if len(transport.sent) != 1 {
+		t.Fatalf("want 1 frame sent, got %d", len(transport.sent))
+	}
+	// addr, tiType, value, sbo, qu, ca
+	want := []uint32{6001, 46, 2, 1, 1, 7}
+	got := commandFrameFields(t, transport.sent[0])
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("frame fields: got %v, want %v", got, want)
+			break
+		}
+	}
+}
+
+func TestForwardCommandExpired(t *testing.T) {
+	now := time.Now()
+	tracker, store, protCon, transport := newTestTracker(t, "")
+	cmd := newTestCommand(now)
+	cmd.TimeTag = now.Add(-CommandExpiration - time.Second)
+	store.insert(cmd)
+
+	forwardCommand(cmd, protCon, tracker, now)
+	checkCommandState(t, store, cmd.Id, CommandExpired, "expired")
+	if len(transport.sent) != 0 {
+		t.Error("expired command sent")
+	}
+}
+
+func TestForwardCommandSendError(t *testing.T) {
+	now := time.Now()
+	tracker, store, protCon, _ := newTestTracker(t, "UDP send error")
+	cmd := newTestCommand(now)
+	store.insert(cmd)
+
+	forwardCommand(cmd, protCon, tracker, now)
+	checkCommandState(t, store, cmd.Id, CommandFailed, "UDP send error")
+}
+
+// select before operate: select and execute confirmations, then termination
+func TestCommandLifecycle(t *testing.T) {
+	now := time.Now()
+	tracker, store, protCon, _ := newTestTracker(t, "")
+	cmd := newTestCommand(now)
+	store.insert(cmd)
+	forwardCommand(cmd, protCon, tracker, now)
+
+	steps := []struct {
+		asdu  uint32
+		cause uint32
+		info  byte
+		state string
+	}{
+		{45, COT_ACTIVATION_CON, 0x82, CommandSent}, // other ASDU, ignored
+		{46, COT_ACTIVATION_CON, 0x82, CommandSelected},
+		{46, COT_ACTIVATION_CON, 0x02, CommandConfirmed},
+		{46, COT_ACTIVATION_TERMINATION, 0x02, CommandTerminated},
+		{46, COT_ACTIVATION_CON | 0x40, 0x02, CommandTerminated}, // late, command finished
+	}
+	for i, step := range steps {
+		tracker.Confirm(6001, step.asdu, decodeCOT(step.cause), []byte{step.info}, now.Add(time.Duration(i+1)*time.Millisecond))
+		checkCommandState(t, store, cmd.Id, step.state, "")
+	}
+}
+
+func TestCommandRejected(t *testing.T) {
+	now := time.Now()
+	tracker, store, protCon, _ := newTestTracker(t, "")
+
+	negative := newTestCommand(now)
+	store.insert(negative)
+	forwardCommand(negative, protCon, tracker, now)
+	tracker.Confirm(6001, 46, decodeCOT(COT_ACTIVATION_CON|0x40), []byte{0x02}, now)
+	checkCommandState(t, store, negative.Id, CommandFailed, "negative confirmation")
+
+	unknown := newTestCommand(now)
+	unknown.ProtocolSourceObjectAddress = 6002
+	unknown.Tag = "BRK2"
+	store.insert(unknown)
+	forwardCommand(unknown, protCon, tracker, now)
+	tracker.Confirm(6002, 46, decodeCOT(47), []byte{0x02}, now)
+	if c := store.commands[unknown.Id]; c.state != CommandFailed {
+		t.Errorf("command rejected by peer in state %s", c.state)
+	}
+
+	deactivated := newTestCommand(now)
+	store.insert(deactivated)
+	forwardCommand(deactivated, protCon, tracker, now)
+	tracker.Confirm(6001, 46, decodeCOT(COT_DEACTIVATION_CON), []byte{0x02}, now)
+	checkCommandState(t, store, deactivated.Id, CommandCancelled, "deactivated")
+}
+
+func TestCommandReconcile(t *testing.T) {
+	now := time.Now()
+	tracker, store, protCon, _ := newTestTracker(t, "")
+	timeout := DefaultCommandTimeout * time.Second
+
+	sent := newTestCommand(now)
+	store.insert(sent)
+	forwardCommand(sent, protCon, tracker, now)
+
+	confirmed := newTestCommand(now)
+	confirmed.ProtocolSourceObjectAddress = 6002
+	confirmed.Tag = "BRK2"
+	store.insert(confirmed)
+	forwardCommand(confirmed, protCon, tracker, now)
+	tracker.Confirm(6002, 46, decodeCOT(COT_ACTIVATION_CON), []byte{0x02}, now)
+
+	never := newTestCommand(now) // inserted while no node was active
+	store.insert(never)
+
+	other := newTestCommand(now) // other connection
+	other.ProtocolSourceConnectionNumber = 2
+	store.insert(other)
+
+	if n, _ := store.ExpireStale(1, timeout, now.Add(timeout/2)); n != 0 {
+		t.Errorf("%d commands expired before the timeout", n)
+	}
+	n, err := store.ExpireStale(1, timeout, now.Add(timeout+time.Second))
+	if err != nil || n != 2 {
+		t.Errorf("want 2 commands expired, got %d %v", n, err)
+	}
+	checkCommandState(t, store, sent.Id, CommandExpired, "no confirmation")
+	checkCommandState(t, store, never.Id, CommandExpired, "expired")
+	checkCommandState(t, store, confirmed.Id, CommandConfirmed, "")
+	checkCommandState(t, store, other.Id, "", "")
+
+	// a late confirmation does not revive an expired command
+	tracker.Confirm(6001, 46, decodeCOT(COT_ACTIVATION_CON), []byte{0x02}, now.Add(timeout+2*time.Second))
+	checkCommandState(t, store, sent.Id, CommandExpired, "no confirmation")
+
+	// a confirmed command is final, it is not expired however long the termination takes
+	if n, _ = store.ExpireStale(1, timeout, now.Add(10*timeout)); n != 0 {
+		t.Errorf("%d commands expired after confirmation", n)
+	}
+	checkCommandState(t, store, confirmed.Id, CommandConfirmed, "")
+	// a termination is accepted within the timeout
+	tracker.Confirm(6002, 46, decodeCOT(COT_ACTIVATION_TERMINATION), []byte{0x02}, now.Add(timeout-time.Second))
+	checkCommandState(t, store, confirmed.Id, CommandTerminated, "")
+
+	tracker.prune(now.Add(time.Second))
+	if len(tracker.pending) != 0 {
+		t.Errorf("pending commands not pruned: %d", len(tracker.pending))
+	}
+
+	if n, _ = store.Archive(1, time.Hour, now.Add(2*time.Hour)); n != 3 {
+		t.Errorf("want 3 commands archived, got %d", n)
+	}
+	if len(store.commands) != 1 {
+		t.Errorf("commands left: %d", len(store.commands))
+	}
+}
+
+// a termination received after commandTimeout does not change a confirmed command, pruned or not
+func TestCommandLateTermination(t *testing.T) {
+	now := time.Now()
+	tracker, store, protCon, _ := newTestTracker(t, "")
+	tracker.timeout = 10 * time.Second
+
+	cmd := newTestCommand(now)
+	store.insert(cmd)
+	forwardCommand(cmd, protCon, tracker, now)
+	tracker.Confirm(6001, 46, decodeCOT(COT_ACTIVATION_CON), []byte{0x02}, now.Add(time.Second))
+	checkCommandState(t, store, cmd.Id, CommandConfirmed, "")
+
+	tracker.Confirm(6001, 46, decodeCOT(COT_ACTIVATION_TERMINATION), []byte{0x02}, now.Add(tracker.timeout+time.Millisecond))
+	checkCommandState(t, store, cmd.Id, CommandConfirmed, "")
+	if len(tracker.pending) != 0 {
+		t.Errorf("command still tracked after the timeout")
+	}
+
+	pruned := newTestCommand(now)
+	store.insert(pruned)
+	forwardCommand(pruned, protCon, tracker, now)
+	tracker.Confirm(6001, 46, decodeCOT(COT_ACTIVATION_CON), []byte{0x02}, now.Add(time.Second))
+	tracker.prune(now.Add(time.Second))
+	tracker.Confirm(6001, 46, decodeCOT(COT_ACTIVATION_TERMINATION), []byte{0x02}, now.Add(tracker.timeout+time.Second))
+	checkCommandState(t, store, pruned.Id, CommandConfirmed, "")
+}
+
+// a slow store write does not hold the tracker, the confirmation of a command waits for its sent state (run with -race)
+func TestCommandStoreWriteOutsideLock(t *testing.T) {
+	now := time.Now()
+	store := newBlockingCommandStore(CommandSent)
+	tracker := NewCommandTracker(store)
+	tracker.SetCommandDefs(testCommandDefs())
+	protCon := &ProtocolConnection{ProtocolConnectionNumber: 1, transport: &fakeTransport{}}
+	cmd := newTestCommand(now)
+	store.insert(cmd)
+
+	forwarded := make(chan struct{})
+	go func() {
+		defer close(forwarded)
+		forwardCommand(cmd, protCon, tracker, now)
+	}()
+	<-store.blocked // sent state being written
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tracker.SetCommandDefs(testCommandDefs())
+		if _, err := tracker.resolve(Command{Tag: "BRK2"}); err != nil {
+			t.Error(err)
+		}
+		tracker.Confirm(6002, 46, decodeCOT(COT_ACTIVATION_CON), []byte{0x02}, now) // other address
+		tracker.prune(now.Add(-time.Hour))
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("tracker held during the store write")
+	}
+
+	confirmed := make(chan struct{})
+	go func() {
+		defer close(confirmed)
+		tracker.Confirm(6001, 46, decodeCOT(COT_ACTIVATION_CON), []byte{0x02}, now.Add(time.Millisecond))
+	}()
+	select {
+	case <-confirmed:
+		t.Error("confirmation written before the sent state")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(store.release)
+	<-forwarded
+	<-confirmed
+	checkCommandState(t, store.fakeCommandStore, cmd.Id, CommandConfirmed, "")
+}
+
+func TestCommandAddressResolution(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		modify func(cmd *Command)
+		reason string // cancelReason, "" if sent
+		addr   uint32
+	}{
+		{"copied addresses", func(cmd *Command) {}, "", 6001},
+		{"by tag only", func(cmd *Command) {
+			cmd.ProtocolSourceObjectAddress, cmd.ProtocolSourceASDU, cmd.ProtocolSourceCommonAddress = 0, 0, 0
+		}, "", 6001},
+		{"by point key", func(cmd *Command) {
+			cmd.Tag, cmd.PointKey, cmd.ProtocolSourceObjectAddress = "", 102, 0
+		}, "", 6002},
+		{"stale object address", func(cmd *Command) { cmd.ProtocolSourceObjectAddress = 6002 },
+			"address mismatch: command 7/6002 ASDU 46, configured 7/6001 ASDU 46", 0},
+		{"stale ASDU", func(cmd *Command) { cmd.ProtocolSourceASDU = 45 },
+			"address mismatch: command 7/6001 ASDU 45, configured 7/6001 ASDU 46", 0},
+		{"stale common address", func(cmd *Command) { cmd.ProtocolSourceCommonAddress = 8 },
+			"address mismatch: command 8/6001 ASDU 46, configured 7/6001 ASDU 46", 0},
+		{"tag and point key disagree", func(cmd *Command) { cmd.PointKey = 102 }, "tag BRK1 does not match point key 102", 0},
+		{"unknown tag", func(cmd *Command) { cmd.Tag = "BRK9" }, "command point not found", 0},
+		{"no tag or point key", func(cmd *Command) { cmd.Tag = "" }, "command without tag or point key", 0},
+	}
+	for _, tt := range tests {
+		tracker, store, protCon, transport := newTestTracker(t, "")
+		cmd := newTestCommand(now)
+		tt.modify(&cmd)
+		store.insert(cmd)
+		forwardCommand(cmd, protCon, tracker, now)
+
+		if tt.reason != "" {
+			if c := store.commands[cmd.Id]; c.state != CommandCancelled || c.reason != tt.reason {
+				t.Errorf("%s: got state %s reason %q, want cancelled %q", tt.name, c.state, c.reason, tt.reason)
+			}
+			if len(transport.sent) != 0 {
+				t.Errorf("%s: rejected command sent", tt.name)
+			}
+			continue
+		}
+		if len(transport.sent) != 1 {
+			t.Errorf("%s: command not sent, state %s reason %q", tt.name, store.commands[cmd.Id].state, store.commands[cmd.Id].reason)
+			continue
+		}
+		// addr, tiType, value, sbo, qu, ca from the point definition
+		want := []uint32{tt.addr, 46, 2, 1, 1, 7}
+		got := commandFrameFields(t, transport.sent[0])
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("%s: frame fields: got %v, want %v", tt.name, got, want)
+				break
+			}
+		}
+	}
+
+	tracker, store, protCon, _ := newTestTracker(t, "")
+	tracker.SetCommandDefs(nil)
+	cmd := newTestCommand(now)
+	store.insert(cmd)
+	forwardCommand(cmd, protCon, tracker, now)
+	if c := store.commands[cmd.Id]; c.state != CommandCancelled {
+		t.Errorf("command sent without command points: %s", c.state)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"jsonscada"
+)
+
+// log levels (same as the other json-scada drivers)
+const (
+	LogLevelNoLog    = 0
+	LogLevelBasic    = 1 // default
+	LogLevelDetailed = 2
+	LogLevelDebug    = 3
+)
+
+var LogLevel = LogLevelBasic
+
+// Command line options, environment variables can be used instead (the command line takes precedence)
+type Options struct {
+	ConfigFile     string // -config or JS_CONFIG_FILE
+	InstanceNumber int    // -instance or JS_I104M_INSTANCE
+	LogLevel       int    // -loglevel or JS_I104M_LOGLEVEL
+	MetricsAddress string // -metrics or JS_I104M_METRICS_ADDRESS (e.g. ":9104", empty = disabled)
+	CaptureFile    string // -capture or JS_I104M_CAPTURE_FILE, record received packets (empty = disabled)
+	ServerMode     bool   // -server or JS_I104M_SERVER, export realtimeData to I104M peers (driver name I104M_SERVER)
+	ReplayFile     string // -replay, send a capture file to a driver instance and exit
+	ReplayTo       string // -replay-to, address:port of the driver instance
+	ReplaySpeed    float64
+	ReplayKeyId    int    // -replay-auth-key-id, key id to sign replayed packets
+	ReplayKey      string // env JS_I104M_REPLAY_AUTH_KEY (not on the command line), HMAC key (hex) to sign replayed packets
+}
+
+// parse command line and environment (getenv, os.Getenv), the old positional form "i104m [instance number] [log level]"
+// is still accepted. Precedence: flags, then positional args, then environment, then defaults.
+func parseOptions(args []string, getenv func(name string) string) (Options, error) {
+	envString := func(name string, def string) string {
+		if v := getenv(name); strings.TrimSpace(v) != "" {
+			return v
+		}
+		return def
+	}
+	envInt := func(name string, def int) (int, error) {
+		v := strings.TrimSpace(envString(name, ""))
+		if v == "" {
+			return def, nil
+		}
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return def, fmt.Errorf("invalid value '%s' for %s", v, name)
+		}
+		return i, nil
+	}
+
+	opts := Options{
+		ConfigFile:     envString("JS_CONFIG_FILE", jsonscada.DefaultConfigFile),
+		InstanceNumber: 1,
+		LogLevel:       LogLevelBasic,
+		MetricsAddress: envString("JS_I104M_METRICS_ADDRESS", ""),
+		CaptureFile:    envString("JS_I104M_CAPTURE_FILE", ""),
+		ReplayTo:       "127.0.0.1:8099",
+		ReplaySpeed:    1,
+		ReplayKeyId:    1,
+		ReplayKey:      envString("JS_I104M_REPLAY_AUTH_KEY", ""),
+	}
+	var err error
+	if opts.InstanceNumber, err = envInt("JS_I104M_INSTANCE", opts.InstanceNumber); err != nil {
+		return opts, err
+	}
+	if opts.LogLevel, err = envInt("JS_I104M_LOGLEVEL", opts.LogLevel); err != nil {
+		return opts, err
+	}
+	if env := strings.TrimSpace(envString("JS_I104M_SERVER", "")); env != "" {
+		if opts.ServerMode, err = strconv.ParseBool(env); err != nil {
+			return opts, fmt.Errorf("invalid JS_I104M_SERVER '%s'", env)
+		}
+	}
+
+	fs := flag.NewFlagSet(DriverName, flag.ContinueOnError)
+	fs.StringVar(&opts.ConfigFile, "config", opts.ConfigFile, "json-scada config file (env JS_CONFIG_FILE)")
+	fs.IntVar(&opts.InstanceNumber, "instance", opts.InstanceNumber, "driver instance number (env JS_I104M_INSTANCE)")
+	fs.IntVar(&opts.LogLevel, "loglevel", opts.LogLevel, "log level 0=no 1=basic 2=detailed 3=debug (env JS_I104M_LOGLEVEL)")
+	fs.StringVar(&opts.MetricsAddress, "metrics", opts.MetricsAddress, "address to serve metrics, e.g. :9104 (env JS_I104M_METRICS_ADDRESS)")
+	fs.StringVar(&opts.CaptureFile, "capture", opts.CaptureFile, "record received packets to this file (env JS_I104M_CAPTURE_FILE)")
+	fs.BoolVar(&opts.ServerMode, "server", opts.ServerMode, "server mode, send realtimeData to I104M peers (env JS_I104M_SERVER)")
+	fs.StringVar(&opts.ReplayFile, "replay", opts.ReplayFile, "replay a capture file to a driver instance and exit")
+	fs.StringVar(&opts.ReplayTo, "replay-to", opts.ReplayTo, "UDP address:port of the driver instance for -replay")
+	fs.Float64Var(&opts.ReplaySpeed, "replay-speed", opts.ReplaySpeed, "replay speed factor, 1 = original timing, 0 = no delay")
+	fs.IntVar(&opts.ReplayKeyId, "replay-auth-key-id", opts.ReplayKeyId, "key id to sign replayed packets with the key in env JS_I104M_REPLAY_AUTH_KEY")
+	if err := fs.Parse(args); err != nil {
+		return opts, err
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	positional := fs.Args()
+	if len(positional) > 0 && !set["instance"] {
+		if opts.InstanceNumber, err = strconv.Atoi(positional[0]); err != nil {
+			return opts, fmt.Errorf("invalid instance number '%s'", positional[0])
+		}
+	}
+	if len(positional) > 1 && !set["loglevel"] {
+		if opts.LogLevel, err = strconv.Atoi(positional[1]); err != nil {
+			return opts, fmt.Errorf("invalid log level '%s'", positional[1])
+		}
+	}
+
+	if opts.InstanceNumber < 1 {
+		return opts, fmt.Errorf("invalid instance number %d, must be 1 or more", opts.InstanceNumber)
+	}
+	if opts.ReplaySpeed < 0 {
+		return opts, fmt.Errorf("invalid replay speed %g", opts.ReplaySpeed)
+	}
+	if opts.LogLevel < LogLevelNoLog || opts.LogLevel > LogLevelDebug {
+		return opts, fmt.Errorf("invalid log level %d, must be 0 to 3", opts.LogLevel)
+	}
+	return opts, nil
+}
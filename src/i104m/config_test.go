@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"jsonscada"
+)
+
+// precedence of flags, positional args, environment variables and defaults
+func TestParseOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		env      map[string]string
+		instance int
+		logLevel int
+		config   string
+		server   bool
+		metrics  string
+		err      string
+	}{
+		{"defaults", nil, nil, 1, LogLevelBasic, jsonscada.DefaultConfigFile, false, "", ""},
+		{"positional", []string{"2", "3"}, nil, 2, 3, jsonscada.DefaultConfigFile, false, "", ""},
+		{"positional instance only", []string{"4"}, nil, 4, LogLevelBasic, jsonscada.DefaultConfigFile, false, "", ""},
+		{"flags", []string{"-instance", "3", "-loglevel", "0", "-config", "a.json", "-server", "-metrics", ":9104"}, nil,
+			3, 0, "a.json", true, ":9104", ""},
+		{"environment", nil, map[string]string{"JS_I104M_INSTANCE": "5", "JS_I104M_LOGLEVEL": "2", "JS_CONFIG_FILE": "b.json",
+			"JS_I104M_SERVER": "true", "JS_I104M_METRICS_ADDRESS": ":9105"}, 5, 2, "b.json", true, ":9105", ""},
+		{"blank environment ignored", nil, map[string]string{"JS_I104M_INSTANCE": " ", "JS_CONFIG_FILE": ""},
+			1, LogLevelBasic, jsonscada.DefaultConfigFile, false, "", ""},
+		{"flags over environment", []string{"-instance", "3", "-config", "a.json", "-server=false"},
+			map[string]string{"JS_I104M_INSTANCE": "5", "JS_CONFIG_FILE": "b.json", "JS_I104M_SERVER": "1"}, 3, LogLevelBasic, "a.json", false, "", ""},
+		{"positional over environment", []string{"2", "3"}, map[string]string{"JS_I104M_INSTANCE": "5", "JS_I104M_LOGLEVEL": "1"},
+			2, 3, jsonscada.DefaultConfigFile, false, "", ""},
+		{"flags over positional", []string{"-loglevel", "0", "-instance", "6", "2", "3"}, nil, 6, 0, jsonscada.DefaultConfigFile, false, "", ""},
+		{"flag log level, positional instance", []string{"-loglevel", "3", "2", "1"}, map[string]string{"JS_I104M_LOGLEVEL": "2"},
+			2, 3, jsonscada.DefaultConfigFile, false, "", ""},
+		{"environment for missing positional", []string{"2"}, map[string]string{"JS_I104M_LOGLEVEL": "0"}, 2, 0, jsonscada.DefaultConfigFile, false, "", ""},
+		{"invalid environment instance", nil, map[string]string{"JS_I104M_INSTANCE": "x"}, 0, 0, "", false, "", "JS_I104M_INSTANCE"},
+		{"invalid environment server", nil, map[string]string{"JS_I104M_SERVER": "maybe"}, 0, 0, "", false, "", "JS_I104M_SERVER"},
+		{"invalid positional instance", []string{"x"}, nil, 0, 0, "", false, "", "invalid instance number"},
+		{"invalid positional log level", []string{"1", "x"}, nil, 0, 0, "", false, "", "invalid log level"},
+		{"instance out of range", []string{"-instance", "0"}, nil, 0, 0, "", false, "", "must be 1 or more"},
+		{"log level out of range", nil, map[string]string{"JS_I104M_LOGLEVEL": "4"}, 0, 0, "", false, "", "must be 0 to 3"},
+		{"unknown flag", []string{"-unknown"}, nil, 0, 0, "", false, "", "unknown"},
+	}
+	for _, tt := range tests {
+		getenv := func(name string) string { return tt.env[name] }
+		opts, err := parseOptions(tt.args, getenv)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if opts.InstanceNumber != tt.instance || opts.LogLevel != tt.logLevel || opts.ConfigFile != tt.config ||
+			opts.ServerMode != tt.server || opts.MetricsAddress != tt.metrics {
+			t.Errorf("%s: got %+v", tt.name, opts)
+		}
+	}
+}
+
+// the replay key is read only from the environment
+func TestParseOptionsReplay(t *testing.T) {
+	env := map[string]string{"JS_I104M_REPLAY_AUTH_KEY": "00112233445566778899aabbccddeeff"}
+	opts, err := parseOptions([]string{"-replay", "c.jsonl", "-replay-to", "10.0.0.1:8099", "-replay-speed", "0", "-replay-auth-key-id", "3"},
+		func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.ReplayFile != "c.jsonl" || opts.ReplayTo != "10.0.0.1:8099" || opts.ReplaySpeed != 0 || opts.ReplayKeyId != 3 ||
+		opts.ReplayKey != env["JS_I104M_REPLAY_AUTH_KEY"] {
+		t.Errorf("got %+v", opts)
+	}
+	if _, err := parseOptions([]string{"-replay-auth-key", "00"}, func(string) string { return "" }); err == nil {
+		t.Error("replay key accepted on the command line")
+	}
+	if _, err := parseOptions([]string{"-replay-speed", "-1"}, func(string) string { return "" }); err == nil {
+		t.Error("negative replay speed accepted")
+	}
+}
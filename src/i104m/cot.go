@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// Cause of transmission values (IEC60870-5-101/104)
+const (
+	COT_PERIODIC                     = 1
+	COT_BACKGROUND_SCAN              = 2
+	COT_SPONTANEOUS                  = 3
+	COT_INITIALIZED                  = 4
+	COT_REQUEST                      = 5
+	COT_ACTIVATION                   = 6
+	COT_ACTIVATION_CON               = 7
+	COT_DEACTIVATION                 = 8
+	COT_DEACTIVATION_CON             = 9
+	COT_ACTIVATION_TERMINATION       = 10
+	COT_RETURN_INFO_REMOTE           = 11
+	COT_RETURN_INFO_LOCAL            = 12
+	COT_INTERROGATED_BY_STATION      = 20
+	COT_INTERROGATED_BY_GROUP_16     = 36
+	COT_REQUESTED_BY_GENERAL_COUNTER = 37
+	COT_REQUESTED_BY_GROUP_4_COUNTER = 41
+)
+
+// Decoded cause of transmission field of I104M packets (cause in the low octet, originator address in the second octet)
+type CauseOfTransmission struct {
+	Cause      uint32 // cause 0-63
+	Negative   bool   // P/N bit, negative confirmation
+	Test       bool   // T bit, test data
+	Originator uint32 // originator address (0 = not used)
+}
+
+func decodeCOT(raw uint32) CauseOfTransmission {
+	return CauseOfTransmission{
+		Cause:      raw & 0x3F,
+		Negative:   raw&0x40 == 0x40,
+		Test:       raw&0x80 == 0x80,
+		Originator: (raw >> 8) & 0xFF,
+	}
+}
+
+// response to a general or group interrogation
+func (cot CauseOfTransmission) IsInterrogated() bool {
+	return cot.Cause >= COT_INTERROGATED_BY_STATION && cot.Cause <= COT_INTERROGATED_BY_GROUP_16
+}
+
+// response to a general or group counter interrogation
+func (cot CauseOfTransmission) IsCounterInterrogated() bool {
+	return cot.Cause >= COT_REQUESTED_BY_GENERAL_COUNTER && cot.Cause <= COT_REQUESTED_BY_GROUP_4_COUNTER
+}
+
+func (cot CauseOfTransmission) IsSpontaneous() bool {
+	return cot.Cause == COT_SPONTANEOUS
+}
+
+func (cot CauseOfTransmission) IsBackgroundScan() bool {
+	return cot.Cause == COT_BACKGROUND_SCAN
+}
+
+// return information caused by a remote or local command
+func (cot CauseOfTransmission) IsReturnInfo() bool {
+	return cot.Cause == COT_RETURN_INFO_REMOTE || cot.Cause == COT_RETURN_INFO_LOCAL
+}
+
+// integrity data (interrogation responses and background scan), not events
+func (cot CauseOfTransmission) IsIntegrity() bool {
+	return cot.IsInterrogated() || cot.IsCounterInterrogated() || cot.IsBackgroundScan()
+}
+
+func (cot CauseOfTransmission) String() string {
+	var name string
+	switch {
+	case cot.Cause == COT_PERIODIC:
+		name = "periodic"
+	case cot.IsBackgroundScan():
+		name = "background scan"
+	case cot.IsSpontaneous():
+		name = "spontaneous"
+	case cot.Cause == COT_INITIALIZED:
+		name = "initialized"
+	case cot.Cause == COT_REQUEST:
+		name = "request"
+	case cot.Cause == COT_ACTIVATION:
+		name = "activation"
+	case cot.Cause == COT_ACTIVATION_CON:
+		name = "activation con"
+	case cot.Cause == COT_DEACTIVATION:
+		name = "deactivation"
+	case cot.Cause == COT_DEACTIVATION_CON:
+		name = "deactivation con"
+	case cot.Cause == COT_ACTIVATION_TERMINATION:
+		name = "activation termination"
+	case cot.Cause == COT_RETURN_INFO_REMOTE:
+		name = "return info remote"
+	case cot.Cause == COT_RETURN_INFO_LOCAL:
+		name = "return info local"
+	case cot.Cause == COT_INTERROGATED_BY_STATION:
+		name = "interrogated by station"
+	case cot.IsInterrogated():
+		name = fmt.Sprintf("interrogated by group %d", cot.Cause-COT_INTERROGATED_BY_STATION)
+	case cot.Cause == COT_REQUESTED_BY_GENERAL_COUNTER:
+		name = "requested by general counter"
+	case cot.IsCounterInterrogated():
+		name = fmt.Sprintf("requested by group %d counter", cot.Cause-COT_REQUESTED_BY_GENERAL_COUNTER)
+	default:
+		name = fmt.Sprintf("cause %d", cot.Cause)
+	}
+	if cot.Negative {
+		name += " [NEG]"
+	}
+	if cot.Test {
+		name += " [TEST]"
+	}
+	if cot.Originator != 0 {
+		name += fmt.Sprintf(" [OA %d]", cot.Originator)
+	}
+	return name
+}
+
+// check if data received with this cause of transmission should be processed for the connection
+func acceptCOT(cot CauseOfTransmission, iecAsdu uint32, protCon *ProtocolConnection) bool {
+	if cot.Test && !protCon.AcceptTestData {
+		log.Println("Test data ignored: ", cot)
+		return false
+	}
+	if cot.Negative && iecAsdu < 45 { // negative bit is meaningful only for command confirmations
+		log.Println("Negative confirmation data ignored: ", cot)
+		return false
+	}
+	return true
+}
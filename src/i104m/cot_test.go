@@ -0,0 +1,89 @@
+package main
+
+import "testing"
+
+func TestDecodeCOT(t *testing.T) {
+	tests := []struct {
+		raw  uint32
+		want CauseOfTransmission
+		name string
+	}{
+		{3, CauseOfTransmission{Cause: 3}, "spontaneous"},
+		{20, CauseOfTransmission{Cause: 20}, "interrogated by station"},
+		{0x47, CauseOfTransmission{Cause: 7, Negative: true}, "activation con [NEG]"},
+		{0x83, CauseOfTransmission{Cause: 3, Test: true}, "spontaneous [TEST]"},
+		{0xC7, CauseOfTransmission{Cause: 7, Negative: true, Test: true}, "activation con [NEG] [TEST]"},
+		{0x0503, CauseOfTransmission{Cause: 3, Originator: 5}, "spontaneous [OA 5]"},
+		{0xFF14, CauseOfTransmission{Cause: 20, Originator: 255}, "interrogated by station [OA 255]"},
+		{0xFF0114, CauseOfTransmission{Cause: 20, Originator: 1}, "interrogated by station [OA 1]"}, // third octet ignored
+		{22, CauseOfTransmission{Cause: 22}, "interrogated by group 2"},
+		{38, CauseOfTransmission{Cause: 38}, "requested by group 1 counter"},
+		{2, CauseOfTransmission{Cause: 2}, "background scan"},
+		{63, CauseOfTransmission{Cause: 63}, "cause 63"},
+	}
+	for _, tt := range tests {
+		got := decodeCOT(tt.raw)
+		if got != tt.want {
+			t.Errorf("%#x: got %+v, want %+v", tt.raw, got, tt.want)
+		}
+		if got.String() != tt.name {
+			t.Errorf("%#x: got %q, want %q", tt.raw, got.String(), tt.name)
+		}
+	}
+}
+
+// interrogation responses and background scan are integrity data, not events
+func TestCOTClasses(t *testing.T) {
+	tests := []struct {
+		cause                                          uint32
+		interrogated, counter, background, spontaneous bool
+	}{
+		{COT_SPONTANEOUS, false, false, false, true},
+		{COT_BACKGROUND_SCAN, false, false, true, false},
+		{COT_PERIODIC, false, false, false, false},
+		{COT_INTERROGATED_BY_STATION, true, false, false, false},
+		{COT_INTERROGATED_BY_GROUP_16, true, false, false, false},
+		{COT_REQUESTED_BY_GENERAL_COUNTER, false, true, false, false},
+		{COT_REQUESTED_BY_GROUP_4_COUNTER, false, true, false, false},
+		{COT_RETURN_INFO_REMOTE, false, false, false, false},
+	}
+	for _, tt := range tests {
+		cot := decodeCOT(tt.cause)
+		if cot.IsInterrogated() != tt.interrogated || cot.IsCounterInterrogated() != tt.counter ||
+			cot.IsBackgroundScan() != tt.background || cot.IsSpontaneous() != tt.spontaneous {
+			t.Errorf("cause %d: wrong class", tt.cause)
+		}
+		if integrity := tt.interrogated || tt.counter || tt.background; cot.IsIntegrity() != integrity {
+			t.Errorf("cause %d: IsIntegrity %v, want %v", tt.cause, cot.IsIntegrity(), integrity)
+		}
+	}
+}
+
+func TestAcceptCOT(t *testing.T) {
+	tests := []struct {
+		name       string
+		raw        uint32
+		asdu       uint32
+		acceptTest bool
+		want       bool
+	}{
+		{"spontaneous", COT_SPONTANEOUS, 1, false, true},
+		{"interrogated", COT_INTERROGATED_BY_STATION, 13, false, true},
+		{"background scan", COT_BACKGROUND_SCAN, 13, false, true},
+		{"with originator", 0x0703, 1, false, true},
+		{"test data ignored", COT_SPONTANEOUS | 0x80, 1, false, false},
+		{"test data accepted", COT_SPONTANEOUS | 0x80, 1, true, true},
+		{"test interrogated accepted", COT_INTERROGATED_BY_STATION | 0x80, 36, true, true},
+		{"negative data", COT_SPONTANEOUS | 0x40, 30, false, false},
+		{"negative data with test accepted", COT_SPONTANEOUS | 0x40, 30, true, false},
+		{"negative command confirmation", COT_ACTIVATION_CON | 0x40, 45, false, true},
+		{"negative test command confirmation", COT_ACTIVATION_CON | 0xC0, 46, false, false},
+		{"negative test command confirmation accepted", COT_ACTIVATION_CON | 0xC0, 46, true, true},
+	}
+	for _, tt := range tests {
+		protCon := &ProtocolConnection{AcceptTestData: tt.acceptTest}
+		if got := acceptCOT(decodeCOT(tt.raw), tt.asdu, protCon); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+	_ "time/tzdata" // named source time zones must work on hosts/containers without a zoneinfo database
+
+	"i104mproto"
+)
+
+// Binary time tags (IEC60870-5-4), see i104mproto for the layout and the encoding
+
+// return the location for the configured source time zone ("" = local time of this host, "UTC" or a IANA zone name)
+func sourceTimeLocation(zone string) (*time.Location, error) {
+	zone = strings.TrimSpace(zone)
+	switch strings.ToUpper(zone) {
+	case "":
+		return time.Local, nil
+	case "UTC", "Z":
+		return time.UTC, nil
+	}
+	return time.LoadLocation(zone)
+}
+
+// decode a CP56Time2a time tag in the source time zone.
+// timeOk is false when the IV bit is set or the day of week does not match the date.
+// An error is returned when the fields are out of range (no usable time).
+func parseCP56Time2a(b []byte, loc *time.Location) (t time.Time, timeOk bool, err error) {
+	if len(b) < 7 {
+		return t, false, fmt.Errorf("CP56Time2a: short buffer (%d bytes)", len(b))
+	}
+	msec := int(binary.LittleEndian.Uint16(b[0:]))
+	minute := int(b[2] & 0x3F)
+	hour := int(b[3] & 0x1F)
+	day := int(b[4] & 0x1F)
+	dow := int(b[4] >> 5) // 1=monday ... 7=sunday, 0=not used
+	month := int(b[5] & 0x0F)
+	year := 2000 + int(b[6]&0x7F)
+	invalid := b[2]&i104mproto.TimeTagInvalidBit == i104mproto.TimeTagInvalidBit
+	summer := b[3]&i104mproto.TimeTagSummerBit == i104mproto.TimeTagSummerBit
+
+	if msec > 59999 || minute > 59 || hour > 23 || day < 1 || month < 1 || month > 12 ||
+		day > time.Date(year, time.Month(month)+1, 0, 0, 0, 0, 0, time.UTC).Day() {
+		return t, false, fmt.Errorf("CP56Time2a: field out of range %d-%d-%d %d:%d %dms", year, month, day, hour, minute, msec)
+	}
+
+	t = wallClockTime(year, time.Month(month), day, hour, minute, msec, summer, loc)
+
+	timeOk = !invalid
+	if dow != 0 && dow != i104mproto.ISOWeekday(t.In(loc).Weekday()) {
+		timeOk = false
+	}
+	return t, timeOk, nil
+}
+
+// decode a CP24Time2a time tag (minutes and milliseconds), completing hour and date from the reference time
+// as seen in the source time zone. A time more than 30 minutes in the future is assumed to belong to the previous hour.
+func parseCP24Time2a(b []byte, ref time.Time, loc *time.Location) (t time.Time, timeOk bool, err error) {
+	if len(b) < 3 {
+		return t, false, fmt.Errorf("CP24Time2a: short buffer (%d bytes)", len(b))
+	}
+	msec := int(binary.LittleEndian.Uint16(b[0:]))
+	minute := int(b[2] & 0x3F)
+	if msec > 59999 || minute > 59 {
+		return t, false, fmt.Errorf("CP24Time2a: field out of range %d:%dms", minute, msec)
+	}
+
+	ref = ref.In(loc)
+	t = time.Date(ref.Year(), ref.Month(), ref.Day(), ref.Hour(), minute, msec/1000, (msec%1000)*int(time.Millisecond), loc)
+	if t.Sub(ref) > 30*time.Minute {
+		t = t.Add(-time.Hour)
+	}
+	return t, b[2]&i104mproto.TimeTagInvalidBit == 0, nil
+}
+
+// build a time from wall clock fields, using the summer time flag to pick the right instant
+// when the wall clock time is ambiguous (repeated hour when daylight saving time ends)
+func wallClockTime(year int, month time.Month, day, hour, minute, msec int, summer bool, loc *time.Location) time.Time {
+	t := time.Date(year, month, day, hour, minute, msec/1000, (msec%1000)*int(time.Millisecond), loc)
+	if t.IsDST() == summer {
+		return t
+	}
+	for _, d := range []time.Duration{-time.Hour, time.Hour} {
+		c := t.Add(d).In(loc)
+		if c.IsDST() == summer && c.Hour() == t.Hour() && c.Minute() == t.Minute() && c.Day() == t.Day() {
+			return c
+		}
+	}
+	return t
+}
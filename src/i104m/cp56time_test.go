@@ -0,0 +1,205 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"i104mproto"
+)
+
+// encode a CP56Time2a from wall clock fields (dow: 1=monday ... 7=sunday, 0=not used)
+func cp56(year, month, day, hour, minute, msec, dow int, iv, su bool) []byte {
+	b := []byte{byte(msec), byte(msec >> 8), byte(minute), byte(hour), byte(day | dow<<5), byte(month), byte(year - 2000)}
+	if iv {
+		b[2] |= i104mproto.TimeTagInvalidBit
+	}
+	if su {
+		b[3] |= i104mproto.TimeTagSummerBit
+	}
+	return b
+}
+
+func TestParseCP56Time2a(t *testing.T) {
+	berlin, err := sourceTimeLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		buf    []byte
+		loc    *time.Location
+		want   time.Time
+		wantOk bool
+		err    bool
+	}{
+		{"utc", cp56(2020, 7, 15, 13, 45, 12345, 0, false, false), time.UTC,
+			time.Date(2020, 7, 15, 13, 45, 12, 345e6, time.UTC), true, false},
+		{"max milliseconds", cp56(2020, 12, 31, 23, 59, 59999, 0, false, false), time.UTC,
+			time.Date(2020, 12, 31, 23, 59, 59, 999e6, time.UTC), true, false},
+		{"reserved bits ignored", []byte{0, 0, 0x40 | 30, 0x60 | 10, 1, 0xF0 | 6, 0x80 | 20}, time.UTC,
+			time.Date(2020, 6, 1, 10, 30, 0, 0, time.UTC), true, false},
+		{"invalid bit", cp56(2020, 7, 15, 13, 45, 0, 0, true, false), time.UTC,
+			time.Date(2020, 7, 15, 13, 45, 0, 0, time.UTC), false, false},
+		{"day of week match", cp56(2020, 7, 15, 13, 45, 0, 3, false, false), time.UTC,
+			time.Date(2020, 7, 15, 13, 45, 0, 0, time.UTC), true, false},
+		{"day of week sunday", cp56(2020, 7, 19, 13, 45, 0, 7, false, false), time.UTC,
+			time.Date(2020, 7, 19, 13, 45, 0, 0, time.UTC), true, false},
+		{"day of week mismatch", cp56(2020, 7, 15, 13, 45, 0, 1, false, false), time.UTC,
+			time.Date(2020, 7, 15, 13, 45, 0, 0, time.UTC), false, false},
+		{"named zone winter", cp56(2020, 1, 10, 12, 0, 0, 0, false, false), berlin,
+			time.Date(2020, 1, 10, 11, 0, 0, 0, time.UTC), true, false},
+		{"named zone summer", cp56(2020, 7, 10, 12, 0, 0, 0, false, true), berlin,
+			time.Date(2020, 7, 10, 10, 0, 0, 0, time.UTC), true, false},
+		{"dst end repeated hour summer", cp56(2020, 10, 25, 2, 30, 0, 7, false, true), berlin,
+			time.Date(2020, 10, 25, 0, 30, 0, 0, time.UTC), true, false},
+		{"dst end repeated hour winter", cp56(2020, 10, 25, 2, 30, 0, 7, false, false), berlin,
+			time.Date(2020, 10, 25, 1, 30, 0, 0, time.UTC), true, false},
+		{"dst start before gap", cp56(2020, 3, 29, 1, 59, 59000, 0, false, false), berlin,
+			time.Date(2020, 3, 29, 0, 59, 59, 0, time.UTC), true, false},
+		{"dst start after gap", cp56(2020, 3, 29, 3, 0, 0, 0, false, true), berlin,
+			time.Date(2020, 3, 29, 1, 0, 0, 0, time.UTC), true, false},
+		{"leap day", cp56(2020, 2, 29, 0, 0, 0, 6, false, false), time.UTC,
+			time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC), true, false},
+		{"not a leap year", cp56(2021, 2, 29, 0, 0, 0, 0, false, false), time.UTC, time.Time{}, false, true},
+		{"milliseconds out of range", cp56(2020, 7, 15, 13, 45, 60000, 0, false, false), time.UTC, time.Time{}, false, true},
+		{"minute out of range", cp56(2020, 7, 15, 13, 60, 0, 0, false, false), time.UTC, time.Time{}, false, true},
+		{"hour out of range", cp56(2020, 7, 15, 24, 0, 0, 0, false, false), time.UTC, time.Time{}, false, true},
+		{"day zero", cp56(2020, 7, 0, 13, 0, 0, 0, false, false), time.UTC, time.Time{}, false, true},
+		{"month zero", cp56(2020, 0, 15, 13, 0, 0, 0, false, false), time.UTC, time.Time{}, false, true},
+		{"month out of range", cp56(2020, 13, 15, 13, 0, 0, 0, false, false), time.UTC, time.Time{}, false, true},
+		{"short buffer", []byte{0, 0, 0, 0, 0, 0}, time.UTC, time.Time{}, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok, err := parseCP56Time2a(tt.buf, tt.loc)
+			if (err != nil) != tt.err {
+				t.Fatalf("error = %v, want error %v", err, tt.err)
+			}
+			if tt.err {
+				return
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("time = %v, want %v", got.UTC(), tt.want)
+			}
+			if ok != tt.wantOk {
+				t.Errorf("timeOk = %v, want %v", ok, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestParseCP24Time2a(t *testing.T) {
+	ref := time.Date(2020, 7, 15, 13, 10, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		buf    []byte
+		want   time.Time
+		wantOk bool
+		err    bool
+	}{
+		{"same hour", []byte{0x39, 0x30, 5}, time.Date(2020, 7, 15, 13, 5, 12, 345e6, time.UTC), true, false},
+		{"near future", []byte{0, 0, 20}, time.Date(2020, 7, 15, 13, 20, 0, 0, time.UTC), true, false},
+		{"previous hour", []byte{0, 0, 55}, time.Date(2020, 7, 15, 12, 55, 0, 0, time.UTC), true, false},
+		{"invalid bit", []byte{0, 0, 0x80 | 5}, time.Date(2020, 7, 15, 13, 5, 0, 0, time.UTC), false, false},
+		{"minute out of range", []byte{0, 0, 61}, time.Time{}, false, true},
+		{"short buffer", []byte{0, 0}, time.Time{}, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok, err := parseCP24Time2a(tt.buf, ref, time.UTC)
+			if (err != nil) != tt.err {
+				t.Fatalf("error = %v, want error %v", err, tt.err)
+			}
+			if tt.err {
+				return
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("time = %v, want %v", got.UTC(), tt.want)
+			}
+			if ok != tt.wantOk {
+				t.Errorf("timeOk = %v, want %v", ok, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestSourceTimeLocation(t *testing.T) {
+	for _, zone := range []string{"", "UTC", "utc", "America/Sao_Paulo"} {
+		if _, err := sourceTimeLocation(zone); err != nil {
+			t.Errorf("zone %q: %v", zone, err)
+		}
+	}
+	if _, err := sourceTimeLocation("Not/AZone"); err == nil {
+		t.Error("expected error for unknown zone")
+	}
+}
+
+func TestEncodeCP56Time2a(t *testing.T) {
+	berlin, err := sourceTimeLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []time.Time{
+		time.Date(2020, 7, 15, 13, 45, 12, 345e6, time.UTC),
+		time.Date(2020, 10, 25, 0, 30, 0, 0, time.UTC), // 02:30 summer time in Berlin
+		time.Date(2020, 10, 25, 1, 30, 0, 0, time.UTC), // 02:30 standard time in Berlin
+	} {
+		for _, loc := range []*time.Location{time.UTC, berlin} {
+			got, ok, err := parseCP56Time2a(i104mproto.EncodeCP56Time2a(want, true, loc), loc)
+			if err != nil || !ok || !got.Equal(want) {
+				t.Errorf("%v in %v: got %v ok=%v err=%v", want, loc, got, ok, err)
+			}
+		}
+	}
+	if _, ok, _ := parseCP56Time2a(i104mproto.EncodeCP56Time2a(time.Now(), false, time.UTC), time.UTC); ok {
+		t.Error("invalid time tag decoded as ok")
+	}
+}
+
+// CP56Time2a of each time-tagged ASDU, after the value and quality of the object
+func TestParseObjTimeTags(t *testing.T) {
+	protCon := &ProtocolConnection{sourceLocation: time.UTC}
+	tag := cp56(2020, 7, 15, 13, 45, 12345, 3, false, false)
+	want := time.Date(2020, 7, 15, 13, 45, 12, 345e6, time.UTC)
+	tests := []struct {
+		name  string
+		asdu  uint32
+		value []byte // value and quality
+		want  float64
+	}{
+		{"single", 30, []byte{0x01}, 1},
+		{"double", 31, []byte{0x02}, 1},
+		{"step position", 32, []byte{0x05, 0x00}, 5},
+		{"normalized", 34, []byte{0x00, 0x40, 0x00}, 0.5},
+		{"scaled", 35, []byte{0xD2, 0x04, 0x00}, 1234},
+		{"float", 36, []byte{0x00, 0x00, 0x80, 0x3F, 0x00}, 1},
+	}
+	for _, tt := range tests {
+		for _, iv := range []bool{false, true} {
+			tag := append([]byte(nil), tag...)
+			if iv {
+				tag[2] |= i104mproto.TimeTagInvalidBit
+			}
+			info := append(append([]byte(nil), tt.value...), tag...)
+			upd, ok := i104mParseObj(info, 1, tt.asdu, decodeCOT(COT_SPONTANEOUS), protCon)
+			if !ok {
+				t.Errorf("%s: not decoded", tt.name)
+				continue
+			}
+			if upd.Value != tt.want || !upd.HasTime || !upd.TimeTag.Equal(want) || upd.TimeTagOk == iv {
+				t.Errorf("%s IV=%v: got value=%g hasTime=%v time=%v ok=%v, want %g %v",
+					tt.name, iv, upd.Value, upd.HasTime, upd.TimeTag, upd.TimeTagOk, tt.want, want)
+			}
+		}
+
+		// fields out of range: the value is kept without source time
+		info := append(append([]byte(nil), tt.value...), cp56(2020, 13, 15, 13, 45, 0, 0, false, false)...)
+		if upd, ok := i104mParseObj(info, 1, tt.asdu, decodeCOT(COT_SPONTANEOUS), protCon); !ok || upd.HasTime || upd.Value != tt.want {
+			t.Errorf("%s: invalid time tag, got value=%g hasTime=%v", tt.name, upd.Value, upd.HasTime)
+		}
+	}
+}
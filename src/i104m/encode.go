@@ -0,0 +1,27 @@
+package main
+
+import (
+	"time"
+
+	"i104mproto"
+)
+
+// encode the information of an object (value, quality and time tag) for its ASDU, the reverse of i104mParseObj.
+// ASDUs with time tag use the current time (marked invalid) when the update has no time.
+func (upd PointUpdate) encode(loc *time.Location) ([]byte, bool) {
+	info := i104mproto.Info{
+		Value:       upd.Value,
+		Invalid:     upd.Invalid,
+		NotTopical:  upd.NotTopical,
+		Substituted: upd.Substituted,
+		Blocked:     upd.Blocked,
+		Overflow:    upd.Overflow,
+		Transient:   upd.Transient,
+		Time:        upd.TimeTag,
+		TimeOk:      upd.TimeTagOk,
+	}
+	if !upd.HasTime {
+		info.Time, info.TimeOk = time.Now(), false
+	}
+	return i104mproto.EncodeInfo(upd.Asdu, info, loc)
+}
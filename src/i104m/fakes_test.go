@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// In-memory implementations of the stores and of the transport, for tests
+
+var errStoreUnreachable = errors.New("store unreachable")
+
+type fakeClock struct {
+	mutex sync.Mutex
+	t     time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// realtimeData writes
+type fakePointWriter struct {
+	writes [][]PointUpdate
+	err    error
+}
+
+func (w *fakePointWriter) WritePoints(ctx context.Context, upds []PointUpdate, defs PointDefs) error {
+	if w.err != nil {
+		return w.err
+	}
+	w.writes = append(w.writes, append([]PointUpdate(nil), upds...))
+	return nil
+}
+
+// all updates written, in order
+func (w *fakePointWriter) updates() []PointUpdate {
+	var upds []PointUpdate
+	for _, write := range w.writes {
+		upds = append(upds, write...)
+	}
+	return upds
+}
+
+// commandsQueue
+type fakeCommandStore struct {
+	commands map[primitive.ObjectID]*fakeCommand
+	archived []*fakeCommand
+}
+
+type fakeCommand struct {
+	cmd      Command
+	state    string
+	reason   string
+	timeTags map[string]time.Time // time of each transition
+}
+
+func newFakeCommandStore() *fakeCommandStore {
+	return &fakeCommandStore{commands: map[primitive.ObjectID]*fakeCommand{}}
+}
+
+// insert a command, as the HMI
+func (s *fakeCommandStore) insert(cmd Command) {
+	s.commands[cmd.Id] = &fakeCommand{cmd: cmd, timeTags: map[string]time.Time{}}
+}
+
+func (s *fakeCommandStore) state(id primitive.ObjectID) string {
+	if c, found := s.commands[id]; found {
+		return c.state
+	}
+	return ""
+}
+
+func (s *fakeCommandStore) SetState(id primitive.ObjectID, state string, reason string, t time.Time) {
+	c, found := s.commands[id]
+	if !found || !validCommandTransition(c.state, state) {
+		return
+	}
+	c.state = state
+	c.timeTags[state] = t
+	if reason != "" {
+		c.reason = reason
+	}
+}
+
+// command store holding the writes of one state until released (a slow MongoDB), safe for concurrent use
+type blockingCommandStore struct {
+	*fakeCommandStore
+	mutex   sync.Mutex
+	block   string
+	blocked chan struct{} // a write of the state is held
+	release chan struct{}
+}
+
+func newBlockingCommandStore(block string) *blockingCommandStore {
+	return &blockingCommandStore{fakeCommandStore: newFakeCommandStore(), block: block, blocked: make(chan struct{}, 1), release: make(chan struct{})}
+}
+
+func (s *blockingCommandStore) SetState(id primitive.ObjectID, state string, reason string, t time.Time) {
+	if state == s.block {
+		s.blocked <- struct{}{}
+		<-s.release
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.fakeCommandStore.SetState(id, state, reason, t)
+}
+
+func (s *fakeCommandStore) stateTime(c *fakeCommand) time.Time {
+	if c.state == "" {
+		return c.cmd.TimeTag
+	}
+	return c.timeTags[c.state]
+}
+
+func (s *fakeCommandStore) ExpireStale(connectionNumber int, timeout time.Duration, now time.Time) (int, error) {
+	n := 0
+	for _, c := range s.commands {
+		if c.cmd.ProtocolSourceConnectionNumber != connectionNumber || !s.stateTime(c).Before(now.Add(-timeout)) {
+			continue
+		}
+		switch c.state {
+		case CommandSent, CommandSelected:
+			c.reason = "no confirmation"
+		case "", CommandQueued:
+			c.reason = "expired"
+		default: // confirmed and final states
+			continue
+		}
+		c.state = CommandExpired
+		c.timeTags[CommandExpired] = now
+		n++
+	}
+	return n, nil
+}
+
+func (s *fakeCommandStore) Archive(connectionNumber int, age time.Duration, now time.Time) (int, error) {
+	n := 0
+	for id, c := range s.commands {
+		if c.cmd.ProtocolSourceConnectionNumber != connectionNumber || !c.cmd.TimeTag.Before(now.Add(-age)) {
+			continue
+		}
+		switch c.state {
+		case "", CommandQueued, CommandSent, CommandSelected:
+			continue
+		}
+		s.archived = append(s.archived, c)
+		delete(s.commands, id)
+		n++
+	}
+	return n, nil
+}
+
+// transport that records the frames sent
+type fakeTransport struct {
+	sent    [][]byte
+	failMsg string // send fails with this message when not empty
+}
+
+func (t *fakeTransport) Receive(ctx context.Context, handler func(frame []byte, from string)) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (t *fakeTransport) Send(frame []byte) (ok bool, err_msg string) {
+	if t.failMsg != "" {
+		return false, t.failMsg
+	}
+	t.sent = append(t.sent, append([]byte(nil), frame...))
+	return true, ""
+}
+
+func (t *fakeTransport) Close() error {
+	return nil
+}
+
+// redundancy store sharing one instance document between nodes, lease conditions use the fake clock as store clock
+type fakeRedundancyStore struct {
+	mutex    sync.Mutex
+	clock    *fakeClock
+	instance ProtocolDriverInstance
+	events   []RedundancyEvent
+	status   map[string]NodeStatus
+	down     bool // simulates the store unreachable
+}
+
+func newFakeRedundancyStore(clock *fakeClock, nodeNames ...string) *fakeRedundancyStore {
+	return &fakeRedundancyStore{
+		clock: clock,
+		instance: ProtocolDriverInstance{
+			Id:                           primitive.NewObjectID(),
+			ProtocolDriver:               DriverName,
+			ProtocolDriverInstanceNumber: 1,
+			Enabled:                      true,
+			NodeNames:                    nodeNames,
+			LeaseDuration:                15,
+		},
+		status: map[string]NodeStatus{},
+	}
+}
+
+func (s *fakeRedundancyStore) get() ProtocolDriverInstance {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.instance
+}
+
+func (s *fakeRedundancyStore) update(f func(instance *ProtocolDriverInstance)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f(&s.instance)
+}
+
+func (s *fakeRedundancyStore) setDown(down bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.down = down
+}
+
+func (s *fakeRedundancyStore) eventsOf(nodeName string) []RedundancyEvent {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var events []RedundancyEvent
+	for _, event := range s.events {
+		if event.NodeName == nodeName {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+func (s *fakeRedundancyStore) ReadInstance(ctx context.Context) (ProtocolDriverInstance, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.down {
+		return ProtocolDriverInstance{}, errStoreUnreachable
+	}
+	return s.instance, nil
+}
+
+func (s *fakeRedundancyStore) heldBy(nodeName string, epoch int64) bool {
+	return s.instance.ActiveNodeName == nodeName && s.instance.ActiveNodeEpoch == epoch
+}
+
+func (s *fakeRedundancyStore) clearSwitchoverTo(nodeName string) {
+	if s.instance.SwitchoverToNodeName == nodeName {
+		s.instance.SwitchoverToNodeName = ""
+	}
+}
+
+func (s *fakeRedundancyStore) RenewLease(ctx context.Context, nodeName string, epoch int64, leaseDuration time.Duration) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.down {
+		return false, errStoreUnreachable
+	}
+	if !s.heldBy(nodeName, epoch) {
+		return false, nil
+	}
+	now := s.clock.Now()
+	s.instance.ActiveNodeKeepAliveTimeTag = now
+	s.instance.LeaseExpiration = now.Add(leaseDuration)
+	s.clearSwitchoverTo(nodeName)
+	return true, nil
+}
+
+func (s *fakeRedundancyStore) AcquireLease(ctx context.Context, nodeName string, observedEpoch int64, handedOver bool, delay time.Duration, leaseDuration time.Duration) (ProtocolDriverInstance, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.down {
+		return ProtocolDriverInstance{}, false, errStoreUnreachable
+	}
+	now := s.clock.Now()
+	if s.instance.ActiveNodeEpoch != observedEpoch {
+		return ProtocolDriverInstance{}, false, nil
+	}
+	if handedOver && s.instance.ActiveNodeName != nodeName ||
+		!handedOver && !s.instance.LeaseExpiration.Add(delay).Before(now) {
+		return ProtocolDriverInstance{}, false, nil
+	}
+	s.instance.ActiveNodeName = nodeName
+	s.instance.ActiveNodeKeepAliveTimeTag = now
+	s.instance.LeaseExpiration = now.Add(leaseDuration)
+	s.instance.ActiveNodeEpoch++
+	s.instance.HandoverFromNodeName = ""
+	s.clearSwitchoverTo(nodeName)
+	return s.instance, true, nil
+}
+
+func (s *fakeRedundancyStore) HandoverLease(ctx context.Context, nodeName string, epoch int64, target string, leaseDuration time.Duration) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.down {
+		return false, errStoreUnreachable
+	}
+	if !s.heldBy(nodeName, epoch) {
+		return false, nil
+	}
+	now := s.clock.Now()
+	s.instance.ActiveNodeName = target
+	s.instance.HandoverFromNodeName = nodeName
+	s.instance.ActiveNodeKeepAliveTimeTag = now
+	s.instance.LeaseExpiration = now.Add(leaseDuration)
+	s.instance.SwitchoverToNodeName = ""
+	return true, nil
+}
+
+func (s *fakeRedundancyStore) ReleaseLease(ctx context.Context, nodeName string, epoch int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.down {
+		return errStoreUnreachable
+	}
+	if s.heldBy(nodeName, epoch) {
+		s.instance.ActiveNodeName = ""
+		s.instance.LeaseExpiration = s.clock.Now()
+	}
+	return nil
+}
+
+func (s *fakeRedundancyStore) WatchInstance(ctx context.Context, changed func(ProtocolDriverInstance)) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (s *fakeRedundancyStore) InsertEvent(ctx context.Context, event RedundancyEvent) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.down {
+		return errStoreUnreachable
+	}
+	s.events = append(s.events, event)
+	return nil
+}
+
+func (s *fakeRedundancyStore) UpdateNodeStatus(ctx context.Context, status NodeStatus) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.down {
+		return errStoreUnreachable
+	}
+	s.status[status.NodeName] = status
+	return nil
+}
+
+// commandsQueue inserts of the server mode
+type fakeCommandQueue struct {
+	commands []ServerCommand
+	err      error
+}
+
+func (q *fakeCommandQueue) InsertCommand(ctx context.Context, cmd ServerCommand) error {
+	if q.err != nil {
+		return q.err
+	}
+	q.commands = append(q.commands, cmd)
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Last value written to MongoDB for an object address
+type lastValue struct {
+	upd     PointUpdate
+	written time.Time
+}
+
+// In-memory cache of last written values, used to discard updates without significant changes
+type ChangeFilter struct {
+	last map[uint32]*lastValue
+}
+
+func NewChangeFilter() *ChangeFilter {
+	return &ChangeFilter{last: map[uint32]*lastValue{}}
+}
+
+// forget all last written values
+func (f *ChangeFilter) Reset() {
+	f.last = map[uint32]*lastValue{}
+}
+
+// check if the update must be written. With changeOnlyUpdates, writes only time tagged events,
+// quality changes, value changes beyond the deadband or unchanged values after refreshInterval seconds.
+func (f *ChangeFilter) Accept(upd PointUpdate, def *PointDef, protCon *ProtocolConnection, now time.Time) bool {
+	prev, found := f.last[upd.ObjAddr]
+	if protCon.ChangeOnlyUpdates && found &&
+		!upd.HasTime &&
+		sameQuality(upd, prev.upd) &&
+		!(protCon.RefreshInterval > 0 && now.Sub(prev.written) >= time.Duration(protCon.RefreshInterval)*time.Second) &&
+		!valueChanged(upd, prev.upd, def, protCon) {
+		return false
+	}
+	f.last[upd.ObjAddr] = &lastValue{upd: upd, written: now}
+	return true
+}
+
+func sameQuality(a, b PointUpdate) bool {
+	return a.Invalid == b.Invalid &&
+		a.NotTopical == b.NotTopical &&
+		a.Substituted == b.Substituted &&
+		a.Blocked == b.Blocked &&
+		a.Overflow == b.Overflow &&
+		a.Transient == b.Transient &&
+		a.Questionable == b.Questionable &&
+		a.Carry == b.Carry
+}
+
+// compare values, analogs use the larger of the absolute and percent (of last value) deadbands,
+// point definition settings override the connection settings
+func valueChanged(upd, prev PointUpdate, def *PointDef, protCon *ProtocolConnection) bool {
+	if isDigitalAsdu(upd.Asdu) {
+		return upd.Value != prev.Value
+	}
+
+	deadBand := protCon.DeadBand
+	deadBandPercent := protCon.DeadBandPercent
+	if def != nil && (def.ProtocolSourceDeadBand != nil || def.ProtocolSourceDeadBandPercent != nil) {
+		deadBand, deadBandPercent = 0, 0
+		if def.ProtocolSourceDeadBand != nil {
+			deadBand = *def.ProtocolSourceDeadBand
+		}
+		if def.ProtocolSourceDeadBandPercent != nil {
+			deadBandPercent = *def.ProtocolSourceDeadBandPercent
+		}
+	}
+
+	band := math.Max(math.Abs(deadBand), math.Abs(prev.Value)*math.Abs(deadBandPercent)/100)
+	if band == 0 {
+		return upd.Value != prev.Value
+	}
+	return math.Abs(upd.Value-prev.Value) > band
+}
+
+func isDigitalAsdu(iecAsdu uint32) bool {
+	switch iecAsdu {
+	case 1, 2, 3, 4, 30, 31:
+		return true
+	}
+	return false
+}
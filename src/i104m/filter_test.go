@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func float64Ptr(v float64) *float64 {
+	return &v
+}
+
+// updates written with changeOnlyUpdates, after a first value of 100 (analogs) or 1 (digitals)
+func TestChangeFilter(t *testing.T) {
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	protCon := &ProtocolConnection{ChangeOnlyUpdates: true, DeadBand: 1, DeadBandPercent: 2, RefreshInterval: 60}
+	tests := []struct {
+		name   string
+		upd    PointUpdate
+		def    *PointDef
+		after  time.Duration
+		accept bool
+	}{
+		{"analog unchanged", PointUpdate{Asdu: 13, Value: 100}, nil, time.Second, false},
+		{"analog inside percent deadband", PointUpdate{Asdu: 13, Value: 102}, nil, time.Second, false},
+		{"analog beyond percent deadband", PointUpdate{Asdu: 13, Value: 102.5}, nil, time.Second, true},
+		{"analog decrease beyond deadband", PointUpdate{Asdu: 13, Value: 97.9}, nil, time.Second, true},
+		{"point deadband", PointUpdate{Asdu: 13, Value: 100.6}, &PointDef{ProtocolSourceDeadBand: float64Ptr(0.5)}, time.Second, true},
+		{"point deadband replaces percent", PointUpdate{Asdu: 13, Value: 101.5}, &PointDef{ProtocolSourceDeadBand: float64Ptr(2)}, time.Second, false},
+		{"point percent replaces absolute", PointUpdate{Asdu: 13, Value: 100.6}, &PointDef{ProtocolSourceDeadBandPercent: float64Ptr(0.5)}, time.Second, true},
+		{"point deadband zero", PointUpdate{Asdu: 13, Value: 100.01}, &PointDef{ProtocolSourceDeadBand: float64Ptr(0)}, time.Second, true},
+		{"point deadband zero unchanged", PointUpdate{Asdu: 13, Value: 100}, &PointDef{ProtocolSourceDeadBand: float64Ptr(0)}, time.Second, false},
+		{"analog quality change", PointUpdate{Asdu: 13, Value: 100, Invalid: true}, nil, time.Second, true},
+		{"analog overflow change", PointUpdate{Asdu: 13, Value: 100, Overflow: true}, nil, time.Second, true},
+		{"analog refresh", PointUpdate{Asdu: 13, Value: 100}, nil, 60 * time.Second, true},
+		{"analog before refresh", PointUpdate{Asdu: 13, Value: 100}, nil, 59 * time.Second, false},
+		{"analog time tagged", PointUpdate{Asdu: 36, Value: 100, HasTime: true}, nil, time.Second, true},
+		{"digital unchanged", PointUpdate{Asdu: 1, Value: 1}, &PointDef{ProtocolSourceDeadBand: float64Ptr(5)}, time.Second, false},
+		{"digital changed", PointUpdate{Asdu: 1, Value: 0}, &PointDef{ProtocolSourceDeadBand: float64Ptr(5)}, time.Second, true},
+		{"digital quality change", PointUpdate{Asdu: 3, Value: 1, Transient: true}, nil, time.Second, true},
+		{"digital time tagged", PointUpdate{Asdu: 30, Value: 1, HasTime: true}, nil, time.Second, true},
+	}
+	for _, tt := range tests {
+		f := NewChangeFilter()
+		first := PointUpdate{ObjAddr: 1, Asdu: tt.upd.Asdu, Value: 100}
+		if isDigitalAsdu(tt.upd.Asdu) {
+			first.Value = 1
+		}
+		if !f.Accept(first, tt.def, protCon, start) {
+			t.Fatalf("%s: first update not accepted", tt.name)
+		}
+		tt.upd.ObjAddr = 1
+		if got := f.Accept(tt.upd, tt.def, protCon, start.Add(tt.after)); got != tt.accept {
+			t.Errorf("%s: got accepted=%v, want %v", tt.name, got, tt.accept)
+		}
+	}
+}
+
+// the reference value and time are those of the last update written
+func TestChangeFilterLastWritten(t *testing.T) {
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	protCon := &ProtocolConnection{ChangeOnlyUpdates: true, DeadBand: 1, RefreshInterval: 60}
+	f := NewChangeFilter()
+	steps := []struct {
+		addr   uint32
+		value  float64
+		after  time.Duration
+		accept bool
+	}{
+		{1, 10, 0, true},
+		{2, 10, 0, true}, // other address
+		{1, 10.6, 10 * time.Second, false},
+		{1, 11.2, 20 * time.Second, true}, // drift from the last written value
+		{1, 11.5, 30 * time.Second, false},
+		{1, 11.5, 79 * time.Second, false},
+		{1, 11.5, 80 * time.Second, true}, // refresh counted from the last write
+		{2, 10, 80 * time.Second, true},
+		{1, 11.5, 100 * time.Second, false},
+	}
+	for i, s := range steps {
+		if got := f.Accept(PointUpdate{ObjAddr: s.addr, Asdu: 13, Value: s.value}, nil, protCon, start.Add(s.after)); got != s.accept {
+			t.Errorf("step %d: got accepted=%v, want %v", i, got, s.accept)
+		}
+	}
+
+	// after a reset every address is written again
+	f.Reset()
+	if !f.Accept(PointUpdate{ObjAddr: 1, Asdu: 13, Value: 11.5}, nil, protCon, start.Add(101*time.Second)) {
+		t.Error("update not accepted after reset")
+	}
+}
+
+// without changeOnlyUpdates every update is written, no refresh when refreshInterval is zero
+func TestChangeFilterSettings(t *testing.T) {
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	upd := PointUpdate{ObjAddr: 1, Asdu: 13, Value: 5}
+
+	f := NewChangeFilter()
+	all := &ProtocolConnection{ChangeOnlyUpdates: false, DeadBand: 10}
+	for i := 0; i < 3; i++ {
+		if !f.Accept(upd, nil, all, start) {
+			t.Fatal("update not accepted without changeOnlyUpdates")
+		}
+	}
+
+	f = NewChangeFilter()
+	noRefresh := &ProtocolConnection{ChangeOnlyUpdates: true}
+	f.Accept(upd, nil, noRefresh, start)
+	if f.Accept(upd, nil, noRefresh, start.Add(24*time.Hour)) {
+		t.Error("unchanged update accepted with refreshInterval 0")
+	}
+	upd.Value = 5.001
+	if !f.Accept(upd, nil, noRefresh, start.Add(24*time.Hour)) {
+		t.Error("changed update not accepted without deadbands")
+	}
+}
@@ -4,63 +4,51 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"net"
 	"os"
-	"path/filepath"
-	"strconv"
 	"strings"
-	"sync"
 	"time"
 
+	"i104mproto"
+	"jsonscada"
+
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var Version string = "{json:scada} I104M Protocol Driver v.0.1 - Copyright 2020 Ricardo L. Olsen"
 var DriverName string = "I104M"
-var IsActive bool = false
 
 const UDPChannelSize = 1000
+const MongoPingMaxBackoff = 30 * time.Second // max interval between pings while MongoDB is unreachable
 
-type ConfigData struct {
-	NodeName                 string `json: "nodeName"`
-	MongoConnectionString    string `json: "mongoConnectionString"`
-	MongoDatabaseName        string `json: "mongoDatabaseName"`
-	TlsCaPemFile             string `json: "tlsCaPemFile"`
-	TlsClientPemFile         string `json: "tlsClientPemFile"`
-	TlsClientPfxFile         string `json: "tlsClientPfxFile"`
-	TlsClientKeyPassword     string `json: "tlsClientKeyPassword"`
-	TlsAllowInvalidHostnames bool   `json: "tlsAllowInvalidHostnames"`
-	TlsAllowChainErrors      bool   `json: "tlsAllowChainErrors"`
-	TlsInsecure              bool   `json: "tlsInsecure"`
-}
-
-type Command struct {
-	Id                             primitive.ObjectID `json:"_id" bson:"_id"`
-	ProtocolSourceConnectionNumber int                `json: "protocolSourceConnectionNumber"`
-	ProtocolSourceCommonAddress    int                `json: "protocolSourceCommonAddress"`
-	ProtocolSourceObjectAddress    int                `json: "protocolSourceObjectAddress"`
-	ProtocolSourceASDU             int                `json: "protocolSourceASDU"`
-	ProtocolSourceCommandDuration  int                `json: "protocolSourceCommandDuration"`
-	ProtocolSourceCommandUseSBO    bool               `json: "protocolSourceCommandUseSBO"`
-	PointKey                       int                `json: "pointKey"`
-	Tag                            string             `json: "tag"`
-	TimeTag                        time.Time          `json: "timeTag"`
-	Value                          float64            `json: "value"`
-	ValueString                    string             `json: "valueString"`
-	OriginatorUserName             string             `json: "originatorUserName"`
-	OriginatorIpAddress            string             `json: "originatorIpAddress"`
+// I104M packet received from a peer
+type ReceivedPacket struct {
+	Data []byte
+	From string
 }
 
-type InsertChange struct {
-	FullDocument  Command `json: "fullDocument"`
-	OperationType string  `json: "operationType"`
+// Decoded information object received from I104M
+type PointUpdate struct {
+	ObjAddr      uint32
+	Asdu         uint32
+	Cot          CauseOfTransmission
+	Value        float64
+	RawValue     float64 // value as received, before the point settings
+	Invalid      bool
+	NotTopical   bool
+	Substituted  bool
+	Blocked      bool
+	Overflow     bool
+	Transient    bool
+	Questionable bool
+	Carry        bool
+	HasTime      bool
+	TimeTag      time.Time
+	TimeTagOk    bool
 }
 
 type ProtocolDriverInstance struct {
@@ -73,756 +61,570 @@ type ProtocolDriverInstance struct {
 	ActiveNodeName                   string             `json: "activeNodeName"`
 	ActiveNodeKeepAliveTimeTag       time.Time          `json: "activeNodeKeepAliveTimeTag"`
 	KeepProtocolRunningWhileInactive bool               `json: "keepProtocolRunningWhileInactive"`
+	LeaseDuration                    int                `json: "leaseDuration"`
+	LeaseExpiration                  time.Time          `json: "leaseExpiration"`
+	ActiveNodeEpoch                  int64              `json: "activeNodeEpoch"`
+	SwitchoverToNodeName             string             `json: "switchoverToNodeName"`
+	PinnedNodeName                   string             `json: "pinnedNodeName"`
+	HandoverFromNodeName             string             `json: "handoverFromNodeName"`
 }
 
 type ProtocolConnection struct {
-	ProtocolDriver               string   `json: "protocolDriver"`
-	ProtocolDriverInstanceNumber int      `json: "protocolDriverInstanceNumber"`
-	ProtocolConnectionNumber     int      `json: "protocolConnectionNumber"`
-	Name                         string   `json: "name"`
-	Description                  string   `json: "description"`
-	Enabled                      bool     `json: "enabled"`
-	CommandsEnabled              bool     `json: "commandsEnabled"`
-	IpAddressLocalBind           string   `json: "ipAddressLocalBind"`
-	IpAddresses                  []string `json: "ipAddresses"`
-}
-
-// check error, terminate app if error
-func checkFatalError(err error) {
-	if err != nil {
-		log.Fatal(err)
-	}
+	ProtocolDriver               string         `json: "protocolDriver"`
+	ProtocolDriverInstanceNumber int            `json: "protocolDriverInstanceNumber"`
+	ProtocolConnectionNumber     int            `json: "protocolConnectionNumber"`
+	Name                         string         `json: "name"`
+	Description                  string         `json: "description"`
+	Enabled                      bool           `json: "enabled"`
+	CommandsEnabled              bool           `json: "commandsEnabled"`
+	IpAddressLocalBind           string         `json: "ipAddressLocalBind"`
+	IpAddresses                  []string       `json: "ipAddresses"`
+	RemoteLinkAddress            int            `json: "remoteLinkAddress"`
+	GiInterval                   int            `json: "giInterval"`
+	CiInterval                   int            `json: "ciInterval"`
+	TimeSyncInterval             int            `json: "timeSyncInterval"`
+	SourceTimeZone               string         `json: "sourceTimeZone"`
+	SoeFromInterrogation         bool           `json: "soeFromInterrogation"`
+	AcceptTestData               bool           `json: "acceptTestData"`
+	ChangeOnlyUpdates            bool           `json: "changeOnlyUpdates"`
+	DeadBand                     float64        `json: "deadBand"`
+	DeadBandPercent              float64        `json: "deadBandPercent"`
+	RefreshInterval              int            `json: "refreshInterval"`
+	DecimalPlaces                int            `json: "decimalPlaces"`
+	StateTextTransit             string         `json: "stateTextTransit"`
+	Transport                    string         `json: "transport"`
+	AuthMode                     string         `json: "authMode"`
+	AuthKeys                     []AuthKey      `json: "authKeys"`
+	AuthSendKeyId                int            `json: "authSendKeyId"`
+	AuthMaxClockSkew             int            `json: "authMaxClockSkew"`
+	QualityProfile               QualityProfile `json: "qualityProfile"`
+	CommandTimeout               int            `json: "commandTimeout"`
+	CommandsArchiveAge           int            `json: "commandsArchiveAge"`
+	sourceLocation               *time.Location
+	auth                         *Authenticator
+	transport                    Transport
+	stats                        *TrafficStats
 }
 
-func mongoConnect(cfg ConfigData) (client *mongo.Client, err error, collRTD *mongo.Collection, collInsts *mongo.Collection, collConns *mongo.Collection, collCmds *mongo.Collection) {
+func mongoConnect(cfg jsonscada.Config) (client *mongo.Client, err error, collRTD *mongo.Collection, collInsts *mongo.Collection, collConns *mongo.Collection, collCmds *mongo.Collection) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
 
-	if cfg.TlsCaPemFile != "" || cfg.TlsClientPemFile != "" {
-		cfg.MongoConnectionString = cfg.MongoConnectionString + "&tls=true"
-	}
-	if cfg.TlsCaPemFile != "" {
-		cfg.MongoConnectionString = cfg.MongoConnectionString + "&tlsCAFile=" + cfg.TlsCaPemFile
-	}
-	if cfg.TlsClientPemFile != "" {
-		cfg.MongoConnectionString = cfg.MongoConnectionString + "&tlsCertificateKeyFile=" + cfg.TlsClientPemFile
-	}
-	if cfg.TlsClientKeyPassword != "" {
-		cfg.MongoConnectionString = cfg.MongoConnectionString + "&tlsCertificateKeyFilePassword=" + cfg.TlsClientKeyPassword
-	}
-	if cfg.TlsInsecure {
-		cfg.MongoConnectionString = cfg.MongoConnectionString + "&tlsInsecure=true"
-	}
-	if cfg.TlsAllowChainErrors {
-		cfg.MongoConnectionString = cfg.MongoConnectionString + "&tlsInsecure=true"
-	}
-	if cfg.TlsAllowInvalidHostnames {
-		cfg.MongoConnectionString = cfg.MongoConnectionString + "&tlsAllowInvalidHostnames=true"
-	}
-
-	client, err = mongo.NewClient(options.Client().ApplyURI(cfg.MongoConnectionString))
+	client, err = jsonscada.Connect(ctx, cfg)
 	if err != nil {
 		return client, err, collRTD, collInsts, collConns, collCmds
 	}
-
-	err = client.Connect(ctx)
-	if err != nil {
-		return client, err, collRTD, collInsts, collConns, collCmds
-	}
-	collRTD = client.Database(cfg.MongoDatabaseName).Collection("realtimeData")
-	collInsts = client.Database(cfg.MongoDatabaseName).Collection("protocolDriverInstances")
-	collConns = client.Database(cfg.MongoDatabaseName).Collection("protocolConnections")
-	collCmds = client.Database(cfg.MongoDatabaseName).Collection("commandsQueue")
+	db := client.Database(cfg.MongoDatabaseName)
+	collRTD = db.Collection(jsonscada.RealtimeDataCollectionName)
+	collInsts = db.Collection(jsonscada.ProtocolDriverInstancesCollectionName)
+	collConns = db.Collection(jsonscada.ProtocolConnectionsCollectionName)
+	collCmds = db.Collection(jsonscada.CommandsQueueCollectionName)
 
 	return client, err, collRTD, collInsts, collConns, collCmds
 }
 
-// Cancel a command on commandsQueue collection
-func CommandCancel(collectionCommands *mongo.Collection, Id primitive.ObjectID, cancelReason string) {
-	// write cancel to the command in mongo
-	_, err := collectionCommands.UpdateOne(
-		context.TODO(),
-		bson.M{"_id": bson.M{"$eq": Id}},
-		bson.M{"$set": bson.M{"cancelReason": cancelReason}},
-	)
-	if err != nil {
-		log.Println(err)
-		log.Println("Can not write update to command on mongo!")
-	}
+// send a frame to the peers of the connection (signed when authentication is required), ok if delivered to at least one
+func i104mSendToPeers(protCon *ProtocolConnection, frame []byte) (ok bool, err_msg string) {
+	return protCon.transport.Send(protCon.auth.Seal(frame, time.Now()))
 }
 
-// Signals a command delvered to protocol on commandsQueue collection
-func CommandDelivered(collectionCommands *mongo.Collection, Id primitive.ObjectID) {
-	// write cancel to the command in mongo
-	_, err := collectionCommands.UpdateOne(
-		context.TODO(),
-		bson.M{"_id": bson.M{"$eq": Id}},
-		bson.M{"$set": bson.M{"delivered": true, "ack": true, "ackTimeTag": time.Now()}},
-	)
-	if err != nil {
-		log.Println(err)
-		log.Println("Can not write update to command on mongo!")
-	}
-}
-
-// process commands from change stream, forward commands via UDP
-func iterateChangeStream(routineCtx context.Context, waitGroup *sync.WaitGroup, stream *mongo.ChangeStream, protCon *ProtocolConnection, UdpConn *net.UDPConn, collectionCommands *mongo.Collection) {
-	defer stream.Close(routineCtx)
-	defer waitGroup.Done()
-	for stream.Next(routineCtx) {
-		if !IsActive {
-			return
-		}
-
-		var insDoc InsertChange
-		if err := stream.Decode(&insDoc); err != nil {
-			log.Println(err)
-			continue
-		}
-
-		if insDoc.OperationType == "insert" && insDoc.FullDocument.ProtocolSourceConnectionNumber == protCon.ProtocolConnectionNumber {
-			log.Printf("Command received on connection %d, %s %f", insDoc.FullDocument.ProtocolSourceConnectionNumber, insDoc.FullDocument.Tag, insDoc.FullDocument.Value)
-
-			// test for time expired, if too old command (> 10s) then cancel it
-			if time.Now().Sub(insDoc.FullDocument.TimeTag) > 10*time.Second {
-				log.Println("Command expired ", time.Now().Sub(insDoc.FullDocument.TimeTag))
-				// write cancel to the command in mongo
-				CommandCancel(collectionCommands, insDoc.FullDocument.Id, "expired")
-				continue
-			}
-
-			// All is ok, so send command to I104M UPD
-
-			buf := new(bytes.Buffer)
-			var cmdSig uint32 = 0x4b4b4b4b
-			err := binary.Write(buf, binary.LittleEndian, cmdSig)
-			if err != nil {
-				CommandCancel(collectionCommands, insDoc.FullDocument.Id, "udp buffer write error")
-				log.Println("binary.Write failed:", err)
-				continue
-			}
-			var addr uint32 = uint32(insDoc.FullDocument.ProtocolSourceObjectAddress)
-			err = binary.Write(buf, binary.LittleEndian, addr)
-			if err != nil {
-				CommandCancel(collectionCommands, insDoc.FullDocument.Id, "udp buffer write error")
-				log.Println("binary.Write failed:", err)
-				continue
-			}
-			var tiType uint32 = uint32(insDoc.FullDocument.ProtocolSourceASDU)
-			err = binary.Write(buf, binary.LittleEndian, tiType)
-			if err != nil {
-				CommandCancel(collectionCommands, insDoc.FullDocument.Id, "udp buffer write error")
-				log.Println("binary.Write failed:", err)
-				continue
-			}
-			var value uint32 = uint32(insDoc.FullDocument.Value)
-			err = binary.Write(buf, binary.LittleEndian, value)
-			if err != nil {
-				CommandCancel(collectionCommands, insDoc.FullDocument.Id, "udp buffer write error")
-				log.Println("binary.Write failed:", err)
-				continue
-			}
-			var sbo uint32 = 0
-			if insDoc.FullDocument.ProtocolSourceCommandUseSBO {
-				sbo = 1
-			}
-			err = binary.Write(buf, binary.LittleEndian, sbo)
-			if err != nil {
-				CommandCancel(collectionCommands, insDoc.FullDocument.Id, "udp buffer write error")
-				log.Println("binary.Write failed:", err)
-				continue
-			}
-			var qu uint32 = uint32(insDoc.FullDocument.ProtocolSourceCommandDuration)
-			err = binary.Write(buf, binary.LittleEndian, qu)
-			if err != nil {
-				CommandCancel(collectionCommands, insDoc.FullDocument.Id, "udp buffer write error")
-				log.Println("binary.Write failed:", err)
-				continue
-			}
-			var ca uint32 = uint32(insDoc.FullDocument.ProtocolSourceCommonAddress)
-			err = binary.Write(buf, binary.LittleEndian, ca)
-			if err != nil {
-				CommandCancel(collectionCommands, insDoc.FullDocument.Id, "udp buffer write error")
-				log.Println("binary.Write failed:", err)
-				continue
-			}
-
-			err_msg := ""
-			ok := false
-			for _, ipAddressDest := range protCon.IpAddresses {
-				if strings.TrimSpace(ipAddressDest) == "" {
-					err_msg = "no IP destination"
-					continue
-				}
-				udpAddr, err := net.ResolveUDPAddr("udp", ipAddressDest)
-				if err != nil {
-					err_msg = "IP address error"
-					log.Println("Error on IP: ", err)
-					continue
-				}
-				_, err = UdpConn.WriteToUDP(buf.Bytes(), udpAddr)
-				if err != nil {
-					err_msg = "UDP send error"
-					log.Println("Error on IP: ", err)
-					continue
-				}
-				// success delivering command
-				log.Println("Command sent to: ", ipAddressDest)
-				ok = true
-				// log.Println(buf.Bytes())
-			}
-			if ok == true {
-				CommandDelivered(collectionCommands, insDoc.FullDocument.Id)
-			} else {
-				CommandCancel(collectionCommands, insDoc.FullDocument.Id, err_msg)
-				log.Println("Command canceled!")
-			}
-		}
-	}
-}
-
-func i104mParseObj(oper *mongo.UpdateOneModel, buf []byte, objAddr uint32, iecAsdu uint32, cause uint32, connectionNumber int) (ok bool) {
+// decode one information object from a I104M packet
+func i104mParseObj(buf []byte, objAddr uint32, iecAsdu uint32, cot CauseOfTransmission, protCon *ProtocolConnection) (upd PointUpdate, ok bool) {
 	var flags byte
 	var value float64
 	var f32value float32
 	var i16value int16
 	var srcTime time.Time
-	var srcTimeMSec uint16 // seconds * 1000 + milliseconds
 	var srcTimeQualityOk = false
+	var err error
 	var hasTime = false
-	var invalid = false
-	var notTopical = false
-	var blocked = false
-	var substituted = false
-	var overflow = false
-	var transient = false
 	var carry = false
+	var qual = SourceQualifiers{DoubleState: -1}
 
 	ok = false
 
+	// IV NT SB BL bits of the quality descriptor
+	decodeFlags := func(flags byte) {
+		qual.Invalid = (flags & 0x80) == 0x80
+		qual.NotTopical = (flags & 0x40) == 0x40
+		qual.Substituted = (flags & 0x20) == 0x20
+		qual.Blocked = (flags & 0x10) == 0x10
+	}
+
 	switch iecAsdu {
 	case 45, 46, 47:
-		log.Println("Command ack")
-		return false
+		if cot.Negative {
+			log.Println("Command ack negative ", objAddr, " ", cot)
+		} else {
+			log.Println("Command ack ", objAddr, " ", cot)
+		}
+		return upd, false
 
 	case 9, 11, 34, 35:
 		ok = true
 		flags = buf[2]
-		invalid = (flags & 0x80) == 0x80
-		notTopical = (flags & 0x40) == 0x40
-		substituted = (flags & 0x20) == 0x20
-		blocked = (flags & 0x10) == 0x10
+		decodeFlags(flags)
+		qual.Overflow = (flags & 0x01) == 0x01
 		buffer := bytes.NewBuffer(buf[0:])
 		binary.Read(buffer, binary.LittleEndian, &i16value)
 		value = float64(i16value)
-		log.Printf("Analogic %d: %d %f %d\n", iecAsdu, objAddr, value, flags)
+		if iecAsdu == 9 || iecAsdu == 34 { // normalized
+			value = value / i104mproto.NormalizedFullScale
+		}
+		if LogLevel >= LogLevelDetailed {
+			log.Printf("Analogic %d: %d %f %d\n", iecAsdu, objAddr, value, flags)
+		}
 
 	case 5, 32:
 		ok = true
 		flags = buf[1]
-		invalid = (flags & 0x80) == 0x80
-		notTopical = (flags & 0x40) == 0x40
-		substituted = (flags & 0x20) == 0x20
-		blocked = (flags & 0x10) == 0x10
-		transient = (buf[0] & 0x80) == 0x80
-		value = float64(buf[0] & 0x7F)
-		log.Printf("Analogic %d: %d %f %d\n", iecAsdu, objAddr, value, flags)
+		decodeFlags(flags)
+		qual.StepTransient = (buf[0] & 0x80) == 0x80
+		value = float64(int8(buf[0]<<1) >> 1) // VTI: 7 bit two's complement value (-64..63)
+		if LogLevel >= LogLevelDetailed {
+			log.Printf("Analogic %d: %d %f %d\n", iecAsdu, objAddr, value, flags)
+		}
 
 	case 13, 36: // float
 		ok = true
 		flags = buf[4]
-		overflow = (flags & 0x01) == 0x01
-		invalid = (flags & 0x80) == 0x80
-		notTopical = (flags & 0x40) == 0x40
-		substituted = (flags & 0x20) == 0x20
-		blocked = (flags & 0x10) == 0x10
+		decodeFlags(flags)
+		qual.Overflow = (flags & 0x01) == 0x01
 		buffer := bytes.NewBuffer(buf[0:])
 		binary.Read(buffer, binary.LittleEndian, &f32value)
 		value = float64(f32value)
-		log.Printf("Analogic %d: %d %f %d\n", iecAsdu, objAddr, value, flags)
+		if LogLevel >= LogLevelDetailed {
+			log.Printf("Analogic %d: %d %f %d\n", iecAsdu, objAddr, value, flags)
+		}
 
 	case 1, 2, 3, 4, 30, 31: // digital
 		ok = true
-		// convert qualifiers
 		flags = buf[0]
-		invalid = (flags&0x80) == 0x80 || (flags&0x03) == 0 || (flags&0x03) == 0x03
-		invalid = (flags & 0x80) == 0x80
-		notTopical = (flags & 0x40) == 0x40
-		substituted = (flags & 0x20) == 0x20
-		blocked = (flags & 0x10) == 0x10
-		if iecAsdu == 3 || iecAsdu == 4 || iecAsdu == 31 { // double
+		decodeFlags(flags)
+		if isDoublePointAsdu(iecAsdu) {
+			qual.DoubleState = int(flags & 0x03)
 			if flags&0x02 == 0x02 {
 				value = 1
 			} else {
 				value = 0
 			}
-			if flags&0x03 == 0x00 || flags&0x03 == 0x03 {
-				transient = true
-			}
 		} else { // single
-			invalid = (flags & 0x80) == 0x80
 			if flags&0x01 == 0x01 {
 				value = 1
 			} else {
 				value = 0
 			}
 		}
-		log.Printf("Digital %d: %d %f %d\n", iecAsdu, objAddr, value, flags)
+		if LogLevel >= LogLevelDetailed {
+			log.Printf("Digital %d: %d %f %d\n", iecAsdu, objAddr, value, flags)
+		}
 	}
 
-	if iecAsdu == 2 || iecAsdu == 4 || iecAsdu == 30 || iecAsdu == 31 {
+	switch iecAsdu {
+	case 2, 4: // CP24Time2a
 		hasTime = true
-		srcTimeQualityOk = !(buf[3]&0x80 == 80)
-		srcTimeMSec = binary.LittleEndian.Uint16(buf[1:])
-		srcTime = time.Date(2000+int(buf[7]), time.Month(buf[6]), int(buf[5]), int(buf[4]), int(buf[3]&0xEF), int(srcTimeMSec/1000), 0 /*1000*int(srcTimeMSec%1000)*/, time.Local)
-		srcTime = srcTime.Add(time.Duration(srcTimeMSec%1000) * time.Millisecond)
-		// log.Printf(">>>> %v\n", srcTime);
-	}
-
-	if ok {
-		oper.SetFilter(bson.D{
-			{"protocolSourceConnectionNumber", connectionNumber},
-			{"protocolSourceObjectAddress", objAddr},
-		})
-
-		if hasTime {
-			oper.SetUpdate(
-				bson.D{{"$set",
-					bson.D{{"sourceDataUpdate",
-						bson.D{
-							{"valueAtSource", value},
-							{"valueStringAtSource", fmt.Sprintf("%f", value)},
-							{"invalidAtSource", invalid},
-							{"notTopicalAtSource", notTopical},
-							{"substitutedAtSource", substituted},
-							{"blockedAtSource", blocked},
-							{"overflowAtSource", overflow},
-							{"transientAtSource", transient},
-							{"carryAtSource", carry},
-							{"asduAtSource", fmt.Sprintf("%d", iecAsdu)},
-							{"causeOfTransmissionAtSource", cause},
-							{"timeTag", time.Now()},
-							{"timeTagAtSource", srcTime},
-							{"timeTagAtSourceOk", srcTimeQualityOk},
-						}},
-					}}})
-		} else {
-			oper.SetUpdate(
-				bson.D{{"$set",
-					bson.D{{"sourceDataUpdate",
-						bson.D{
-							{"valueAtSource", value},
-							{"valueStringAtSource", fmt.Sprintf("%f", value)},
-							{"invalidAtSource", invalid},
-							{"notTopicalAtSource", notTopical},
-							{"substitutedAtSource", substituted},
-							{"blockedAtSource", blocked},
-							{"overflowAtSource", overflow},
-							{"transientAtSource", transient},
-							{"carryAtSource", carry},
-							{"asduAtSource", fmt.Sprintf("%d", iecAsdu)},
-							{"causeOfTransmissionAtSource", cause},
-							{"timeTag", time.Now()},
-							{"timeTagAtSourceOk", false},
-						}},
-					}}})
-		}
+		srcTime, srcTimeQualityOk, err = parseCP24Time2a(buf[1:], time.Now(), protCon.sourceLocation)
+	case 30, 31: // CP56Time2a after the quality
+		hasTime = true
+		srcTime, srcTimeQualityOk, err = parseCP56Time2a(buf[1:], protCon.sourceLocation)
+	case 32: // CP56Time2a after VTI and quality
+		hasTime = true
+		srcTime, srcTimeQualityOk, err = parseCP56Time2a(buf[2:], protCon.sourceLocation)
+	case 34, 35: // CP56Time2a after int16 and quality
+		hasTime = true
+		srcTime, srcTimeQualityOk, err = parseCP56Time2a(buf[3:], protCon.sourceLocation)
+	case 36: // CP56Time2a after float and quality
+		hasTime = true
+		srcTime, srcTimeQualityOk, err = parseCP56Time2a(buf[5:], protCon.sourceLocation)
 	}
-	return ok // , oksoe, aggrSoePipeline
-}
-
-var countKeepAliveUpdates = 0
-var countKeepAliveUpdatesLimit = 4
-var lastActiveNodeKeepAliveTimeTag time.Time
-
-func processRedundancy(collectionInstances *mongo.Collection, id primitive.ObjectID, cfg ConfigData) {
-
-	var instance ProtocolDriverInstance
-	filter := bson.D{{"_id", id}}
-	err := collectionInstances.FindOne(context.TODO(), filter).Decode(&instance)
 	if err != nil {
-		log.Println("Error querying protocolDriverInstances!")
-		log.Println(err)
-	}
-	if instance.ProtocolDriver == "" {
-		log.Println("No driver instance found!")
-	}
-
-	if !contains(instance.NodeNames, cfg.NodeName) {
-		log.Fatal("This node name not in the list of nodes from driver instance!")
-	}
+		log.Printf("Invalid time tag %d: %d %s\n", iecAsdu, objAddr, err)
+		hasTime = false
+	}
+	if hasTime && cot.IsIntegrity() && !protCon.SoeFromInterrogation {
+		// do not generate SOE from interrogation responses
+		hasTime = false
+	}
+
+	invalid, transient, questionable := protCon.QualityProfile.Map(qual)
+	upd = PointUpdate{
+		ObjAddr:      objAddr,
+		Asdu:         iecAsdu,
+		Cot:          cot,
+		Value:        value,
+		RawValue:     value,
+		Invalid:      invalid,
+		NotTopical:   qual.NotTopical,
+		Substituted:  qual.Substituted,
+		Blocked:      qual.Blocked,
+		Overflow:     qual.Overflow,
+		Transient:    transient,
+		Questionable: questionable,
+		Carry:        carry,
+		HasTime:      hasTime,
+		TimeTag:      srcTime,
+		TimeTagOk:    srcTimeQualityOk,
+	}
+	return upd, ok
+}
 
-	if instance.ActiveNodeName == cfg.NodeName {
-		if IsActive == false {
-			log.Println("Redundancy - ACTIVATING this Node!")
-		}
-		IsActive = true
+// build the realtimeData update for a decoded object
+func (upd PointUpdate) updateModel(def *PointDef, protCon *ProtocolConnection) *mongo.UpdateOneModel {
+	oper := mongo.NewUpdateOneModel()
+	epoch := ActiveNodeEpoch()
+	oper.SetFilter(bson.D{
+		{"protocolSourceConnectionNumber", protCon.ProtocolConnectionNumber},
+		{"protocolSourceObjectAddress", upd.ObjAddr},
+		// fencing: do not overwrite data written by a node that acquired the lease later
+		{"sourceDataUpdate.activeNodeEpoch", bson.D{{"$not", bson.D{{"$gt", epoch}}}}},
+	})
+
+	sourceDataUpdate := bson.D{
+		{"valueAtSource", upd.Value},
+		{"rawValueAtSource", upd.RawValue},
+		{"valueStringAtSource", formatValueString(upd, def, protCon)},
+		{"invalidAtSource", upd.Invalid},
+		{"notTopicalAtSource", upd.NotTopical},
+		{"substitutedAtSource", upd.Substituted},
+		{"blockedAtSource", upd.Blocked},
+		{"overflowAtSource", upd.Overflow},
+		{"transientAtSource", upd.Transient},
+		{"questionableAtSource", upd.Questionable},
+		{"carryAtSource", upd.Carry},
+		{"asduAtSource", fmt.Sprintf("%d", upd.Asdu)},
+		{"causeOfTransmissionAtSource", fmt.Sprintf("%d", upd.Cot.Cause)},
+		{"originatorAddressAtSource", upd.Cot.Originator},
+		{"activeNodeEpoch", epoch},
+		{"timeTag", time.Now()},
+	}
+	if def != nil && strings.TrimSpace(def.Unit) != "" {
+		sourceDataUpdate = append(sourceDataUpdate, bson.E{"unitAtSource", strings.TrimSpace(def.Unit)})
+	}
+	if upd.HasTime {
+		sourceDataUpdate = append(sourceDataUpdate,
+			bson.E{"timeTagAtSource", upd.TimeTag},
+			bson.E{"timeTagAtSourceOk", upd.TimeTagOk})
 	} else {
-		if IsActive { // was active, other node assumed, so be inactive and wait a random time
-			log.Println("Redundancy - DEACTIVATING this Node (other node active)!")
-			countKeepAliveUpdates = 0
-			IsActive = false
-			time.Sleep(time.Duration(1000) * time.Millisecond)
-		}
-		IsActive = false
-		if lastActiveNodeKeepAliveTimeTag == instance.ActiveNodeKeepAliveTimeTag {
-			countKeepAliveUpdates++
-		}
-		lastActiveNodeKeepAliveTimeTag = instance.ActiveNodeKeepAliveTimeTag
-		if countKeepAliveUpdates > countKeepAliveUpdatesLimit { // time exceeded, be active
-			log.Println("Redundancy - ACTIVATING this Node!")
-			IsActive = true
-		}
-
-	}
-
-	if IsActive {
-		log.Println("Redundancy - This node is active.")
-
-		// update keep alive time and node name
-		result, err := collectionInstances.UpdateOne(
-			context.TODO(),
-			bson.M{"_id": bson.M{"$eq": id}},
-			bson.M{"$set": bson.M{"activeNodeName": cfg.NodeName, "activeNodeKeepAliveTimeTag": primitive.NewDateTimeFromTime(time.Now())}},
-		)
-		if err != nil {
-			log.Println(err)
-		} else {
-			log.Println(result)
-		}
+		sourceDataUpdate = append(sourceDataUpdate,
+			bson.E{"timeTagAtSourceOk", false})
 	}
+	oper.SetUpdate(bson.D{{"$set", bson.D{{"sourceDataUpdate", sourceDataUpdate}}}})
+	return oper
 }
 
-// find if array contains a string
-func contains(a []string, str string) bool {
-	tStr := strings.TrimSpace(str)
-	for _, n := range a {
-		if tStr == strings.TrimSpace(n) {
-			return true
-		}
-	}
-	return false
-}
+// receive I104M packets from the transport, put packets on channel. The channel is closed when the context is canceled.
+func listenI104MPackets(ctx context.Context, protCon *ProtocolConnection, capture *CaptureWriter, keepRunningWhileInactive bool, chanBuf chan ReceivedPacket) error {
+	defer close(chanBuf)
+	_, isStream := protCon.transport.(*streamTransport)
 
-// find if array contains a IP address ( compare just left part of ":" as in 127.0.0.1:8099 )
-func containsIp(a []string, str string) bool {
-	tStr := strings.Split(strings.TrimSpace(str), ":")[0]
-	for _, n := range a {
-		str = strings.Split(n, ":")[0]
-		if tStr == strings.TrimSpace(str) {
-			return true
+	return protCon.transport.Receive(ctx, func(frame []byte, from string) {
+		now := time.Now()
+		protCon.stats.PacketReceived(from, now)
+		if len(frame) <= 4 {
+			protCon.stats.PacketRejected(RejectTooShort)
+			return
 		}
-	}
-	return false
-}
-
-// listen for I104M UDP packets, put packets on channel
-func listenI104MUdpPackets(con *net.UDPConn, ipAddresses []string, chanBuf chan []byte) {
-	buf := make([]byte, 2048)
-
-	for {
-		n, addr, err := con.ReadFromUDP(buf)
+		if LogLevel >= LogLevelDebug {
+			log.Printf("Received packet with %d bytes from %s", len(frame), from)
+		}
+		payload, err := protCon.auth.Open(frame, now)
 		if err != nil {
-			log.Printf("%s \n", err)
+			log.Println("Datagram discarded from ", from, ": ", err)
+			protCon.stats.PacketRejected(RejectAuthentication)
+			return
 		}
-		err = nil
-
-		ip_port := strings.Split(addr.String(), ":")
-		if !containsIp(ipAddresses, ip_port[0]) {
-			continue
+		capture.Write(from, payload, now)
+		if !isActive() && !keepRunningWhileInactive { // do not process packets while inactive (unless hot standby)
+			return
 		}
-
-		if n > 4 {
-			log.Printf("Received packet with %d bytes from %s", n, ip_port)
-			if !IsActive { // do not process packets while inactive
-				continue
-			}
+		packet := ReceivedPacket{Data: make([]byte, len(payload)), From: from} // frame buffer is reused for the next packet
+		copy(packet.Data, payload)
+		if isStream { // streams are flow controlled, wait for room in the channel instead of discarding
 			select {
-			case chanBuf <- buf: // Put buffer in the channel unless it is full
-			default:
-				log.Println("Channel full. Discarding packet!")
+			case chanBuf <- packet:
+			case <-ctx.Done():
 			}
-
+			return
 		}
-	}
+		select {
+		case chanBuf <- packet: // Put packet in the channel unless it is full
+		default:
+			log.Println("Channel full. Discarding packet!")
+			protCon.stats.ChannelDrop()
+		}
+	})
 }
 
 func main() {
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+	log.Println(Version)
+
+	// run returns only after cleanup (deferred), exit code 1 signals the failure to the service manager
+	if err := run(); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	log.Println("Driver stopped.")
+}
+
+func run() error {
 
 	var client *mongo.Client
 	var err error
 	var collection, collectionInstances, collectionConnections, collectionCommands *mongo.Collection
-	var csCommands *mongo.ChangeStream
 
-	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
-	log.Println(Version)
-	log.Println("Usage i104m [instance number] [log level]")
-
-	cfg := ConfigData{}
-	file, err := ioutil.ReadFile(filepath.Join("..", "conf", "json-scada.json"))
+	opts, err := parseOptions(os.Args[1:], os.Getenv)
 	if err != nil {
-		log.Printf("Failed to read file: %v", err)
-		os.Exit(1)
+		return err
 	}
+	LogLevel = opts.LogLevel
+	instanceNumber := opts.InstanceNumber
 
-	_ = json.Unmarshal([]byte(file), &cfg)
-	cfg.MongoConnectionString = strings.TrimSpace(cfg.MongoConnectionString)
-	cfg.MongoDatabaseName = strings.TrimSpace(cfg.MongoDatabaseName)
-	cfg.NodeName = strings.TrimSpace(cfg.NodeName)
-
-	if cfg.MongoConnectionString == "" || cfg.MongoDatabaseName == "" || cfg.NodeName == "" {
-		log.Printf("Empty string in config file.")
-		os.Exit(1)
+	if opts.ReplayFile != "" {
+		auth, err := newReplayAuthenticator(opts.ReplayKeyId, opts.ReplayKey)
+		if err != nil {
+			return err
+		}
+		return replayCapture(NewLifecycle().Context(), opts.ReplayFile, opts.ReplayTo, opts.ReplaySpeed, auth)
 	}
 
-	instanceNumber := 1
-	if len(os.Args) > 1 {
-		instanceNumber, _ = strconv.Atoi(os.Args[1])
+	if opts.ServerMode {
+		DriverName = ServerDriverName
+		log.Println("Server mode.")
 	}
 
-	/*
-		logLevel := 1
-		if len(os.Args) > 2 {
-			logLevel, _ = strconv.Atoi(os.Args[2])
-		}
-	*/
+	log.Println("Reading config file ", opts.ConfigFile)
+	cfg, err := jsonscada.ReadConfig(opts.ConfigFile)
+	if err != nil {
+		return err
+	}
 
 	log.Print("Try to connect MongoDB server...")
 	client, err, collection, collectionInstances, collectionConnections, collectionCommands = mongoConnect(cfg)
-	checkFatalError(err)
-	defer client.Disconnect(context.TODO())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		client.Disconnect(ctx)
+		log.Print("MongoDB disconnected.")
+	}()
+
+	// on any return the go routines are stopped and waited before disconnecting
+	lc := NewLifecycle()
+	defer lc.Shutdown()
+
+	if opts.MetricsAddress != "" {
+		lc.Go("Metrics", func(ctx context.Context) error {
+			return serveMetrics(ctx, opts.MetricsAddress)
+		})
+	}
 
 	// Check the connection
-	err = client.Ping(context.TODO(), nil)
-	checkFatalError(err)
+	err = client.Ping(lc.Context(), nil)
+	if err != nil {
+		return err
+	}
 	log.Print("MongoDB connected.")
 
-	csCommands, err = collectionCommands.Watch(context.TODO(), mongo.Pipeline{bson.D{
-		{
-			"$match", bson.D{
-				{"operationType", "insert"},
-			},
-		},
-	}})
-	checkFatalError(err)
-	defer csCommands.Close(context.TODO())
-
 	// read instances config
 	var instance ProtocolDriverInstance
 	filter := bson.D{{"protocolDriver", DriverName}, {"protocolDriverInstanceNumber", instanceNumber}, {"enabled", true}}
-	err = collectionInstances.FindOne(context.TODO(), filter).Decode(&instance)
+	err = collectionInstances.FindOne(lc.Context(), filter).Decode(&instance)
 	if err != nil || instance.ProtocolDriver == "" {
-		log.Fatal("No driver instance found on configuration! Driver Name: ", DriverName, " Instance number: ", instanceNumber)
+		return fmt.Errorf("No driver instance found on configuration! Driver Name: %s Instance number: %d", DriverName, instanceNumber)
 	}
 
 	// read connections config
 	// This driver admits only 1 connection per instance!
-	var protocolConn ProtocolConnection
+	protocolConn := ProtocolConnection{GiInterval: 300, RefreshInterval: 60, DecimalPlaces: 3, StateTextTransit: "TRANSIT", AuthMaxClockSkew: 30}
 	filter = bson.D{{"protocolDriver", DriverName}, {"protocolDriverInstanceNumber", instanceNumber}, {"enabled", true}}
-	err = collectionConnections.FindOne(context.TODO(), filter).Decode(&protocolConn)
-	checkFatalError(err)
-	fmt.Println(protocolConn)
+	err = collectionConnections.FindOne(lc.Context(), filter).Decode(&protocolConn)
+	if err != nil {
+		return err
+	}
+	logConn := protocolConn
+	logConn.AuthKeys = nil // do not log secrets
+	if LogLevel >= LogLevelBasic {
+		log.Println(logConn)
+	}
 	if protocolConn.ProtocolDriver == "" {
-		log.Fatal("No connection found!")
+		return errors.New("No connection found!")
 	}
 
 	if strings.TrimSpace(protocolConn.IpAddressLocalBind) == "" {
 		protocolConn.IpAddressLocalBind = "0.0.0.0:8099"
 	}
+	protocolConn.sourceLocation, err = sourceTimeLocation(protocolConn.SourceTimeZone)
+	if err != nil {
+		return fmt.Errorf("Invalid sourceTimeZone on connection! %v", err)
+	}
+	if err = protocolConn.QualityProfile.validate(); err != nil {
+		return fmt.Errorf("Invalid quality profile on connection! %v", err)
+	}
+	protocolConn.auth, err = NewAuthenticator(&protocolConn)
+	if err != nil {
+		return fmt.Errorf("Invalid authentication config on connection! %v", err)
+	}
 	if len(protocolConn.IpAddresses) == 0 {
-		protocolConn.IpAddresses[0] = "127.0.0.1"
+		protocolConn.IpAddresses = []string{"127.0.0.1"}
 	}
 
 	log.Printf("Instance:%d Connection:%d", protocolConn.ProtocolDriverInstanceNumber, protocolConn.ProtocolConnectionNumber)
+	protocolConn.stats = NewTrafficStats(time.Now())
 
-	// Lets prepare an server address at any address at port 10001
-	ServerAddr, err := net.ResolveUDPAddr("udp", protocolConn.IpAddressLocalBind)
-	checkFatalError(err)
+	pointDefs, commandDefs, err := loadPointDefs(collection, protocolConn.ProtocolConnectionNumber)
+	if err != nil {
+		return err
+	}
+	log.Printf("Point definitions: %d, commands: %d", len(pointDefs), commandDefs.Len())
+	tmPointDefs := time.Now()
+	ingest := NewIngest(&protocolConn, &mongoPointWriter{collection: collection, protCon: &protocolConn}, pointDefs)
+	ingest.hotStandby = instance.KeepProtocolRunningWhileInactive
+
+	protocolConn.transport, err = newTransport(&protocolConn)
+	if err != nil {
+		return err
+	}
+	defer protocolConn.transport.Close()
 
-	// Now listen at selected port
-	ServerConn, err := net.ListenUDP("udp", ServerAddr)
-	checkFatalError(err)
-	defer ServerConn.Close()
+	capture, err := NewCaptureWriter(opts.CaptureFile)
+	if err != nil {
+		return err
+	}
+	defer capture.Close()
 
-	buf := make([]byte, 2048)
-	prevbuf := make([]byte, 2048)
+	var buf []byte
 
 	tm := time.Now().Add(-6 * time.Second)
 
-	var waitGroup sync.WaitGroup
-	if protocolConn.CommandsEnabled == true {
-		waitGroup.Add(1)
-		routineCtx, _ := context.WithCancel(context.Background())
-		go iterateChangeStream(routineCtx, &waitGroup, csCommands, &protocolConn, ServerConn, collectionCommands)
+	var commandTracker *CommandTracker
+	if protocolConn.CommandsEnabled == true && !opts.ServerMode {
+		csCommands, err := collectionCommands.Watch(lc.Context(), mongo.Pipeline{bson.D{
+			{
+				"$match", bson.D{
+					{"operationType", "insert"},
+				},
+			},
+		}})
+		if err != nil {
+			return err
+		}
+		commandTracker = NewCommandTracker(newMongoCommandStore(collectionCommands))
+		commandTracker.stats = protocolConn.stats
+		commandTracker.timeout = commandTimeout(&protocolConn)
+		commandTracker.SetCommandDefs(commandDefs)
+		ingest.commands = commandTracker
+		lc.Go("Commands", func(ctx context.Context) error {
+			return iterateChangeStream(ctx, csCommands, &protocolConn, commandTracker)
+		})
+		lc.Go("Commands reconciler", func(ctx context.Context) error {
+			return reconcileCommands(ctx, &protocolConn, commandTracker)
+		})
+	}
+
+	// traffic statistics of the connection on this node
+	lc.Go("Statistics", func(ctx context.Context) error {
+		return writeTrafficStats(ctx, collection.Database().Collection(ConnectionStatsCollectionName), &protocolConn, cfg.NodeName)
+	})
+
+	// redundancy control (lease on the driver instance). On any return the go routines (commands in progress,
+	// lease renewals) are stopped and waited before the lease is released, so it is not renewed after the release.
+	redundancy := NewRedundancy(newMongoRedundancyStore(collectionInstances, instance.Id), instance, cfg.NodeName)
+	defer func() {
+		lc.Shutdown()
+		redundancy.Release()
+	}()
+	lc.Go("Redundancy", redundancy.Run)
+
+	var server *Server
+	if opts.ServerMode {
+		// send points to the peers, commands received are inserted in commandsQueue
+		server, err = NewServer(lc.Context(), &protocolConn, collection, collectionCommands)
+		if err != nil {
+			return err
+		}
+		lc.Go("Server changes", server.WatchChanges)
+		lc.Go("Server", server.Run)
+	} else {
+		// send interrogation and clock sync requests to the peer while active
+		lc.Go("Interrogation", func(ctx context.Context) error {
+			return processInterrogation(ctx, &protocolConn)
+		})
 	}
 
 	// listen for UDP packets on a go routine, return packets via a channel (packets as []byte )
-	chanBuf := make(chan []byte, UDPChannelSize)
-	go listenI104MUdpPackets(ServerConn, protocolConn.IpAddresses, chanBuf)
+	// on shutdown the channel is closed, packets already received are processed before exit
+	chanBuf := make(chan ReceivedPacket, UDPChannelSize)
+	lc.Go("UDP listener", func(ctx context.Context) error {
+		return listenI104MPackets(ctx, &protocolConn, capture, instance.KeepProtocolRunningWhileInactive, chanBuf)
+	})
+
+	if server != nil {
+		for packet := range chanBuf {
+			server.HandleFrame(packet)
+		}
+		log.Println("Shutting down...")
+		return lc.Err()
+	}
 
 	for {
-		if time.Since(tm) > 5*time.Second {
-			log.Printf("Ping Mongo \n")
+		if time.Since(tm) > 5*time.Second && lc.Context().Err() == nil {
+			if LogLevel >= LogLevelDebug {
+				log.Printf("Ping Mongo \n")
+			}
 			tm = time.Now()
 
-			for {
+			backoff := time.Second
+			for lc.Context().Err() == nil {
 				// Check the connection
-				err = client.Ping(context.TODO(), nil)
-				if err != nil {
-					log.Printf("%s \n", err)
-					log.Print("Disconnected MongoDB server...")
-				}
+				err = client.Ping(lc.Context(), nil)
 				if err == nil {
 					break
 				}
-			}
-
-			processRedundancy(collectionInstances, instance.Id, cfg)
-		}
-
-		select {
-		case buf = <-chanBuf: // receive UDP packets via channel
-			break
-		case <-time.After(5 * time.Second):
-			continue
-		}
-
-		n := len(buf)
-		if n > 4 {
-			signature := binary.LittleEndian.Uint32(buf[0:])
-			if signature == 0x64646464 {
-				numpoints := binary.LittleEndian.Uint32(buf[4:])
-				iecASDU := binary.LittleEndian.Uint32(buf[8:])
-				primaryAddr := binary.LittleEndian.Uint32(buf[12:])
-				secondaryAddr := binary.LittleEndian.Uint32(buf[16:])
-				cause := binary.LittleEndian.Uint32(buf[20:])
-				infoSize := binary.LittleEndian.Uint32(buf[24:])
-				incinfo := uint32(0)
-				ok := true
-				//_, _, _, _, _ = primaryAddr, secondaryAddr, cause, infoSize, addr
-
-				log.Println("Received Seqncy ",
-					// n, " ",
-					// signature, " ",
-					numpoints, " ",
-					iecASDU, " ",
-					primaryAddr, " ",
-					secondaryAddr, " ",
-					cause, " ",
-					infoSize)
-
-				switch {
-				case iecASDU == 1 || // simples sem tag
-					iecASDU == 3: // duplo sem tag
-					incinfo = 4 + 1
-				case iecASDU == 2 || // simples com tag
-					iecASDU == 4: // duplo com tag
-					incinfo = 4 + 1 + 3
-				case iecASDU == 30 || // simples com tag longa
-					iecASDU == 31: // duplo com tag longa
-					incinfo = 4 + 1 + 7
-				case iecASDU == 5: // reg pos
-					incinfo = 4 + 2
-				case iecASDU == 32: // reg pos c/ tag
-					incinfo = 4 + 2 + 7
-				case iecASDU == 9 || // normalized
-					iecASDU == 11: // scaled
-					incinfo = 4 + 3
-				case iecASDU == 34 || // normalized c/ tag
-					iecASDU == 35: // scaled c/ tag
-					incinfo = 4 + 3 + 7
-				case iecASDU == 13: // ponto flutuante
-					incinfo = 4 + 5
-				case iecASDU == 36: // ponto flutuante c/ tag
-					incinfo = 4 + 5 + 7
-				case iecASDU == 15:
-					incinfo = 4 + 5
-				default:
-					ok = false
-					return
+				log.Printf("%s \n", err)
+				log.Print("Disconnected MongoDB server...")
+				select {
+				case <-lc.Context().Done():
+				case <-time.After(backoff):
 				}
-
-				if ok {
-					t1 := time.Now()
-					var opers []mongo.WriteModel
-					// var opersSOE []mongo.WriteModel
-					for i := uint32(0); i < numpoints; i++ {
-						oper := mongo.NewUpdateOneModel()
-						objAddr := binary.LittleEndian.Uint32(buf[28+i*incinfo:])
-						okrt := i104mParseObj(oper, buf[32+i*incinfo:], objAddr, iecASDU, cause, protocolConn.ProtocolConnectionNumber)
-						if okrt {
-							opers = append(opers, oper)
-						}
-					}
-					if len(opers) > 0 {
-						res, err := collection.BulkWrite(
-							context.Background(),
-							opers,
-							options.BulkWrite().SetOrdered(false),
-						)
-						if res == nil {
-							log.Print("bulk")
-							log.Fatal(err)
-						}
-						t2 := time.Now()
-						if numpoints > 10 {
-							log.Printf("%f upserts/s\n", float64(numpoints)/t2.Sub(t1).Seconds())
-						} else {
-							log.Printf("%d ms\n", t2.Sub(t1).Milliseconds())
-						}
-						//log.Println(res.MatchedCount)
-						//log.Println(res.ModifiedCount)
-					}
-				}
-			} else if signature == 0x53535353 {
-
-				// avoid duplicated message
-				if bytes.Compare(buf, prevbuf) == 0 {
-					log.Printf("Duplicated message.\n")
-					continue
+				if backoff *= 2; backoff > MongoPingMaxBackoff {
+					backoff = MongoPingMaxBackoff
 				}
+			}
 
-				objAddr := binary.LittleEndian.Uint32(buf[4:])
-				iecASDU := binary.LittleEndian.Uint32(buf[8:])
-				primaryAddr := binary.LittleEndian.Uint32(buf[12:])
-				secondaryAddr := binary.LittleEndian.Uint32(buf[16:])
-				cause := binary.LittleEndian.Uint32(buf[20:])
-				infoSize := binary.LittleEndian.Uint32(buf[24:])
-
-				_, _, _, _ = primaryAddr, secondaryAddr, cause, infoSize
-
-				log.Println("Received Single ",
-					// n, " ",
-					// signature, " ",
-					objAddr, " ",
-					iecASDU, " ",
-					primaryAddr, " ",
-					secondaryAddr, " ",
-					cause, " ",
-					infoSize)
-
-				var opers []mongo.WriteModel
-				oper := mongo.NewUpdateOneModel()
-				okrt := i104mParseObj(oper, buf[28:], objAddr, iecASDU, cause, protocolConn.ProtocolConnectionNumber)
-				if okrt {
-					opers = append(opers, oper)
-					res, err := collection.BulkWrite(
-						context.Background(),
-						opers,
-					)
-					if res == nil {
-						log.Print("bulk")
-						log.Fatal(err)
+			if time.Since(tmPointDefs) > PointDefsReloadInterval {
+				tmPointDefs = time.Now()
+				defs, commandDefs, err := loadPointDefs(collection, protocolConn.ProtocolConnectionNumber)
+				if err != nil {
+					log.Println("Error reading point definitions: ", err)
+				} else {
+					ingest.SetPointDefs(defs)
+					if commandTracker != nil {
+						commandTracker.SetCommandDefs(commandDefs)
 					}
-					log.Println(res)
 				}
-				copy(prevbuf, buf)
 			}
+		}
+
+		ingest.CheckActivation() // also checked on each packet, here to flush a hot standby snapshot without waiting for data
 
-			if err != nil {
-				log.Println("Error: ", err)
+		select {
+		case packet, more := <-chanBuf: // receive UDP packets via channel
+			if !more { // listener stopped and all packets processed
+				log.Println("Shutting down...")
+				return lc.Err()
 			}
+			buf = packet.Data
+		case <-time.After(1 * time.Second):
+			continue
+		}
+
+		if err := ingest.Process(context.Background(), buf); err != nil {
+			log.Println("Error writing to MongoDB: ", err)
+			lc.Fail(err)
 		}
 	}
 }
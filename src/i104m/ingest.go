@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"log"
+	"time"
+
+	"i104mproto"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Destination of the decoded point updates (realtimeData)
+type PointWriter interface {
+	WritePoints(ctx context.Context, upds []PointUpdate, defs PointDefs) error
+}
+
+// writes point updates to the realtimeData collection
+type mongoPointWriter struct {
+	collection *mongo.Collection
+	protCon    *ProtocolConnection
+}
+
+func (w *mongoPointWriter) WritePoints(ctx context.Context, upds []PointUpdate, defs PointDefs) error {
+	opers := make([]mongo.WriteModel, 0, len(upds))
+	for _, upd := range upds {
+		opers = append(opers, upd.updateModel(defs[upd.ObjAddr], w.protCon))
+	}
+	res, err := w.collection.BulkWrite(ctx, opers, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return err
+	}
+	if LogLevel >= LogLevelDebug {
+		log.Println(res)
+	}
+	return nil
+}
+
+// Decoding of I104M data packets of a connection into point updates, written while active
+type Ingest struct {
+	protCon      *ProtocolConnection
+	writer       PointWriter
+	pointDefs    PointDefs
+	changeFilter *ChangeFilter
+	valueCache   *ValueCache     // last values, also while inactive (hot standby)
+	commands     *CommandTracker // receives command confirmations (nil when commands are disabled)
+	hotStandby   bool            // keepProtocolRunningWhileInactive
+	epoch        int64           // lease epoch of the last activation seen (0 = inactive)
+	prevbuf      []byte
+}
+
+func NewIngest(protCon *ProtocolConnection, writer PointWriter, pointDefs PointDefs) *Ingest {
+	return &Ingest{
+		protCon:      protCon,
+		writer:       writer,
+		pointDefs:    pointDefs,
+		changeFilter: NewChangeFilter(),
+		valueCache:   NewValueCache(),
+	}
+}
+
+// replace point definitions (reloaded)
+func (in *Ingest) SetPointDefs(defs PointDefs) {
+	in.pointDefs = defs
+}
+
+// decode a packet and write the updates, only write errors are returned (invalid packets are logged and discarded)
+func (in *Ingest) Process(ctx context.Context, buf []byte) error {
+	in.CheckActivation()
+	n := len(buf)
+	protCon := in.protCon
+	if n < 28 {
+		protCon.stats.PacketRejected(RejectTooShort)
+		return nil
+	}
+	signature := binary.LittleEndian.Uint32(buf[0:])
+	if signature == i104mproto.SequenceSignature {
+		numpoints := binary.LittleEndian.Uint32(buf[4:])
+		iecASDU := binary.LittleEndian.Uint32(buf[8:])
+		primaryAddr := binary.LittleEndian.Uint32(buf[12:])
+		secondaryAddr := binary.LittleEndian.Uint32(buf[16:])
+		cause := binary.LittleEndian.Uint32(buf[20:])
+		infoSize := binary.LittleEndian.Uint32(buf[24:])
+		cot := decodeCOT(cause)
+
+		if LogLevel >= LogLevelDetailed {
+			log.Println("Received Seqncy ",
+				numpoints, " ",
+				iecASDU, " ",
+				primaryAddr, " ",
+				secondaryAddr, " ",
+				cot, " ",
+				infoSize)
+		}
+
+		if !acceptCOT(cot, iecASDU, protCon) {
+			protCon.stats.PacketRejected(RejectCause)
+			return nil
+		}
+
+		incinfo, ok := i104mproto.ObjectSize(iecASDU)
+		if !ok {
+			log.Println("Unsupported ASDU ", iecASDU)
+			protCon.stats.PacketRejected(RejectUnsupportedAsdu)
+			return nil
+		}
+		if uint64(numpoints)*uint64(incinfo) > uint64(n-28) {
+			log.Println("Truncated packet, discarded!")
+			protCon.stats.PacketRejected(RejectTruncated)
+			return nil
+		}
+
+		t1 := time.Now()
+		var upds []PointUpdate
+		for i := uint32(0); i < numpoints; i++ {
+			objAddr := binary.LittleEndian.Uint32(buf[28+i*incinfo:])
+			if upd, ok := in.decode(buf[32+i*incinfo:], objAddr, iecASDU, cot, t1); ok {
+				upds = append(upds, upd)
+			}
+		}
+		if len(upds) > 0 {
+			if err := in.write(ctx, upds); err != nil {
+				return err
+			}
+			t2 := time.Now()
+			if LogLevel >= LogLevelDetailed {
+				if numpoints > 10 {
+					log.Printf("%f upserts/s\n", float64(numpoints)/t2.Sub(t1).Seconds())
+				} else {
+					log.Printf("%d ms\n", t2.Sub(t1).Milliseconds())
+				}
+			}
+		}
+	} else if signature == i104mproto.SingleSignature {
+
+		// avoid duplicated message
+		if bytes.Equal(buf, in.prevbuf) {
+			if LogLevel >= LogLevelDetailed {
+				log.Printf("Duplicated message.\n")
+			}
+			protCon.stats.PacketRejected(RejectDuplicate)
+			return nil
+		}
+		in.prevbuf = buf
+
+		objAddr := binary.LittleEndian.Uint32(buf[4:])
+		iecASDU := binary.LittleEndian.Uint32(buf[8:])
+		primaryAddr := binary.LittleEndian.Uint32(buf[12:])
+		secondaryAddr := binary.LittleEndian.Uint32(buf[16:])
+		cause := binary.LittleEndian.Uint32(buf[20:])
+		infoSize := binary.LittleEndian.Uint32(buf[24:])
+		cot := decodeCOT(cause)
+
+		if LogLevel >= LogLevelDetailed {
+			log.Println("Received Single ",
+				objAddr, " ",
+				iecASDU, " ",
+				primaryAddr, " ",
+				secondaryAddr, " ",
+				cot, " ",
+				infoSize)
+		}
+
+		if !acceptCOT(cot, iecASDU, protCon) {
+			protCon.stats.PacketRejected(RejectCause)
+			return nil
+		}
+		if incinfo, ok := i104mproto.ObjectSize(iecASDU); ok && uint32(n-24) < incinfo {
+			log.Println("Truncated packet, discarded!")
+			protCon.stats.PacketRejected(RejectTruncated)
+			return nil
+		}
+
+		if upd, ok := in.decode(buf[28:], objAddr, iecASDU, cot, time.Now()); ok {
+			return in.write(ctx, []PointUpdate{upd})
+		}
+	} else {
+		protCon.stats.PacketRejected(RejectSignature)
+	}
+	return nil
+}
+
+func (in *Ingest) write(ctx context.Context, upds []PointUpdate) error {
+	if err := in.writer.WritePoints(ctx, upds, in.pointDefs); err != nil {
+		return err
+	}
+	in.protCon.stats.PointsUpdated(len(upds))
+	return nil
+}
+
+// decode an object and apply the point settings, true if the update must be written
+func (in *Ingest) decode(buf []byte, objAddr uint32, iecASDU uint32, cot CauseOfTransmission, now time.Time) (PointUpdate, bool) {
+	if isCommandAsdu(iecASDU) && in.commands != nil && isActive() {
+		in.commands.Confirm(objAddr, iecASDU, cot, buf, now)
+	}
+	upd, ok := i104mParseObj(buf, objAddr, iecASDU, cot, in.protCon)
+	if !ok {
+		return upd, false
+	}
+	def := in.pointDefs[objAddr]
+	if def == nil {
+		in.protCon.stats.Unmapped(objAddr)
+	}
+	upd, ok = upd.applyPointDef(def)
+	if !ok {
+		return upd, false
+	}
+	in.valueCache.Store(upd)
+	return upd, isActive() && in.changeFilter.Accept(upd, def, in.protCon, now)
+}
+
+// on each activation of this node (new lease epoch), forget the values last written as the other node may have
+// overwritten them meanwhile. A hot standby node also writes the values received while inactive.
+func (in *Ingest) CheckActivation() {
+	epoch := ActiveNodeEpoch()
+	if epoch == in.epoch {
+		return
+	}
+	in.epoch = epoch
+	if epoch == 0 {
+		return
+	}
+	in.changeFilter.Reset()
+	if in.hotStandby {
+		in.FlushSnapshot()
+	}
+}
+
+// write the values received while inactive, used when a hot standby node becomes active
+func (in *Ingest) FlushSnapshot() {
+	flushSnapshot(in.writer, in.valueCache, in.changeFilter, in.pointDefs, in.protCon)
+}
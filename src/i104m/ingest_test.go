@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"i104mproto"
+)
+
+// ingest of a connection writing to a fake writer, with this node active
+func newTestIngest(t *testing.T, defs PointDefs) (*Ingest, *fakePointWriter) {
+	t.Helper()
+	wasActive, wasEpoch := isActive(), ActiveNodeEpoch()
+	setActiveNode(true, 1)
+	t.Cleanup(func() { setActiveNode(wasActive, wasEpoch) })
+
+	protCon := &ProtocolConnection{ProtocolConnectionNumber: 1, sourceLocation: time.UTC}
+	if err := protCon.QualityProfile.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if defs == nil {
+		defs = PointDefs{}
+	}
+	writer := &fakePointWriter{}
+	return NewIngest(protCon, writer, defs), writer
+}
+
+func encodeObject(t *testing.T, upd PointUpdate) []byte {
+	t.Helper()
+	info, ok := upd.encode(time.UTC)
+	if !ok {
+		t.Fatalf("ASDU %d not encoded", upd.Asdu)
+	}
+	return info
+}
+
+func sequencePacket(t *testing.T, asdu uint32, cause uint32, upds ...PointUpdate) []byte {
+	t.Helper()
+	var objects bytes.Buffer
+	for _, upd := range upds {
+		upd.Asdu = asdu
+		objects.Write([]byte{byte(upd.ObjAddr), byte(upd.ObjAddr >> 8), byte(upd.ObjAddr >> 16), byte(upd.ObjAddr >> 24)})
+		objects.Write(encodeObject(t, upd))
+	}
+	return i104mproto.SequencePacket(uint32(len(upds)), asdu, 1, cause, objects.Bytes())
+}
+
+func singlePacket(t *testing.T, cause uint32, upd PointUpdate) []byte {
+	t.Helper()
+	return i104mproto.SinglePacket(upd.ObjAddr, upd.Asdu, 1, cause, encodeObject(t, upd))
+}
+
+func TestIngestSequence(t *testing.T) {
+	in, writer := newTestIngest(t, nil)
+	packet := sequencePacket(t, 13, COT_INTERROGATED_BY_STATION,
+		PointUpdate{ObjAddr: 100, Value: 1.5},
+		PointUpdate{ObjAddr: 101, Value: -20, Invalid: true})
+	if err := in.Process(context.Background(), packet); err != nil {
+		t.Fatal(err)
+	}
+	upds := writer.updates()
+	if len(upds) != 2 {
+		t.Fatalf("want 2 updates, got %d", len(upds))
+	}
+	if upds[0].ObjAddr != 100 || upds[0].Value != 1.5 || upds[0].Invalid || upds[0].HasTime {
+		t.Errorf("first object: %+v", upds[0])
+	}
+	if upds[1].ObjAddr != 101 || upds[1].Value != -20 || !upds[1].Invalid {
+		t.Errorf("second object: %+v", upds[1])
+	}
+	if !upds[0].Cot.IsInterrogated() {
+		t.Errorf("cause of transmission: %v", upds[0].Cot)
+	}
+}
+
+// sequence of events: spontaneous changes keep the source time tag and all events are written in order
+func TestIngestSOE(t *testing.T) {
+	in, writer := newTestIngest(t, nil)
+	t0 := time.Date(2024, 3, 1, 10, 20, 30, 125e6, time.UTC)
+	events := []PointUpdate{
+		{ObjAddr: 200, Asdu: 30, Value: 1, HasTime: true, TimeTag: t0, TimeTagOk: true},
+		{ObjAddr: 201, Asdu: 31, Value: 0, HasTime: true, TimeTag: t0.Add(5 * time.Millisecond), TimeTagOk: true},
+		{ObjAddr: 200, Asdu: 30, Value: 0, HasTime: true, TimeTag: t0.Add(17 * time.Millisecond), TimeTagOk: true},
+	}
+	for _, event := range events {
+		if err := in.Process(context.Background(), singlePacket(t, COT_SPONTANEOUS, event)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	upds := writer.updates()
+	if len(upds) != len(events) {
+		t.Fatalf("want %d events, got %d", len(events), len(upds))
+	}
+	for i, upd := range upds {
+		if upd.ObjAddr != events[i].ObjAddr || upd.Value != events[i].Value ||
+			!upd.HasTime || !upd.TimeTag.Equal(events[i].TimeTag) || !upd.TimeTagOk {
+			t.Errorf("event %d: got %+v, want %+v", i, upd, events[i])
+		}
+	}
+
+	// interrogated time-tagged values are written without source time, unless soeFromInterrogation
+	for _, soe := range []bool{false, true} {
+		in.protCon.SoeFromInterrogation = soe
+		for _, asdu := range []uint32{30, 31} {
+			upd := PointUpdate{ObjAddr: 210, Value: 1, HasTime: true, TimeTag: t0, TimeTagOk: true}
+			if err := in.Process(context.Background(), sequencePacket(t, asdu, COT_INTERROGATED_BY_STATION, upd)); err != nil {
+				t.Fatal(err)
+			}
+			upds = writer.updates()
+			last := upds[len(upds)-1]
+			if last.ObjAddr != 210 || last.HasTime != soe || soe && !last.TimeTag.Equal(t0) {
+				t.Errorf("ASDU %d interrogated, soeFromInterrogation %v: got %+v", asdu, soe, last)
+			}
+		}
+	}
+}
+
+func TestIngestDiscarded(t *testing.T) {
+	in, writer := newTestIngest(t, nil)
+
+	single := singlePacket(t, COT_SPONTANEOUS, PointUpdate{ObjAddr: 300, Asdu: 1, Value: 1})
+	in.Process(context.Background(), single)
+	in.Process(context.Background(), single)
+	if n := len(writer.updates()); n != 1 {
+		t.Errorf("duplicated single packet written, %d updates", n)
+	}
+
+	packet := sequencePacket(t, 13, COT_SPONTANEOUS,
+		PointUpdate{ObjAddr: 301, Value: 1},
+		PointUpdate{ObjAddr: 302, Value: 2})
+	in.Process(context.Background(), packet[:len(packet)-1])
+	if n := len(writer.updates()); n != 1 {
+		t.Errorf("truncated packet written, %d updates", n)
+	}
+
+	test := singlePacket(t, COT_SPONTANEOUS|0x80, PointUpdate{ObjAddr: 303, Asdu: 1, Value: 1})
+	in.Process(context.Background(), test)
+	if n := len(writer.updates()); n != 1 {
+		t.Errorf("test data written, %d updates", n)
+	}
+}
+
+func TestIngestPointDefs(t *testing.T) {
+	in, writer := newTestIngest(t, PointDefs{
+		400: {ProtocolSourceBlocked: true},
+		401: {ProtocolSourceInvert: true},
+	})
+	packet := sequencePacket(t, 1, COT_SPONTANEOUS,
+		PointUpdate{ObjAddr: 400, Value: 1},
+		PointUpdate{ObjAddr: 401, Value: 1})
+	if err := in.Process(context.Background(), packet); err != nil {
+		t.Fatal(err)
+	}
+	upds := writer.updates()
+	if len(upds) != 1 || upds[0].ObjAddr != 401 {
+		t.Fatalf("blocked point written: %+v", upds)
+	}
+	if upds[0].Value != 0 || upds[0].RawValue != 1 {
+		t.Errorf("point not inverted: %+v", upds[0])
+	}
+}
+
+func TestIngestWriteError(t *testing.T) {
+	in, writer := newTestIngest(t, nil)
+	writer.err = errors.New("write failed")
+	packet := sequencePacket(t, 1, COT_SPONTANEOUS, PointUpdate{ObjAddr: 500, Value: 1})
+	if err := in.Process(context.Background(), packet); err == nil {
+		t.Error("write error not returned")
+	}
+}
+
+// hot standby: values received while inactive are only cached, then written without time tags when activated
+func TestIngestHotStandby(t *testing.T) {
+	in, writer := newTestIngest(t, nil)
+	in.hotStandby = true
+	setActiveNode(false, 0)
+	t0 := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	in.Process(context.Background(), singlePacket(t, COT_SPONTANEOUS,
+		PointUpdate{ObjAddr: 600, Asdu: 30, Value: 1, HasTime: true, TimeTag: t0, TimeTagOk: true}))
+	in.Process(context.Background(), sequencePacket(t, 13, COT_INTERROGATED_BY_STATION,
+		PointUpdate{ObjAddr: 601, Value: 42}))
+	if len(writer.writes) != 0 {
+		t.Fatalf("written while inactive: %+v", writer.writes)
+	}
+
+	setActiveNode(true, 2)
+	in.CheckActivation()
+	upds := writer.updates()
+	if len(upds) != 2 {
+		t.Fatalf("want 2 cached values, got %+v", upds)
+	}
+	for _, upd := range upds {
+		if upd.HasTime {
+			t.Errorf("snapshot value with time tag: %+v", upd)
+		}
+	}
+}
+
+// with changeOnlyUpdates, values are written again after each activation (the other node may have written meanwhile)
+func TestIngestReactivation(t *testing.T) {
+	in, writer := newTestIngest(t, nil)
+	in.protCon.ChangeOnlyUpdates = true
+	packet := sequencePacket(t, 13, COT_SPONTANEOUS, PointUpdate{ObjAddr: 603, Value: 5})
+
+	in.Process(context.Background(), packet)
+	in.Process(context.Background(), packet) // unchanged
+	if n := len(writer.updates()); n != 1 {
+		t.Fatalf("want 1 update written, got %d", n)
+	}
+
+	setActiveNode(false, 0)
+	in.Process(context.Background(), packet)
+	setActiveNode(true, 3)
+	in.Process(context.Background(), packet)
+	if n := len(writer.updates()); n != 2 {
+		t.Fatalf("unchanged value not written after activation, %d updates", n)
+	}
+
+	// deactivated and activated again between packets
+	setActiveNode(false, 0)
+	setActiveNode(true, 5)
+	in.Process(context.Background(), packet)
+	in.Process(context.Background(), packet)
+	if n := len(writer.updates()); n != 3 {
+		t.Errorf("want 3 updates written, got %d", n)
+	}
+}
+
+// the redundancy goroutine changes the role while packets are processed (run with -race)
+func TestIngestRoleChange(t *testing.T) {
+	in, writer := newTestIngest(t, nil)
+	packet := sequencePacket(t, 13, COT_SPONTANEOUS, PointUpdate{ObjAddr: 602, Value: 1})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for epoch := int64(2); epoch < 200; epoch += 2 {
+			setActiveNode(true, epoch)
+			setActiveNode(false, 0)
+		}
+		setActiveNode(true, 200)
+	}()
+	for i := 0; i < 200; i++ {
+		if err := in.Process(context.Background(), packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+	if err := in.Process(context.Background(), sequencePacket(t, 13, COT_SPONTANEOUS, PointUpdate{ObjAddr: 602, Value: 2})); err != nil {
+		t.Fatal(err)
+	}
+	if upds := writer.updates(); len(upds) == 0 || upds[len(upds)-1].Value != 2 {
+		t.Errorf("update not written after activation: %+v", upds)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"i104mproto"
+)
+
+// a peer on the loopback exchanging packets and commands with the driver over a real UDP transport
+func TestUdpPeerIntegration(t *testing.T) {
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip("UDP loopback not available: ", err)
+	}
+	defer peer.Close()
+
+	in, writer := newTestIngest(t, nil)
+	protCon := in.protCon
+	transport, err := newUdpTransport("127.0.0.1:0", NewPeerAllowList([]string{"127.0.0.1"}), []string{peer.LocalAddr().String()})
+	if err != nil {
+		t.Skip("UDP loopback not available: ", err)
+	}
+	defer transport.Close()
+	protCon.transport = transport
+
+	ctx, cancel := context.WithCancel(context.Background())
+	chanBuf := make(chan ReceivedPacket, 10)
+	done := make(chan struct{})
+	go func() {
+		listenI104MPackets(ctx, protCon, nil, false, chanBuf)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// peer to driver: spontaneous event with time tag
+	t0 := time.Date(2024, 3, 1, 10, 20, 30, 0, time.UTC)
+	packet := singlePacket(t, COT_SPONTANEOUS,
+		PointUpdate{ObjAddr: 700, Asdu: 30, Value: 1, HasTime: true, TimeTag: t0, TimeTagOk: true})
+	if _, err := peer.WriteToUDP(packet, transport.conn.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case received := <-chanBuf:
+		if received.From != "127.0.0.1" {
+			t.Errorf("packet from %s", received.From)
+		}
+		if err := in.Process(ctx, received.Data); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet not received")
+	}
+	upds := writer.updates()
+	if len(upds) != 1 || upds[0].ObjAddr != 700 || upds[0].Value != 1 || !upds[0].TimeTag.Equal(t0) {
+		t.Fatalf("event not written: %+v", upds)
+	}
+
+	// driver to peer: command
+	store := newFakeCommandStore()
+	in.commands = NewCommandTracker(store)
+	in.commands.SetCommandDefs(testCommandDefs())
+	cmd := newTestCommand(time.Now())
+	store.insert(cmd)
+	forwardCommand(cmd, protCon, in.commands, time.Now())
+	if state := store.state(cmd.Id); state != CommandSent {
+		t.Fatalf("command not sent: %s", state)
+	}
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := peer.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal("command frame not received: ", err)
+	}
+	if fields := commandFrameFields(t, buf[:n]); fields[0] != uint32(cmd.ProtocolSourceObjectAddress) {
+		t.Errorf("command frame fields: %v", fields)
+	}
+
+	// peer to driver: activation confirmation
+	ack := i104mproto.SinglePacket(uint32(cmd.ProtocolSourceObjectAddress), uint32(cmd.ProtocolSourceASDU), 7, COT_ACTIVATION_CON, []byte{0x02})
+	if _, err := peer.WriteToUDP(ack, transport.conn.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case received := <-chanBuf:
+		if err := in.Process(ctx, received.Data); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("confirmation not received")
+	}
+	if state := store.state(cmd.Id); state != CommandConfirmed {
+		t.Errorf("command not confirmed: %s", state)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"i104mproto"
+)
+
+// IEC60870-5-101/104 system commands forwarded via the I104M command frame
+const (
+	C_IC_NA_1 = 100 // interrogation command
+	C_CI_NA_1 = 101 // counter interrogation command
+	C_CS_NA_1 = 103 // clock synchronization command
+)
+
+const QOIStation = 20 // qualifier of interrogation: station interrogation (global)
+const QCCGeneral = 5  // qualifier of counter interrogation: general request counter, no freeze
+
+// Schedule of the general interrogation, counter interrogation and clock sync requests to the I104M peer.
+// Requests are sent shortly after the node becomes active and then periodically (intervals in seconds, 0 disables).
+type Interrogation struct {
+	protCon     *ProtocolConnection
+	now         func() time.Time
+	cntGI       int
+	cntCI       int
+	cntTimeSync int
+}
+
+func NewInterrogation(protCon *ProtocolConnection) *Interrogation {
+	in := &Interrogation{protCon: protCon, now: time.Now}
+	in.reset()
+	return in
+}
+
+// prepare counters to send requests right after activation
+func (in *Interrogation) reset() {
+	in.cntGI = in.protCon.GiInterval - 2
+	in.cntCI = in.protCon.CiInterval - 2
+	in.cntTimeSync = in.protCon.TimeSyncInterval
+}
+
+// advance the schedule by one second, requests are sent only while active
+func (in *Interrogation) tick(active bool) {
+	protCon := in.protCon
+	if !active {
+		in.reset()
+		return
+	}
+
+	if protCon.GiInterval > 0 {
+		in.cntGI++
+		if in.cntGI >= protCon.GiInterval {
+			in.cntGI = 0
+			log.Println("Send Interrogation Request")
+			sendSystemCommand(protCon, C_IC_NA_1, QOIStation, 0)
+		}
+	}
+
+	if protCon.CiInterval > 0 {
+		in.cntCI++
+		if in.cntCI >= protCon.CiInterval {
+			in.cntCI = 0
+			log.Println("Send Counter Interrogation Request")
+			sendSystemCommand(protCon, C_CI_NA_1, QCCGeneral, 0)
+		}
+	}
+
+	// opt-in: the encoding is specific to this driver, OSHMI peers do not parse it
+	if protCon.TimeSyncInterval > 0 {
+		in.cntTimeSync++
+		if in.cntTimeSync >= protCon.TimeSyncInterval {
+			in.cntTimeSync = 0
+			log.Println("Send Clock Sync")
+			// value carries UTC unix time in seconds, qualifier field carries the milliseconds
+			now := in.now().UTC()
+			sendSystemCommand(protCon, C_CS_NA_1, uint32(now.Unix()), uint32(now.Nanosecond()/1000000))
+		}
+	}
+}
+
+// send the requests of the connection while the node is active
+func processInterrogation(ctx context.Context, protCon *ProtocolConnection) error {
+	if protCon.TimeSyncInterval > 0 {
+		log.Println("Clock sync enabled (timeSyncInterval), the peer must support the I104M clock sync encoding of this driver")
+	}
+	in := NewInterrogation(protCon)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second):
+		}
+		in.tick(isActive())
+	}
+}
+
+// send a system command (object address 0) to the I104M peers of the connection
+func sendSystemCommand(protCon *ProtocolConnection, tiType uint32, value uint32, qu uint32) {
+	frame := i104mproto.CommandFrame(i104mproto.Command{TiType: tiType, Value: value, Qu: qu, Ca: uint32(protCon.RemoteLinkAddress)})
+	if ok, err_msg := i104mSendToPeers(protCon, frame); !ok {
+		log.Println("Can not send system command ", tiType, ": ", err_msg)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestInterrogation(protCon *ProtocolConnection) (*Interrogation, *fakeTransport, *fakeClock) {
+	transport := &fakeTransport{}
+	protCon.transport = transport
+	protCon.RemoteLinkAddress = 7
+	clock := newFakeClock()
+	in := NewInterrogation(protCon)
+	in.now = clock.Now
+	return in, transport, clock
+}
+
+// advance the schedule n seconds, returns the type of the system commands sent
+func tickInterrogation(t *testing.T, in *Interrogation, transport *fakeTransport, clock *fakeClock, n int, active bool) []uint32 {
+	t.Helper()
+	transport.sent = nil
+	var types []uint32
+	for i := 0; i < n; i++ {
+		clock.Advance(time.Second)
+		in.tick(active)
+	}
+	for _, frame := range transport.sent {
+		types = append(types, commandFrameFields(t, frame)[1])
+	}
+	return types
+}
+
+func checkTypes(t *testing.T, name string, got []uint32, want ...uint32) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%s: got %v, want %v", name, got, want)
+		return
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+			return
+		}
+	}
+}
+
+func TestInterrogationSchedule(t *testing.T) {
+	in, transport, clock := newTestInterrogation(&ProtocolConnection{GiInterval: 300, CiInterval: 600})
+
+	checkTypes(t, "inactive", tickInterrogation(t, in, transport, clock, 1000, false))
+	checkTypes(t, "first second active", tickInterrogation(t, in, transport, clock, 1, true))
+	checkTypes(t, "after activation", tickInterrogation(t, in, transport, clock, 1, true), C_IC_NA_1, C_CI_NA_1)
+	checkTypes(t, "before the GI interval", tickInterrogation(t, in, transport, clock, 299, true))
+	checkTypes(t, "GI interval", tickInterrogation(t, in, transport, clock, 1, true), C_IC_NA_1)
+	checkTypes(t, "CI interval", tickInterrogation(t, in, transport, clock, 300, true), C_IC_NA_1, C_CI_NA_1)
+
+	// counters restart on deactivation, requests are sent again after the next activation
+	checkTypes(t, "deactivated", tickInterrogation(t, in, transport, clock, 100, false))
+	checkTypes(t, "reactivated", tickInterrogation(t, in, transport, clock, 2, true), C_IC_NA_1, C_CI_NA_1)
+}
+
+func TestInterrogationDisabled(t *testing.T) {
+	in, transport, clock := newTestInterrogation(&ProtocolConnection{})
+	checkTypes(t, "all disabled", tickInterrogation(t, in, transport, clock, 3600, true))
+
+	// a transport error does not stop the schedule
+	in, transport, clock = newTestInterrogation(&ProtocolConnection{GiInterval: 10})
+	transport.failMsg = "UDP send error"
+	checkTypes(t, "send failed", tickInterrogation(t, in, transport, clock, 2, true))
+	transport.failMsg = ""
+	checkTypes(t, "send restored", tickInterrogation(t, in, transport, clock, 10, true), C_IC_NA_1)
+}
+
+// system commands: object address 0, qualifier in the value field, common address of the connection
+func TestInterrogationFrames(t *testing.T) {
+	in, transport, clock := newTestInterrogation(&ProtocolConnection{GiInterval: 300, CiInterval: 300, TimeSyncInterval: 60})
+	clock.Advance(250*time.Millisecond - time.Second)
+	tickInterrogation(t, in, transport, clock, 2, true)
+	if len(transport.sent) != 3 {
+		t.Fatalf("got %d frames, want 3", len(transport.sent))
+	}
+
+	sync := time.Date(2024, 3, 1, 12, 0, 0, 250000000, time.UTC) // clock at the first tick
+	want := map[uint32][]uint32{
+		C_IC_NA_1: {0, C_IC_NA_1, QOIStation, 0, 0, 7},
+		C_CI_NA_1: {0, C_CI_NA_1, QCCGeneral, 0, 0, 7},
+		C_CS_NA_1: {0, C_CS_NA_1, uint32(sync.Unix()), 0, 250, 7},
+	}
+	for _, frame := range transport.sent {
+		fields := commandFrameFields(t, frame)
+		w, found := want[fields[1]]
+		if !found {
+			t.Errorf("unexpected frame %v", fields)
+			continue
+		}
+		for i := range w {
+			if fields[i] != w[i] {
+				t.Errorf("ASDU %d: got fields %v, want %v", fields[1], fields, w)
+				break
+			}
+		}
+		delete(want, fields[1])
+	}
+	if len(want) != 0 {
+		t.Errorf("frames not sent: %v", want)
+	}
+
+	checkTypes(t, "clock sync interval", tickInterrogation(t, in, transport, clock, 60, true), C_CS_NA_1)
+}
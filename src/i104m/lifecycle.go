@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const ShutdownTimeout = 10 * time.Second
+
+// Process lifecycle: the context is canceled on SIGINT/SIGTERM or when a go routine fails,
+// go routines started with Go are waited on shutdown. Shutdown is bounded by ShutdownTimeout.
+type Lifecycle struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	waitGroup sync.WaitGroup
+	mutex     sync.Mutex
+	err       error
+}
+
+func NewLifecycle() *Lifecycle {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	return newLifecycle(sigs, func() { signal.Stop(sigs) }, ShutdownTimeout, os.Exit)
+}
+
+// lifecycle canceled by the signals received, exit is called when the shutdown takes longer than timeout (tests)
+func newLifecycle(sigs <-chan os.Signal, stopSignals func(), timeout time.Duration, exit func(code int)) *Lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	lc := &Lifecycle{ctx: ctx, cancel: cancel}
+
+	go func() {
+		select {
+		case sig := <-sigs:
+			log.Println("Signal received, shutting down: ", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+		stopSignals()
+		// force exit when shutdown hangs (mongodb unreachable, etc.)
+		time.Sleep(timeout)
+		log.Println("Shutdown timeout, exiting!")
+		exit(1)
+	}()
+	return lc
+}
+
+func (lc *Lifecycle) Context() context.Context {
+	return lc.ctx
+}
+
+// start a go routine to be waited on shutdown, an error returned initiates the shutdown
+func (lc *Lifecycle) Go(name string, f func(ctx context.Context) error) {
+	lc.waitGroup.Add(1)
+	go func() {
+		defer lc.waitGroup.Done()
+		if err := f(lc.ctx); err != nil {
+			log.Println(name+" failed: ", err)
+			lc.Fail(err)
+		}
+	}()
+}
+
+// initiate the shutdown because of an error, the first error is kept
+func (lc *Lifecycle) Fail(err error) {
+	lc.mutex.Lock()
+	if lc.err == nil {
+		lc.err = err
+	}
+	lc.mutex.Unlock()
+	lc.cancel()
+}
+
+// initiate the shutdown
+func (lc *Lifecycle) Stop() {
+	lc.cancel()
+}
+
+// wait for the go routines to finish
+func (lc *Lifecycle) Wait() {
+	lc.waitGroup.Wait()
+}
+
+// initiate the shutdown and wait for the go routines to finish
+func (lc *Lifecycle) Shutdown() {
+	lc.Stop()
+	lc.Wait()
+}
+
+// error that caused the shutdown (nil for a signal)
+func (lc *Lifecycle) Err() error {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+	return lc.err
+}
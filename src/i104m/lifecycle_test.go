@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// lifecycle on a test signal channel, the exit code is recorded instead of exiting
+func newTestLifecycle(timeout time.Duration) (*Lifecycle, chan os.Signal, chan int, *atomic.Bool) {
+	sigs := make(chan os.Signal, 1)
+	exits := make(chan int, 1)
+	signalsStopped := &atomic.Bool{}
+	lc := newLifecycle(sigs, func() { signalsStopped.Store(true) }, timeout, func(code int) { exits <- code })
+	return lc, sigs, exits, signalsStopped
+}
+
+// signal -> cancel -> the go routines drain and are waited
+func TestLifecycleSignal(t *testing.T) {
+	lc, sigs, exits, signalsStopped := newTestLifecycle(time.Hour)
+	var drained atomic.Int32
+	for i := 0; i < 3; i++ {
+		lc.Go("worker", func(ctx context.Context) error {
+			<-ctx.Done()
+			time.Sleep(20 * time.Millisecond) // work in progress finished after the cancel
+			drained.Add(1)
+			return nil
+		})
+	}
+
+	sigs <- syscall.SIGTERM
+	select {
+	case <-lc.Context().Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("context not canceled by the signal")
+	}
+	lc.Wait()
+	if drained.Load() != 3 {
+		t.Errorf("%d go routines drained, want 3", drained.Load())
+	}
+	if lc.Err() != nil {
+		t.Errorf("error after a signal: %v", lc.Err())
+	}
+	time.Sleep(10 * time.Millisecond)
+	if !signalsStopped.Load() {
+		t.Error("signals not stopped after the cancel")
+	}
+	select {
+	case code := <-exits:
+		t.Errorf("exit %d before the shutdown timeout", code)
+	default:
+	}
+}
+
+// a go routine that does not finish forces the exit after the shutdown timeout
+func TestLifecycleShutdownTimeout(t *testing.T) {
+	lc, sigs, exits, _ := newTestLifecycle(50 * time.Millisecond)
+	hang := make(chan struct{})
+	defer close(hang)
+	lc.Go("hanging", func(ctx context.Context) error {
+		<-hang
+		return nil
+	})
+
+	start := time.Now()
+	sigs <- syscall.SIGINT
+	select {
+	case code := <-exits:
+		if code != 1 {
+			t.Errorf("exit code %d, want 1", code)
+		}
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Errorf("exit after %v, before the shutdown timeout", elapsed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no exit after the shutdown timeout")
+	}
+}
+
+// a failed go routine cancels the others, the first error is kept
+func TestLifecycleFail(t *testing.T) {
+	lc, _, exits, _ := newTestLifecycle(time.Hour)
+	errFirst := errors.New("first")
+	lc.Go("failing", func(ctx context.Context) error {
+		return errFirst
+	})
+	lc.Go("worker", func(ctx context.Context) error {
+		<-ctx.Done()
+		return errors.New("after cancel")
+	})
+	lc.Wait()
+	if lc.Err() != errFirst {
+		t.Errorf("got error %v, want %v", lc.Err(), errFirst)
+	}
+
+	// shutdown without a signal (start up error), the timeout is armed by the cancel
+	lc, _, exits, _ = newTestLifecycle(50 * time.Millisecond)
+	lc.Go("worker", func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	})
+	lc.Shutdown()
+	if lc.Context().Err() == nil {
+		t.Error("context not canceled by Shutdown")
+	}
+	select {
+	case <-exits:
+	case <-time.After(2 * time.Second):
+		t.Error("shutdown timeout not armed by Shutdown")
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"net/http"
+	"time"
+)
+
+func init() {
+	expvar.NewString("version").Set(Version)
+	expvar.Publish("isActive", expvar.Func(func() interface{} { return isActive() }))
+	expvar.Publish("activeNodeEpoch", expvar.Func(func() interface{} { return ActiveNodeEpoch() }))
+}
+
+// serve metrics as JSON (expvar) on http://address/debug/vars until the context is canceled
+func serveMetrics(ctx context.Context, address string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	srv := &http.Server{Addr: address, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	log.Println("Serving metrics on ", address)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package main
+
+// apply the point settings of realtimeData to a decoded update: inversion of digitals, conversion of analogs
+// to engineering units and manual substitution. Returns false when the point is blocked (the update is not written).
+// The value as received is kept in RawValue.
+func (upd PointUpdate) applyPointDef(def *PointDef) (PointUpdate, bool) {
+	if def == nil {
+		return upd, true
+	}
+	if def.ProtocolSourceBlocked {
+		return upd, false
+	}
+	if def.ProtocolSourceInvert && isDigitalAsdu(upd.Asdu) {
+		if upd.Value == 0 {
+			upd.Value = 1
+		} else {
+			upd.Value = 0
+		}
+	}
+	upd = upd.scaled(def)
+	if def.ProtocolSourceSubstituted {
+		if def.ProtocolSourceSubstituteValue != nil {
+			upd.Value = *def.ProtocolSourceSubstituteValue
+		}
+		upd.Substituted = true
+		upd.Invalid = false
+		upd.Transient = false
+		upd.Questionable = false
+		upd.Overflow = false
+		upd.HasTime = false // no events while substituted
+	}
+	return upd, true
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"i104mproto"
+)
+
+type wantOverride struct {
+	value, raw                                       float64
+	substituted, invalid, transient, overflow, event bool
+}
+
+// point settings applied to the updates decoded from the source
+func TestApplyPointDef(t *testing.T) {
+	cp56 := i104mproto.EncodeCP56Time2a(time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC), true, time.UTC)
+	tests := []struct {
+		name string
+		asdu uint32
+		info []byte
+		def  *PointDef
+		want wantOverride
+	}{
+		{"no definition", 1, []byte{0x01}, nil,
+			wantOverride{1, 1, false, false, false, false, false}},
+		{"no settings", 30, append([]byte{0x01}, cp56...), &PointDef{},
+			wantOverride{1, 1, false, false, false, false, true}},
+		{"invert single", 1, []byte{0x01}, &PointDef{ProtocolSourceInvert: true},
+			wantOverride{0, 1, false, false, false, false, false}},
+		{"invert double", 3, []byte{0x01}, &PointDef{ProtocolSourceInvert: true},
+			wantOverride{1, 0, false, false, false, false, false}},
+		{"invert double in transit", 3, []byte{0x00}, &PointDef{ProtocolSourceInvert: true},
+			wantOverride{1, 0, false, false, true, false, false}},
+		{"invert ignored for analogs", 13, []byte{0x00, 0x00, 0x80, 0x3F, 0x00}, &PointDef{ProtocolSourceInvert: true},
+			wantOverride{1, 1, false, false, false, false, false}},
+		{"scaled keeps raw", 9, []byte{0x00, 0x40, 0x00}, &PointDef{ProtocolSourceScale: float64Ptr(500)},
+			wantOverride{250, 0.5, false, false, false, false, false}},
+		{"substitute", 30, append([]byte{0x81}, cp56...), &PointDef{ProtocolSourceSubstituted: true, ProtocolSourceSubstituteValue: float64Ptr(0)},
+			wantOverride{0, 1, true, false, false, false, false}},
+		{"substitute without value", 1, []byte{0x81}, &PointDef{ProtocolSourceSubstituted: true},
+			wantOverride{1, 1, true, false, false, false, false}},
+		{"substitute and invert", 1, []byte{0x01}, &PointDef{ProtocolSourceSubstituted: true, ProtocolSourceSubstituteValue: float64Ptr(1), ProtocolSourceInvert: true},
+			wantOverride{1, 1, true, false, false, false, false}},
+		{"substitute without value and invert", 1, []byte{0x01}, &PointDef{ProtocolSourceSubstituted: true, ProtocolSourceInvert: true},
+			wantOverride{0, 1, true, false, false, false, false}},
+		{"substitute double in transit", 3, []byte{0x00}, &PointDef{ProtocolSourceSubstituted: true, ProtocolSourceSubstituteValue: float64Ptr(1)},
+			wantOverride{1, 0, true, false, false, false, false}},
+		{"substitute double indeterminate IV", 3, []byte{0x83}, &PointDef{ProtocolSourceSubstituted: true},
+			wantOverride{1, 1, true, false, false, false, false}},
+		{"substitute overflow", 11, []byte{0x10, 0x00, 0x01}, &PointDef{ProtocolSourceSubstituted: true, ProtocolSourceSubstituteValue: float64Ptr(5)},
+			wantOverride{5, 16, true, false, false, false, false}},
+		{"substitute not converted", 9, []byte{0x00, 0x40, 0x00}, &PointDef{ProtocolSourceSubstituted: true, ProtocolSourceSubstituteValue: float64Ptr(100), ProtocolSourceScale: float64Ptr(500)},
+			wantOverride{100, 0.5, true, false, false, false, false}},
+		{"limit overflow", 13, []byte{0x00, 0x00, 0x20, 0x41, 0x00}, &PointDef{ProtocolSourceMax: float64Ptr(5)},
+			wantOverride{5, 10, false, false, false, true, false}},
+	}
+	for _, tt := range tests {
+		upd := parseWithProfile(t, QualityProfile{}, tt.asdu, tt.info)
+		upd, ok := upd.applyPointDef(tt.def)
+		if !ok {
+			t.Errorf("%s: update dropped", tt.name)
+			continue
+		}
+		got := wantOverride{upd.Value, upd.RawValue, upd.Substituted, upd.Invalid, upd.Transient, upd.Overflow, upd.HasTime}
+		if got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// blocked points drop the updates, whatever the other settings
+func TestApplyPointDefBlocked(t *testing.T) {
+	for _, def := range []*PointDef{
+		{ProtocolSourceBlocked: true},
+		{ProtocolSourceBlocked: true, ProtocolSourceSubstituted: true, ProtocolSourceSubstituteValue: float64Ptr(1)},
+		{ProtocolSourceBlocked: true, ProtocolSourceInvert: true},
+	} {
+		for _, asdu := range []uint32{1, 13} {
+			if _, ok := (PointUpdate{Asdu: asdu, Value: 1, RawValue: 1}).applyPointDef(def); ok {
+				t.Errorf("ASDU %d %+v: update not dropped", asdu, *def)
+			}
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const PeerResolveInterval = 60 * time.Second
+
+// Allow-list of peers built from the "ipAddresses" entries of the connection. Entries can be IPv4 or IPv6 addresses
+// (IPv6 in brackets when a port is given), host names (resolved again every PeerResolveInterval) or CIDR ranges,
+// optionally followed by :port. The port is ignored for the allow-list.
+type PeerAllowList struct {
+	nets      []*net.IPNet
+	literals  []net.IP
+	hostNames []string
+	mutex     sync.RWMutex
+	resolved  map[string][]net.IP // addresses of host names
+	resolving int32
+	nextCheck time.Time
+	lookupIP  func(host string) ([]net.IP, error)
+}
+
+func NewPeerAllowList(entries []string) *PeerAllowList {
+	return newPeerAllowList(entries, net.LookupIP)
+}
+
+// allow-list with the resolver of host names given (tests)
+func newPeerAllowList(entries []string, lookupIP func(host string) ([]net.IP, error)) *PeerAllowList {
+	l := &PeerAllowList{resolved: map[string][]net.IP{}, lookupIP: lookupIP}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			_, ipNet, err := net.ParseCIDR(entry)
+			if err != nil {
+				log.Println("Invalid CIDR in ipAddresses: ", entry)
+				continue
+			}
+			l.nets = append(l.nets, ipNet)
+			continue
+		}
+		host := peerHost(entry)
+		if ip := net.ParseIP(host); ip != nil {
+			l.literals = append(l.literals, ip)
+		} else {
+			l.hostNames = append(l.hostNames, host)
+		}
+	}
+	l.resolve()
+	return l
+}
+
+// host part of an entry: "host", "host:port", "IPv4:port", "IPv6", "[IPv6]" or "[IPv6]:port"
+func peerHost(entry string) string {
+	if host, _, err := net.SplitHostPort(entry); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(entry, "["), "]")
+}
+
+// check if an address is allowed
+func (l *PeerAllowList) Allowed(ip net.IP) bool {
+	for _, ipNet := range l.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	for _, literal := range l.literals {
+		if literal.Equal(ip) {
+			return true
+		}
+	}
+	if len(l.hostNames) == 0 {
+		return false
+	}
+
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	if time.Now().After(l.nextCheck) && atomic.CompareAndSwapInt32(&l.resolving, 0, 1) {
+		go l.resolve() // do not block the receiver
+	}
+	for _, addrs := range l.resolved {
+		for _, addr := range addrs {
+			if addr.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resolve host names, the last addresses are kept for names that fail to resolve
+func (l *PeerAllowList) resolve() {
+	defer atomic.StoreInt32(&l.resolving, 0)
+	if len(l.hostNames) == 0 {
+		return
+	}
+	for _, host := range l.hostNames {
+		addrs, err := l.lookupIP(host)
+		if err != nil {
+			log.Println("Can not resolve peer host name ", host, ": ", err)
+			continue
+		}
+		l.mutex.Lock()
+		l.resolved[host] = addrs
+		l.mutex.Unlock()
+	}
+	l.mutex.Lock()
+	l.nextCheck = time.Now().Add(PeerResolveInterval)
+	l.mutex.Unlock()
+}
+
+// entries with an explicit port, used as destinations for commands
+func peerDestinations(entries []string) []string {
+	var dests []string
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if strings.Contains(entry, "/") {
+			continue
+		}
+		if _, port, err := net.SplitHostPort(entry); err == nil && port != "" {
+			dests = append(dests, entry)
+		}
+	}
+	return dests
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// resolver of host names for the tests, addresses can be changed while the allow-list is in use
+type fakeResolver struct {
+	mutex   sync.Mutex
+	hosts   map[string][]string
+	lookups int
+}
+
+func (r *fakeResolver) set(host string, addrs ...string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.hosts[host] = addrs
+}
+
+func (r *fakeResolver) lookupIP(host string) ([]net.IP, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.lookups++
+	addrs, ok := r.hosts[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		ips = append(ips, net.ParseIP(addr))
+	}
+	return ips, nil
+}
+
+func (r *fakeResolver) count() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.lookups
+}
+
+func TestPeerAllowList(t *testing.T) {
+	resolver := &fakeResolver{hosts: map[string][]string{
+		"rtu1.local": {"10.1.1.1"},
+		"rtu2.local": {"10.1.1.2", "fd00::2"},
+	}}
+	l := newPeerAllowList([]string{
+		"192.168.1.0/24",
+		"fd00:1::/64",
+		" 10.0.0.5 ",
+		"10.0.0.6:2404",
+		"::1",
+		"[fd00::7]",
+		"[fd00::8]:2404",
+		"rtu1.local",
+		"rtu2.local:2404",
+		"unknown.local",
+		"10.0.0.0/33", // invalid CIDR, ignored
+		"",
+	}, resolver.lookupIP)
+
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"192.168.1.1", true},
+		{"192.168.1.254", true},
+		{"192.168.2.1", false},
+		{"fd00:1::99", true},
+		{"fd00:2::99", false},
+		{"10.0.0.5", true},
+		{"10.0.0.6", true},
+		{"::1", true},
+		{"fd00::7", true},
+		{"fd00::8", true},
+		{"10.1.1.1", true},
+		{"10.1.1.2", true},
+		{"fd00::2", true},
+		{"10.0.0.7", false},
+		{"127.0.0.1", false},
+		{"10.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := l.Allowed(net.ParseIP(tt.ip)); got != tt.allowed {
+			t.Errorf("%s: got allowed=%v, want %v", tt.ip, got, tt.allowed)
+		}
+	}
+	if len(l.nets) != 2 || len(l.literals) != 5 || len(l.hostNames) != 3 {
+		t.Errorf("got %d nets, %d literals, %d host names, want 2, 5, 3", len(l.nets), len(l.literals), len(l.hostNames))
+	}
+	if n := resolver.count(); n != 3 {
+		t.Errorf("host names resolved %d times before the resolve interval, want 3", n)
+	}
+}
+
+// host names are resolved again after the resolve interval, in the background of Allowed
+func TestPeerAllowListResolve(t *testing.T) {
+	resolver := &fakeResolver{hosts: map[string][]string{"rtu.local": {"10.1.1.1"}}}
+	l := newPeerAllowList([]string{"rtu.local:2404"}, resolver.lookupIP)
+	if !l.Allowed(net.ParseIP("10.1.1.1")) {
+		t.Fatal("resolved address not allowed")
+	}
+
+	expire := func() {
+		l.mutex.Lock()
+		l.nextCheck = time.Now().Add(-time.Second)
+		l.mutex.Unlock()
+	}
+	waitAllowed := func(ip string, want bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for l.Allowed(net.ParseIP(ip)) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: allowed not %v after resolving again", ip, want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// address changed
+	resolver.set("rtu.local", "10.1.1.9")
+	expire()
+	waitAllowed("10.1.1.9", true)
+	waitAllowed("10.1.1.1", false)
+
+	// the last addresses are kept when the name does not resolve
+	lookups := resolver.count()
+	resolver.mutex.Lock()
+	delete(resolver.hosts, "rtu.local")
+	resolver.mutex.Unlock()
+	expire()
+	l.Allowed(net.ParseIP("10.1.1.9"))
+	deadline := time.Now().Add(2 * time.Second)
+	for resolver.count() == lookups {
+		if time.Now().After(deadline) {
+			t.Fatal("host name not resolved again")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	waitAllowed("10.1.1.9", true)
+}
+
+func TestPeerAllowListEmpty(t *testing.T) {
+	resolver := &fakeResolver{hosts: map[string][]string{}}
+	l := newPeerAllowList(nil, resolver.lookupIP)
+	if l.Allowed(net.ParseIP("127.0.0.1")) {
+		t.Error("address allowed with an empty list")
+	}
+	if resolver.count() != 0 {
+		t.Error("resolver called without host names")
+	}
+}
+
+// only entries with a port are destinations, CIDR ranges are never
+func TestPeerDestinations(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		want    []string
+	}{
+		{"none", nil, nil},
+		{"without port", []string{"10.0.0.1", "rtu.local", "::1", "[fd00::1]"}, nil},
+		{"with port", []string{"10.0.0.1:2404", " rtu.local:2405 ", "[fd00::1]:2406"}, []string{"10.0.0.1:2404", "rtu.local:2405", "[fd00::1]:2406"}},
+		{"CIDR", []string{"192.168.1.0/24", "192.168.1.0/24:2404"}, nil},
+		{"empty port", []string{"10.0.0.1:"}, nil},
+		{"mixed", []string{"192.168.1.0/24", "10.0.0.1", "10.0.0.2:2404"}, []string{"10.0.0.2:2404"}},
+	}
+	for _, tt := range tests {
+		if got := peerDestinations(tt.entries); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const PointDefsReloadInterval = 60 * time.Second
+
+// Point definition fields (realtimeData) used by the driver
+type PointDef struct {
+	Id                            float64  `bson:"_id"`
+	Tag                           string   `bson:"tag"`
+	Type                          string   `bson:"type"`
+	Origin                        string   `bson:"origin"`
+	ProtocolSourceObjectAddress   float64  `bson:"protocolSourceObjectAddress"`
+	ProtocolSourceCommonAddress   float64  `bson:"protocolSourceCommonAddress"`
+	ProtocolSourceASDU            float64  `bson:"protocolSourceASDU"`
+	ProtocolSourceCommandDuration float64  `bson:"protocolSourceCommandDuration"`
+	ProtocolSourceCommandUseSBO   bool     `bson:"protocolSourceCommandUseSBO"`
+	ProtocolSourceDeadBand        *float64 `bson:"protocolSourceDeadBand"`
+	ProtocolSourceDeadBandPercent *float64 `bson:"protocolSourceDeadBandPercent"`
+	StateTextTrue                 string   `bson:"stateTextTrue"`
+	StateTextFalse                string   `bson:"stateTextFalse"`
+	Unit                          string   `bson:"unit"`
+	Kconv1                        *float64 `bson:"kconv1"`
+	Kconv2                        *float64 `bson:"kconv2"`
+	DecimalPlaces                 *int     `bson:"decimalPlaces"`
+	ProtocolSourceScale           *float64 `bson:"protocolSourceScale"`
+	ProtocolSourceOffset          *float64 `bson:"protocolSourceOffset"`
+	ProtocolSourceMin             *float64 `bson:"protocolSourceMin"`
+	ProtocolSourceMax             *float64 `bson:"protocolSourceMax"`
+	ProtocolSourceInvert          bool     `bson:"protocolSourceInvert"`
+	ProtocolSourceSubstituted     bool     `bson:"protocolSourceSubstituted"`
+	ProtocolSourceSubstituteValue *float64 `bson:"protocolSourceSubstituteValue"`
+	ProtocolSourceBlocked         bool     `bson:"protocolSourceBlocked"`
+}
+
+// Point definitions of a connection indexed by object address
+type PointDefs map[uint32]*PointDef
+
+// Command point definitions of a connection, indexed by point key (_id) and by tag
+type CommandDefs struct {
+	byKey map[int]*PointDef
+	byTag map[string]*PointDef
+}
+
+func newCommandDefs(defs []*PointDef) *CommandDefs {
+	c := &CommandDefs{byKey: map[int]*PointDef{}, byTag: map[string]*PointDef{}}
+	for _, def := range defs {
+		c.byKey[int(def.Id)] = def
+		if tag := strings.TrimSpace(def.Tag); tag != "" {
+			c.byTag[tag] = def
+		}
+	}
+	return c
+}
+
+func (c *CommandDefs) Len() int {
+	return len(c.byKey)
+}
+
+// read point definitions for the connection from realtimeData, supervised points by object address
+// and command points (origin "command")
+func loadPointDefs(collection *mongo.Collection, connectionNumber int) (PointDefs, *CommandDefs, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	cur, err := collection.Find(ctx,
+		bson.D{{"protocolSourceConnectionNumber", connectionNumber}},
+		options.Find().SetProjection(bson.D{
+			{"_id", 1},
+			{"tag", 1},
+			{"type", 1},
+			{"origin", 1},
+			{"protocolSourceObjectAddress", 1},
+			{"protocolSourceCommonAddress", 1},
+			{"protocolSourceASDU", 1},
+			{"protocolSourceCommandDuration", 1},
+			{"protocolSourceCommandUseSBO", 1},
+			{"protocolSourceDeadBand", 1},
+			{"protocolSourceDeadBandPercent", 1},
+			{"stateTextTrue", 1},
+			{"stateTextFalse", 1},
+			{"unit", 1},
+			{"kconv1", 1},
+			{"kconv2", 1},
+			{"decimalPlaces", 1},
+			{"protocolSourceScale", 1},
+			{"protocolSourceOffset", 1},
+			{"protocolSourceMin", 1},
+			{"protocolSourceMax", 1},
+			{"protocolSourceInvert", 1},
+			{"protocolSourceSubstituted", 1},
+			{"protocolSourceSubstituteValue", 1},
+			{"protocolSourceBlocked", 1},
+		}),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cur.Close(ctx)
+
+	defs := PointDefs{}
+	var commandDefs []*PointDef
+	for cur.Next(ctx) {
+		def := &PointDef{}
+		if err := cur.Decode(def); err != nil {
+			log.Println("Point definition decode error: ", err)
+			continue
+		}
+		if def.Origin == "command" {
+			commandDefs = append(commandDefs, def)
+			continue
+		}
+		defs[uint32(def.ProtocolSourceObjectAddress)] = def
+	}
+	return defs, newCommandDefs(commandDefs), cur.Err()
+}
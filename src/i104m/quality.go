@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// quality outcomes of a source qualifier condition
+const (
+	QualityNone         = "none"         // only the qualifier itself is written (e.g. notTopicalAtSource)
+	QualityInvalid      = "invalid"      // also written as invalidAtSource
+	QualityTransient    = "transient"    // also written as transientAtSource
+	QualityQuestionable = "questionable" // also written as questionableAtSource
+)
+
+// Maps conditions of the source qualifiers (IV NT SB BL OV bits, double point and step position states) to the
+// quality of the value ("qualityProfile" of the connection). The IV bit always means invalid.
+// Empty fields take the default (the behavior of previous versions).
+type QualityProfile struct {
+	DoubleIntermediate  string `bson:"doubleIntermediate"`  // double point state 00, default transient
+	DoubleIndeterminate string `bson:"doubleIndeterminate"` // double point state 11, default transient
+	StepTransient       string `bson:"stepTransient"`       // transient bit of step position, default transient
+	NotTopical          string `bson:"notTopical"`          // NT bit, default none
+	Substituted         string `bson:"substituted"`         // SB bit, default none
+	Blocked             string `bson:"blocked"`             // BL bit, default none
+	Overflow            string `bson:"overflow"`            // OV bit, default none
+}
+
+// Qualifiers of an information object as received
+type SourceQualifiers struct {
+	Invalid       bool // IV
+	NotTopical    bool // NT
+	Substituted   bool // SB
+	Blocked       bool // BL
+	Overflow      bool // OV
+	DoubleState   int  // double points: 0-3 (00 intermediate, 01 off, 10 on, 11 indeterminate), -1 for other types
+	StepTransient bool
+}
+
+var DefaultQualityProfile = QualityProfile{
+	DoubleIntermediate:  QualityTransient,
+	DoubleIndeterminate: QualityTransient,
+	StepTransient:       QualityTransient,
+	NotTopical:          QualityNone,
+	Substituted:         QualityNone,
+	Blocked:             QualityNone,
+	Overflow:            QualityNone,
+}
+
+// fill defaults and check the outcomes
+func (p *QualityProfile) validate() error {
+	def := DefaultQualityProfile
+	for _, f := range []struct {
+		name  string
+		value *string
+		def   string
+	}{
+		{"doubleIntermediate", &p.DoubleIntermediate, def.DoubleIntermediate},
+		{"doubleIndeterminate", &p.DoubleIndeterminate, def.DoubleIndeterminate},
+		{"stepTransient", &p.StepTransient, def.StepTransient},
+		{"notTopical", &p.NotTopical, def.NotTopical},
+		{"substituted", &p.Substituted, def.Substituted},
+		{"blocked", &p.Blocked, def.Blocked},
+		{"overflow", &p.Overflow, def.Overflow},
+	} {
+		*f.value = strings.ToLower(strings.TrimSpace(*f.value))
+		switch *f.value {
+		case "":
+			*f.value = f.def
+		case QualityNone, QualityInvalid, QualityTransient, QualityQuestionable:
+		default:
+			return fmt.Errorf("qualityProfile.%s: invalid value '%s' (none, invalid, transient or questionable)", f.name, *f.value)
+		}
+	}
+	return nil
+}
+
+// quality of a value from its source qualifiers
+func (p *QualityProfile) Map(q SourceQualifiers) (invalid, transient, questionable bool) {
+	invalid = q.Invalid
+	apply := func(condition bool, outcome string) {
+		if !condition {
+			return
+		}
+		switch outcome {
+		case QualityInvalid:
+			invalid = true
+		case QualityTransient:
+			transient = true
+		case QualityQuestionable:
+			questionable = true
+		}
+	}
+	apply(q.DoubleState == 0, p.DoubleIntermediate)
+	apply(q.DoubleState == 3, p.DoubleIndeterminate)
+	apply(q.StepTransient, p.StepTransient)
+	apply(q.NotTopical, p.NotTopical)
+	apply(q.Substituted, p.Substituted)
+	apply(q.Blocked, p.Blocked)
+	apply(q.Overflow, p.Overflow)
+	return invalid, transient, questionable
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+type wantQuality struct {
+	value                            float64
+	invalid, transient, questionable bool
+}
+
+func parseWithProfile(t *testing.T, profile QualityProfile, asdu uint32, info []byte) PointUpdate {
+	t.Helper()
+	if err := profile.validate(); err != nil {
+		t.Fatal(err)
+	}
+	protCon := &ProtocolConnection{QualityProfile: profile, sourceLocation: time.UTC}
+	upd, ok := i104mParseObj(info, 1, asdu, decodeCOT(COT_SPONTANEOUS), protCon)
+	if !ok {
+		t.Fatalf("ASDU %d not decoded", asdu)
+	}
+	return upd
+}
+
+func checkQuality(t *testing.T, name string, upd PointUpdate, want wantQuality) {
+	t.Helper()
+	if upd.Value != want.value || upd.Invalid != want.invalid || upd.Transient != want.transient || upd.Questionable != want.questionable {
+		t.Errorf("%s: got value=%g invalid=%v transient=%v questionable=%v, want %+v",
+			name, upd.Value, upd.Invalid, upd.Transient, upd.Questionable, want)
+	}
+}
+
+// default profile: only the IV bit makes a value invalid, double point states 00 and 11 and the step position
+// transient bit are transient, NT SB BL OV are written only as their own flags
+func TestDefaultQualityProfile(t *testing.T) {
+	tests := []struct {
+		name string
+		asdu uint32
+		info []byte
+		want wantQuality
+	}{
+		{"single off", 1, []byte{0x00}, wantQuality{0, false, false, false}},
+		{"single on", 1, []byte{0x01}, wantQuality{1, false, false, false}},
+		{"single on IV", 1, []byte{0x81}, wantQuality{1, true, false, false}},
+		{"single NT SB BL", 1, []byte{0x71}, wantQuality{1, false, false, false}},
+		{"double 00 intermediate", 3, []byte{0x00}, wantQuality{0, false, true, false}},
+		{"double 01 off", 3, []byte{0x01}, wantQuality{0, false, false, false}},
+		{"double 10 on", 3, []byte{0x02}, wantQuality{1, false, false, false}},
+		{"double 11 indeterminate", 3, []byte{0x03}, wantQuality{1, false, true, false}},
+		{"double 10 on IV", 3, []byte{0x82}, wantQuality{1, true, false, false}},
+		{"double 00 IV", 3, []byte{0x80}, wantQuality{0, true, true, false}},
+		{"step transient", 5, []byte{0x85, 0x00}, wantQuality{5, false, true, false}},
+		{"scaled OV", 11, []byte{0x10, 0x00, 0x01}, wantQuality{16, false, false, false}},
+		{"float IV", 13, []byte{0x00, 0x00, 0x80, 0x3F, 0x80}, wantQuality{1, true, false, false}},
+	}
+	for _, tt := range tests {
+		checkQuality(t, tt.name, parseWithProfile(t, QualityProfile{}, tt.asdu, tt.info), tt.want)
+	}
+
+	upd := parseWithProfile(t, QualityProfile{}, 1, []byte{0x71})
+	if !upd.NotTopical || !upd.Substituted || !upd.Blocked {
+		t.Errorf("NT SB BL flags not decoded: %+v", upd)
+	}
+	if upd = parseWithProfile(t, QualityProfile{}, 13, []byte{0, 0, 0, 0, 0x01}); !upd.Overflow {
+		t.Errorf("OV flag not decoded: %+v", upd)
+	}
+}
+
+func TestCustomQualityProfile(t *testing.T) {
+	profile := QualityProfile{
+		DoubleIntermediate:  "transient",
+		DoubleIndeterminate: "Invalid",
+		NotTopical:          "questionable",
+		Substituted:         "questionable",
+		Blocked:             "invalid",
+		Overflow:            "invalid",
+		StepTransient:       "none",
+	}
+	tests := []struct {
+		name string
+		asdu uint32
+		info []byte
+		want wantQuality
+	}{
+		{"double 00 intermediate", 3, []byte{0x00}, wantQuality{0, false, true, false}},
+		{"double 11 indeterminate", 3, []byte{0x03}, wantQuality{1, true, false, false}},
+		{"single NT", 1, []byte{0x41}, wantQuality{1, false, false, true}},
+		{"single SB", 1, []byte{0x21}, wantQuality{1, false, false, true}},
+		{"single BL", 1, []byte{0x11}, wantQuality{1, true, false, false}},
+		{"scaled OV", 11, []byte{0x10, 0x00, 0x01}, wantQuality{16, true, false, false}},
+		{"step transient", 5, []byte{0x85, 0x00}, wantQuality{5, false, false, false}},
+	}
+	for _, tt := range tests {
+		checkQuality(t, tt.name, parseWithProfile(t, profile, tt.asdu, tt.info), tt.want)
+	}
+}
+
+func TestQualityProfileValidate(t *testing.T) {
+	p := QualityProfile{Blocked: " Invalid "}
+	if err := p.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if p.Blocked != QualityInvalid || p.DoubleIntermediate != QualityTransient || p.NotTopical != QualityNone {
+		t.Errorf("defaults not filled: %+v", p)
+	}
+	p = QualityProfile{NotTopical: "bad"}
+	if err := p.validate(); err == nil {
+		t.Error("invalid outcome accepted")
+	}
+}
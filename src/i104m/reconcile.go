@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const CommandReconcileInterval = 10 * time.Second
+
+// expire commands stuck in pending states (sent without confirmation, or never sent because the driver stopped)
+// and archive finished commands older than commandsArchiveAge seconds (when set). Runs on the active node.
+func reconcileCommands(ctx context.Context, protCon *ProtocolConnection, tracker *CommandTracker) error {
+	timeout := commandTimeout(protCon)
+	archiveAge := time.Duration(protCon.CommandsArchiveAge) * time.Second
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(CommandReconcileInterval):
+		}
+		if !isActive() {
+			continue
+		}
+		now := time.Now()
+		tracker.prune(now.Add(-timeout))
+		n, err := tracker.store.ExpireStale(protCon.ProtocolConnectionNumber, timeout, now)
+		if err != nil {
+			log.Println("Error expiring stale commands: ", err)
+		} else if n > 0 {
+			log.Printf("Stale commands expired: %d", n)
+		}
+		if archiveAge <= 0 {
+			continue
+		}
+		n, err = tracker.store.Archive(protCon.ProtocolConnectionNumber, archiveAge, now)
+		if err != nil {
+			log.Println("Error archiving commands: ", err)
+		} else if n > 0 && LogLevel >= LogLevelDetailed {
+			log.Printf("Commands archived: %d", n)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultLeaseDuration = 15 // seconds
+
+// Redundancy is controlled by a lease on the protocolDriverInstances document.
+// The active node renews the lease ("leaseExpiration") every 1/3 of the lease duration.
+// When the lease expires, the first node in "nodeNames" can take over, each following node waits one more renew interval.
+// Takeover and renew are atomic conditional updates evaluated with the server clock ($$NOW).
+// Each takeover increments "activeNodeEpoch", which is stamped on data writes to fence out a stale active node.
+// For a switchover ("switchoverToNodeName") or maintenance ("pinnedNodeName"), the active node hands the lease
+// over to the target node and deactivates, the target node adopts the lease as soon as it sees it.
+
+var activeNodeEpoch int64  // epoch of the lease held by this node (0 = not active)
+var activeNode atomic.Bool // role of this node, written by the redundancy goroutine, read by the others
+
+// epoch of the lease held by this node, to be stamped on writes
+func ActiveNodeEpoch() int64 {
+	return atomic.LoadInt64(&activeNodeEpoch)
+}
+
+// true when this node is active
+func isActive() bool {
+	return activeNode.Load()
+}
+
+func setActive(active bool) {
+	activeNode.Store(active)
+}
+
+// Storage of the lease (instance document), of the transition events and of the node status.
+// Lease conditions are evaluated atomically by the store, with the store clock.
+type RedundancyStore interface {
+	ReadInstance(ctx context.Context) (ProtocolDriverInstance, error)
+	// extend the lease held by the node with the epoch, false if not held anymore
+	RenewLease(ctx context.Context, nodeName string, epoch int64, leaseDuration time.Duration) (bool, error)
+	// take the lease if nobody acquired it since observedEpoch and it was handed over to the node (handedOver)
+	// or expired for more than delay, returns the instance with the new epoch, false if the condition is not met
+	AcquireLease(ctx context.Context, nodeName string, observedEpoch int64, handedOver bool, delay time.Duration, leaseDuration time.Duration) (ProtocolDriverInstance, bool, error)
+	// pass the lease held by the node to the target node, false if not held anymore
+	HandoverLease(ctx context.Context, nodeName string, epoch int64, target string, leaseDuration time.Duration) (bool, error)
+	ReleaseLease(ctx context.Context, nodeName string, epoch int64) error
+	// call changed on each change of the instance document, until the context is canceled or the watch fails
+	WatchInstance(ctx context.Context, changed func(ProtocolDriverInstance)) error
+	InsertEvent(ctx context.Context, event RedundancyEvent) error
+	UpdateNodeStatus(ctx context.Context, status NodeStatus) error
+}
+
+type Redundancy struct {
+	store                        RedundancyStore
+	protocolDriver               string
+	protocolDriverInstanceNumber int
+	nodeName                     string
+	leaseDuration                time.Duration
+	leaseDeadline                time.Time // local time limit for the lease held, self deactivate after it
+	active                       bool
+	epoch                        int64 // epoch of the lease held (0 = not active)
+	onChange                     func(active bool, epoch int64)
+	now                          func() time.Time
+	observedActiveNodeName       string
+	lastTransitionTimeTag        time.Time
+	lastTransitionReason         string
+	pendingEvents                []RedundancyEvent
+	wake                         chan struct{} // signals changes on the instance document
+}
+
+func NewRedundancy(store RedundancyStore, instance ProtocolDriverInstance, nodeName string) *Redundancy {
+	leaseDuration := instance.LeaseDuration
+	if leaseDuration <= 0 {
+		leaseDuration = DefaultLeaseDuration
+	}
+	r := &Redundancy{
+		store:                        store,
+		protocolDriver:               instance.ProtocolDriver,
+		protocolDriverInstanceNumber: instance.ProtocolDriverInstanceNumber,
+		nodeName:                     nodeName,
+		leaseDuration:                time.Duration(leaseDuration) * time.Second,
+		onChange:                     setActiveNode,
+		now:                          time.Now,
+		wake:                         make(chan struct{}, 1),
+	}
+	r.recordEvent("started", "driver started", instance.ActiveNodeName)
+	return r
+}
+
+// publish the role of this node to the driver.
+// The epoch is set before activating and cleared after deactivating, so an active node never writes with a stale epoch.
+func setActiveNode(active bool, epoch int64) {
+	if active {
+		atomic.StoreInt64(&activeNodeEpoch, epoch)
+		setActive(true)
+		return
+	}
+	setActive(false)
+	atomic.StoreInt64(&activeNodeEpoch, epoch)
+}
+
+func (r *Redundancy) renewInterval() time.Duration {
+	return r.leaseDuration / 3
+}
+
+// run the redundancy control until the context is canceled, the lease is kept (see Release)
+func (r *Redundancy) Run(ctx context.Context) error {
+	go r.watchInstance(ctx)
+	for {
+		if err := r.process(); err != nil {
+			return err
+		}
+		r.publishStatus()
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-r.wake:
+		case <-time.After(r.renewInterval()):
+		}
+	}
+}
+
+// give up the lease on shutdown, so other node can take over without waiting for the lease to expire
+func (r *Redundancy) Release() {
+	if !r.active {
+		r.publishStatus()
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.renewInterval())
+	defer cancel()
+	if err := r.store.ReleaseLease(ctx, r.nodeName, r.epoch); err != nil {
+		log.Println("Redundancy - Error releasing lease: ", err)
+	}
+	r.observedActiveNodeName = ""
+	r.deactivate("driver shutdown")
+	r.publishStatus()
+}
+
+// watch the instance document to react immediately to switchover requests and lease handovers
+func (r *Redundancy) watchInstance(ctx context.Context) {
+	var lastKey string
+	for ctx.Err() == nil {
+		err := r.store.WatchInstance(ctx, func(instance ProtocolDriverInstance) {
+			// lease renewals do not change these, avoid waking on every keep alive
+			key := instance.ActiveNodeName + "|" + instance.SwitchoverToNodeName + "|" + instance.PinnedNodeName
+			if key == lastKey {
+				return
+			}
+			lastKey = key
+			select {
+			case r.wake <- struct{}{}:
+			default:
+			}
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println("Redundancy - Instance change stream closed, polling only: ", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(r.renewInterval()):
+		}
+	}
+}
+
+// one redundancy cycle: renew the lease if active, try to take over if the lease expired
+func (r *Redundancy) process() error {
+	// self fencing, the lease may have expired while mongodb was unreachable
+	if r.active && r.now().After(r.leaseDeadline) {
+		r.deactivate("lease expired without renew")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.renewInterval())
+	defer cancel()
+
+	instance, err := r.store.ReadInstance(ctx)
+	if err != nil {
+		log.Println("Error querying protocolDriverInstances!")
+		log.Println(err)
+		return nil
+	}
+
+	r.observedActiveNodeName = instance.ActiveNodeName
+
+	rank := indexOf(instance.NodeNames, r.nodeName)
+	if rank < 0 {
+		return errors.New("this node name not in the list of nodes from driver instance")
+	}
+
+	pinned := strings.TrimSpace(instance.PinnedNodeName)
+	switchoverTo := strings.TrimSpace(instance.SwitchoverToNodeName)
+	if pinned != "" && indexOf(instance.NodeNames, pinned) < 0 {
+		log.Println("Redundancy - Pinned node '" + pinned + "' not in the list of nodes, ignored!")
+		pinned = ""
+	}
+	if switchoverTo != "" && indexOf(instance.NodeNames, switchoverTo) < 0 {
+		log.Println("Redundancy - Switchover node '" + switchoverTo + "' not in the list of nodes, ignored!")
+		switchoverTo = ""
+	}
+
+	if r.active {
+		switch {
+		case pinned != "" && pinned != r.nodeName:
+			r.handover(ctx, pinned, "instance pinned to node '"+pinned+"'")
+		case switchoverTo != "" && switchoverTo != r.nodeName && pinned == "":
+			r.handover(ctx, switchoverTo, "switchover to node '"+switchoverTo+"' requested")
+		default:
+			r.renew(ctx, instance)
+		}
+		return nil
+	}
+
+	switch {
+	case pinned != "" && pinned != r.nodeName:
+		log.Println("Redundancy - This node is INACTIVE! Instance pinned to node '" + pinned + "'.")
+		return nil
+	case instance.ActiveNodeName == r.nodeName:
+		// lease handed over to this node (or held before a restart)
+		r.acquire(ctx, instance, true, 0, handoverReason(instance))
+		return nil
+	case instance.ActiveNodeName != "":
+		log.Println("Redundancy - This node is INACTIVE! Node '" + instance.ActiveNodeName + "' is active, wait...")
+	default:
+		log.Println("Redundancy - This node is INACTIVE! No node is active, wait...")
+	}
+
+	// the requested switchover node or the pinned node takes over first
+	if switchoverTo == r.nodeName || pinned == r.nodeName {
+		rank = 0
+	}
+	reason := "no active node"
+	if instance.ActiveNodeName != "" {
+		reason = "lease of node '" + instance.ActiveNodeName + "' expired"
+	}
+	r.acquire(ctx, instance, false, time.Duration(rank)*r.renewInterval(), reason)
+	return nil
+}
+
+// extend the lease held by this node
+func (r *Redundancy) renew(ctx context.Context, instance ProtocolDriverInstance) {
+	tRequest := r.now()
+	held, err := r.store.RenewLease(ctx, r.nodeName, r.epoch, r.leaseDuration)
+	if err != nil {
+		log.Println("Redundancy - Error renewing lease: ", err)
+		return
+	}
+	if !held {
+		r.deactivate("lease taken by node '" + instance.ActiveNodeName + "'")
+		return
+	}
+	r.leaseDeadline = tRequest.Add(r.leaseDuration)
+	log.Println("Redundancy - This node is active.")
+}
+
+// try to acquire the lease (handed over to this node or expired for more than delay), a new epoch is assigned
+func (r *Redundancy) acquire(ctx context.Context, instance ProtocolDriverInstance, handedOver bool, delay time.Duration, reason string) {
+	tRequest := r.now()
+	acquired, ok, err := r.store.AcquireLease(ctx, r.nodeName, instance.ActiveNodeEpoch, handedOver, delay, r.leaseDuration)
+	if err != nil {
+		log.Println("Redundancy - Error acquiring lease: ", err)
+		return
+	}
+	if !ok {
+		return
+	}
+	r.leaseDeadline = tRequest.Add(r.leaseDuration)
+	r.observedActiveNodeName = r.nodeName
+	r.setRole(true, acquired.ActiveNodeEpoch)
+	log.Printf("Redundancy - ACTIVATING this Node! Epoch %d, %s", acquired.ActiveNodeEpoch, reason)
+	r.recordEvent("activated", reason, instance.ActiveNodeName)
+}
+
+// hand the lease over to other node (switchover or maintenance) and deactivate this node
+func (r *Redundancy) handover(ctx context.Context, target string, reason string) {
+	held, err := r.store.HandoverLease(ctx, r.nodeName, r.epoch, target, r.leaseDuration)
+	if err != nil {
+		log.Println("Redundancy - Error handing over lease: ", err)
+		return
+	}
+	if !held {
+		r.deactivate("lease lost before handover")
+		return
+	}
+	r.observedActiveNodeName = target
+	r.deactivate(reason)
+}
+
+func (r *Redundancy) setRole(active bool, epoch int64) {
+	r.active = active
+	r.epoch = epoch
+	if r.onChange != nil {
+		r.onChange(active, epoch)
+	}
+}
+
+func handoverReason(instance ProtocolDriverInstance) string {
+	if instance.HandoverFromNodeName == "" {
+		return "lease held by this node before restart"
+	}
+	return "lease handed over by node '" + instance.HandoverFromNodeName + "'"
+}
+
+func (r *Redundancy) deactivate(reason string) {
+	if !r.active {
+		return
+	}
+	log.Println("Redundancy - DEACTIVATING this Node (" + reason + ")!")
+	r.recordEvent("deactivated", reason, r.nodeName)
+	r.setRole(false, 0)
+}
+
+// find position of a string in array (-1 if not found)
+func indexOf(a []string, str string) int {
+	tStr := strings.TrimSpace(str)
+	for i, n := range a {
+		if tStr == strings.TrimSpace(n) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Redundancy store on MongoDB: the lease is kept on the protocolDriverInstances document, conditions are
+// evaluated with the server clock ($$NOW, requires MongoDB 4.2+)
+type mongoRedundancyStore struct {
+	collectionInstances   *mongo.Collection
+	collectionNodesStatus *mongo.Collection
+	collectionEvents      *mongo.Collection
+	id                    primitive.ObjectID
+}
+
+func newMongoRedundancyStore(collectionInstances *mongo.Collection, id primitive.ObjectID) *mongoRedundancyStore {
+	db := collectionInstances.Database()
+	return &mongoRedundancyStore{
+		collectionInstances:   collectionInstances,
+		collectionNodesStatus: db.Collection(NodesStatusCollectionName),
+		collectionEvents:      db.Collection(RedundancyEventsCollectionName),
+		id:                    id,
+	}
+}
+
+func (s *mongoRedundancyStore) ReadInstance(ctx context.Context) (ProtocolDriverInstance, error) {
+	var instance ProtocolDriverInstance
+	err := s.collectionInstances.FindOne(ctx, bson.D{{"_id", s.id}}).Decode(&instance)
+	return instance, err
+}
+
+// filter of the lease held by a node
+func (s *mongoRedundancyStore) heldBy(nodeName string, epoch int64) bson.D {
+	return bson.D{
+		{"_id", s.id},
+		{"activeNodeName", nodeName},
+		{"activeNodeEpoch", epoch},
+	}
+}
+
+// expression that clears a switchover request already fulfilled (to the node)
+func clearSwitchoverTo(nodeName string) bson.D {
+	return bson.D{{"$cond", bson.A{
+		bson.D{{"$eq", bson.A{"$switchoverToNodeName", nodeName}}}, "", "$switchoverToNodeName"}}}
+}
+
+func (s *mongoRedundancyStore) RenewLease(ctx context.Context, nodeName string, epoch int64, leaseDuration time.Duration) (bool, error) {
+	res, err := s.collectionInstances.UpdateOne(ctx,
+		s.heldBy(nodeName, epoch),
+		mongo.Pipeline{bson.D{{"$set", bson.D{
+			{"activeNodeKeepAliveTimeTag", "$$NOW"},
+			{"leaseExpiration", bson.D{{"$add", bson.A{"$$NOW", leaseDuration.Milliseconds()}}}},
+			{"switchoverToNodeName", clearSwitchoverTo(nodeName)},
+		}}}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+func (s *mongoRedundancyStore) AcquireLease(ctx context.Context, nodeName string, observedEpoch int64, handedOver bool, delay time.Duration, leaseDuration time.Duration) (ProtocolDriverInstance, bool, error) {
+	// lease handed over to this node, or expired (or never set) for more than the delay of this node rank
+	leaseCondition := bson.D{{"$lt", bson.A{bson.D{{"$add", bson.A{"$leaseExpiration", delay.Milliseconds()}}}, "$$NOW"}}}
+	if handedOver {
+		leaseCondition = bson.D{{"$eq", bson.A{"$activeNodeName", nodeName}}}
+	}
+	var acquired ProtocolDriverInstance
+	err := s.collectionInstances.FindOneAndUpdate(ctx,
+		bson.D{
+			{"_id", s.id},
+			{"$expr", bson.D{{"$and", bson.A{
+				// nobody acquired since read
+				bson.D{{"$eq", bson.A{bson.D{{"$ifNull", bson.A{"$activeNodeEpoch", 0}}}, observedEpoch}}},
+				leaseCondition,
+			}}}},
+		},
+		mongo.Pipeline{bson.D{{"$set", bson.D{
+			{"activeNodeName", nodeName},
+			{"activeNodeKeepAliveTimeTag", "$$NOW"},
+			{"leaseExpiration", bson.D{{"$add", bson.A{"$$NOW", leaseDuration.Milliseconds()}}}},
+			// monotonic epoch, survives recreation of the instance document
+			{"activeNodeEpoch", bson.D{{"$max", bson.A{
+				bson.D{{"$add", bson.A{bson.D{{"$ifNull", bson.A{"$activeNodeEpoch", 0}}}, 1}}},
+				bson.D{{"$toLong", "$$NOW"}},
+			}}}},
+			{"handoverFromNodeName", ""},
+			{"switchoverToNodeName", clearSwitchoverTo(nodeName)},
+		}}}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&acquired)
+	if err == mongo.ErrNoDocuments { // condition not met or lease taken by other node
+		return acquired, false, nil
+	}
+	if err != nil {
+		return acquired, false, err
+	}
+	return acquired, true, nil
+}
+
+func (s *mongoRedundancyStore) HandoverLease(ctx context.Context, nodeName string, epoch int64, target string, leaseDuration time.Duration) (bool, error) {
+	res, err := s.collectionInstances.UpdateOne(ctx,
+		s.heldBy(nodeName, epoch),
+		mongo.Pipeline{bson.D{{"$set", bson.D{
+			{"activeNodeName", target},
+			{"handoverFromNodeName", nodeName},
+			{"activeNodeKeepAliveTimeTag", "$$NOW"},
+			{"leaseExpiration", bson.D{{"$add", bson.A{"$$NOW", leaseDuration.Milliseconds()}}}},
+			{"switchoverToNodeName", ""},
+		}}}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+func (s *mongoRedundancyStore) ReleaseLease(ctx context.Context, nodeName string, epoch int64) error {
+	_, err := s.collectionInstances.UpdateOne(ctx,
+		s.heldBy(nodeName, epoch),
+		mongo.Pipeline{bson.D{{"$set", bson.D{
+			{"activeNodeName", ""},
+			{"leaseExpiration", "$$NOW"},
+		}}}},
+	)
+	return err
+}
+
+func (s *mongoRedundancyStore) WatchInstance(ctx context.Context, changed func(ProtocolDriverInstance)) error {
+	cs, err := s.collectionInstances.Watch(ctx,
+		mongo.Pipeline{bson.D{
+			{"$match", bson.D{
+				{"documentKey._id", s.id},
+				{"operationType", bson.D{{"$in", bson.A{"update", "replace"}}}},
+			}},
+		}},
+		options.ChangeStream().SetFullDocument(options.UpdateLookup))
+	if err != nil {
+		return err
+	}
+	defer cs.Close(context.Background())
+	for cs.Next(ctx) {
+		var change struct {
+			FullDocument ProtocolDriverInstance `bson:"fullDocument"`
+		}
+		if err := cs.Decode(&change); err != nil {
+			return err
+		}
+		changed(change.FullDocument)
+	}
+	return cs.Err()
+}
+
+func (s *mongoRedundancyStore) InsertEvent(ctx context.Context, event RedundancyEvent) error {
+	_, err := s.collectionEvents.InsertOne(ctx, event)
+	return err
+}
+
+func (s *mongoRedundancyStore) UpdateNodeStatus(ctx context.Context, status NodeStatus) error {
+	_, err := s.collectionNodesStatus.UpdateOne(ctx,
+		bson.D{
+			{"protocolDriver", status.ProtocolDriver},
+			{"protocolDriverInstanceNumber", status.ProtocolDriverInstanceNumber},
+			{"nodeName", status.NodeName},
+		},
+		bson.D{
+			{"$set", bson.D{
+				{"role", status.Role},
+				{"activeNodeName", status.ActiveNodeName},
+				{"activeNodeEpoch", status.ActiveNodeEpoch},
+				{"leaseDuration", status.LeaseDuration},
+				{"lastTransitionTimeTag", status.LastTransitionTimeTag},
+				{"lastTransitionReason", status.LastTransitionReason},
+				{"version", status.Version},
+			}},
+			{"$currentDate", bson.D{{"heartbeatTimeTag", true}}},
+		},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
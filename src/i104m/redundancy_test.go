@@ -0,0 +1,186 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// redundancy node on the fake store, the role is kept on the node only (not on the driver globals)
+func newTestNode(t *testing.T, store *fakeRedundancyStore, nodeName string) *Redundancy {
+	t.Helper()
+	r := NewRedundancy(store, store.get(), nodeName)
+	r.onChange = nil
+	r.now = store.clock.Now
+	return r
+}
+
+func processNodes(t *testing.T, nodes ...*Redundancy) {
+	t.Helper()
+	for _, r := range nodes {
+		if err := r.process(); err != nil {
+			t.Fatal(err)
+		}
+		r.publishStatus()
+	}
+}
+
+func lastEvent(t *testing.T, store *fakeRedundancyStore, nodeName string) RedundancyEvent {
+	t.Helper()
+	events := store.eventsOf(nodeName)
+	if len(events) == 0 {
+		t.Fatalf("no events of node %s", nodeName)
+	}
+	return events[len(events)-1]
+}
+
+func TestRedundancyAcquire(t *testing.T) {
+	store := newFakeRedundancyStore(newFakeClock(), "A", "B")
+	a, b := newTestNode(t, store, "A"), newTestNode(t, store, "B")
+
+	processNodes(t, a, b)
+	if !a.active || b.active {
+		t.Fatalf("want A active and B standby, got A=%v B=%v", a.active, b.active)
+	}
+	if a.epoch != 1 || store.get().ActiveNodeName != "A" {
+		t.Errorf("lease not acquired by A: %+v", store.get())
+	}
+	if s := store.status["B"]; s.Role != "standby" || s.ActiveNodeName != "A" {
+		t.Errorf("status of B: %+v", s)
+	}
+
+	// renewals keep the lease and the epoch
+	for i := 0; i < 10; i++ {
+		store.clock.Advance(a.renewInterval())
+		processNodes(t, a, b)
+	}
+	if !a.active || b.active || a.epoch != 1 {
+		t.Errorf("roles changed while renewing: A=%v B=%v epoch %d", a.active, b.active, a.epoch)
+	}
+}
+
+func TestRedundancyFailover(t *testing.T) {
+	store := newFakeRedundancyStore(newFakeClock(), "A", "B")
+	a, b := newTestNode(t, store, "A"), newTestNode(t, store, "B")
+	processNodes(t, a, b)
+
+	// A stops renewing, B (rank 1) waits one renew interval after the lease expiration
+	store.clock.Advance(a.leaseDuration + time.Second)
+	processNodes(t, b)
+	if b.active {
+		t.Fatal("B took over before its rank delay")
+	}
+	store.clock.Advance(b.renewInterval())
+	processNodes(t, b)
+	if !b.active || b.epoch <= 1 {
+		t.Fatalf("B did not take over with a new epoch: active=%v epoch %d", b.active, b.epoch)
+	}
+	if e := lastEvent(t, store, "B"); e.Event != "activated" || e.PreviousActiveNodeName != "A" || e.ActiveNodeEpoch != b.epoch {
+		t.Errorf("activation event of B: %+v", e)
+	}
+
+	// A comes back with a stale lease, it must deactivate and stay standby
+	processNodes(t, a)
+	if a.active || a.epoch != 0 {
+		t.Errorf("stale node still active: epoch %d", a.epoch)
+	}
+	if e := lastEvent(t, store, "A"); e.Event != "deactivated" {
+		t.Errorf("deactivation event of A: %+v", e)
+	}
+}
+
+func TestRedundancySelfFencing(t *testing.T) {
+	store := newFakeRedundancyStore(newFakeClock(), "A", "B")
+	a := newTestNode(t, store, "A")
+	processNodes(t, a)
+
+	// store unreachable, the active node must deactivate by itself when its lease expires
+	store.setDown(true)
+	store.clock.Advance(a.renewInterval())
+	processNodes(t, a)
+	if !a.active {
+		t.Fatal("deactivated before the lease expiration")
+	}
+	store.clock.Advance(a.leaseDuration)
+	processNodes(t, a)
+	if a.active {
+		t.Fatal("still active after the lease expiration")
+	}
+
+	// events are kept until the store is reachable again
+	store.setDown(false)
+	a.publishStatus()
+	if e := lastEvent(t, store, "A"); e.Event != "deactivated" || e.Reason != "lease expired without renew" {
+		t.Errorf("deactivation event: %+v", e)
+	}
+}
+
+func TestRedundancySwitchover(t *testing.T) {
+	store := newFakeRedundancyStore(newFakeClock(), "A", "B")
+	a, b := newTestNode(t, store, "A"), newTestNode(t, store, "B")
+	processNodes(t, a, b)
+	epoch := a.epoch
+
+	store.update(func(instance *ProtocolDriverInstance) { instance.SwitchoverToNodeName = "B" })
+	processNodes(t, a, b)
+	if a.active || !b.active {
+		t.Fatalf("switchover not done: A=%v B=%v", a.active, b.active)
+	}
+	if b.epoch <= epoch {
+		t.Errorf("epoch not incremented on switchover: %d", b.epoch)
+	}
+	if instance := store.get(); instance.SwitchoverToNodeName != "" || instance.HandoverFromNodeName != "" {
+		t.Errorf("switchover request not cleared: %+v", instance)
+	}
+	if e := lastEvent(t, store, "B"); !strings.Contains(e.Reason, "handed over by node 'A'") {
+		t.Errorf("activation reason: %s", e.Reason)
+	}
+}
+
+func TestRedundancyPinned(t *testing.T) {
+	store := newFakeRedundancyStore(newFakeClock(), "A", "B")
+	a, b := newTestNode(t, store, "A"), newTestNode(t, store, "B")
+	processNodes(t, a, b)
+
+	store.update(func(instance *ProtocolDriverInstance) { instance.PinnedNodeName = "B" })
+	processNodes(t, a, b)
+	if a.active || !b.active {
+		t.Fatalf("not moved to pinned node: A=%v B=%v", a.active, b.active)
+	}
+
+	// the pinned node fails, other nodes must not take over
+	store.clock.Advance(3 * a.leaseDuration)
+	processNodes(t, a)
+	if a.active {
+		t.Error("node took over an instance pinned to other node")
+	}
+}
+
+func TestRedundancyRelease(t *testing.T) {
+	store := newFakeRedundancyStore(newFakeClock(), "A", "B")
+	a, b := newTestNode(t, store, "A"), newTestNode(t, store, "B")
+	processNodes(t, a, b)
+
+	a.Release()
+	if a.active || store.get().ActiveNodeName != "" {
+		t.Fatalf("lease not released: %+v", store.get())
+	}
+	if s := store.status["A"]; s.Role != "standby" || s.LastTransitionReason != "driver shutdown" {
+		t.Errorf("status of A: %+v", s)
+	}
+
+	// no need to wait for the lease duration, only the rank delay
+	store.clock.Advance(b.renewInterval() + time.Second)
+	processNodes(t, b)
+	if !b.active {
+		t.Error("B did not take over a released lease")
+	}
+}
+
+func TestRedundancyUnknownNode(t *testing.T) {
+	store := newFakeRedundancyStore(newFakeClock(), "A", "B")
+	c := newTestNode(t, store, "C")
+	if err := c.process(); err == nil {
+		t.Error("node not in the instance list accepted")
+	}
+}
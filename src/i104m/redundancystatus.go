@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const NodesStatusCollectionName = "protocolDriverNodesStatus"
+const RedundancyEventsCollectionName = "protocolDriverRedundancyEvents"
+
+// Redundancy transition recorded in the events (history) collection
+type RedundancyEvent struct {
+	ProtocolDriver               string    `bson:"protocolDriver"`
+	ProtocolDriverInstanceNumber int       `bson:"protocolDriverInstanceNumber"`
+	NodeName                     string    `bson:"nodeName"`
+	Event                        string    `bson:"event"` // "started", "activated" or "deactivated"
+	Reason                       string    `bson:"reason"`
+	PreviousActiveNodeName       string    `bson:"previousActiveNodeName"`
+	ActiveNodeEpoch              int64     `bson:"activeNodeEpoch"`
+	TimeTag                      time.Time `bson:"timeTag"`
+}
+
+// Status (heartbeat) of a node, upserted on the nodes status collection
+type NodeStatus struct {
+	ProtocolDriver               string    `bson:"protocolDriver"`
+	ProtocolDriverInstanceNumber int       `bson:"protocolDriverInstanceNumber"`
+	NodeName                     string    `bson:"nodeName"`
+	Role                         string    `bson:"role"` // "active" or "standby"
+	ActiveNodeName               string    `bson:"activeNodeName"`
+	ActiveNodeEpoch              int64     `bson:"activeNodeEpoch"`
+	LeaseDuration                float64   `bson:"leaseDuration"` // seconds
+	LastTransitionTimeTag        time.Time `bson:"lastTransitionTimeTag"`
+	LastTransitionReason         string    `bson:"lastTransitionReason"`
+	Version                      string    `bson:"version"`
+}
+
+// record a role transition, events are kept in memory until written (mongodb may be unreachable when it happens)
+func (r *Redundancy) recordEvent(event string, reason string, previousActiveNodeName string) {
+	r.lastTransitionTimeTag = r.now()
+	r.lastTransitionReason = reason
+	r.pendingEvents = append(r.pendingEvents, RedundancyEvent{
+		ProtocolDriver:               r.protocolDriver,
+		ProtocolDriverInstanceNumber: r.protocolDriverInstanceNumber,
+		NodeName:                     r.nodeName,
+		Event:                        event,
+		Reason:                       reason,
+		PreviousActiveNodeName:       previousActiveNodeName,
+		ActiveNodeEpoch:              r.epoch,
+		TimeTag:                      r.lastTransitionTimeTag,
+	})
+}
+
+func (r *Redundancy) role() string {
+	if r.active {
+		return "active"
+	}
+	return "standby"
+}
+
+// write pending transition events and upsert the status (heartbeat) of this node
+func (r *Redundancy) publishStatus() {
+	ctx, cancel := context.WithTimeout(context.Background(), r.renewInterval())
+	defer cancel()
+
+	for len(r.pendingEvents) > 0 {
+		if err := r.store.InsertEvent(ctx, r.pendingEvents[0]); err != nil {
+			log.Println("Redundancy - Error writing event: ", err)
+			break
+		}
+		r.pendingEvents = r.pendingEvents[1:]
+	}
+
+	err := r.store.UpdateNodeStatus(ctx, NodeStatus{
+		ProtocolDriver:               r.protocolDriver,
+		ProtocolDriverInstanceNumber: r.protocolDriverInstanceNumber,
+		NodeName:                     r.nodeName,
+		Role:                         r.role(),
+		ActiveNodeName:               r.observedActiveNodeName,
+		ActiveNodeEpoch:              r.epoch,
+		LeaseDuration:                r.leaseDuration.Seconds(),
+		LastTransitionTimeTag:        r.lastTransitionTimeTag,
+		LastTransitionReason:         r.lastTransitionReason,
+		Version:                      Version,
+	})
+	if err != nil {
+		log.Println("Redundancy - Error writing node status: ", err)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+// convert an analog value at source to engineering units using the point definition:
+// value * protocolSourceScale + protocolSourceOffset, limited to protocolSourceMin..protocolSourceMax
+// (overflow is flagged when the limit is applied). Digitals and points without conversion are not changed.
+func (upd PointUpdate) scaled(def *PointDef) PointUpdate {
+	if def == nil || isDigitalAsdu(upd.Asdu) {
+		return upd
+	}
+	if def.ProtocolSourceScale != nil {
+		upd.Value *= *def.ProtocolSourceScale
+	}
+	if def.ProtocolSourceOffset != nil {
+		upd.Value += *def.ProtocolSourceOffset
+	}
+	if def.ProtocolSourceMin != nil && upd.Value < *def.ProtocolSourceMin {
+		upd.Value = *def.ProtocolSourceMin
+		upd.Overflow = true
+	}
+	if def.ProtocolSourceMax != nil && upd.Value > *def.ProtocolSourceMax {
+		upd.Value = *def.ProtocolSourceMax
+		upd.Overflow = true
+	}
+	return upd
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"i104mproto"
+)
+
+// linear conversion and limits of analog values at ingest
+func TestScaled(t *testing.T) {
+	tests := []struct {
+		name     string
+		asdu     uint32
+		value    float64
+		def      *PointDef
+		want     float64
+		overflow bool
+	}{
+		{"no definition", 13, 12.5, nil, 12.5, false},
+		{"no conversion", 13, 12.5, &PointDef{}, 12.5, false},
+		{"scale", 9, 0.5, &PointDef{ProtocolSourceScale: float64Ptr(500)}, 250, false},
+		{"offset", 11, 100, &PointDef{ProtocolSourceOffset: float64Ptr(-20)}, 80, false},
+		{"scale then offset", 11, 10, &PointDef{ProtocolSourceScale: float64Ptr(2), ProtocolSourceOffset: float64Ptr(5)}, 25, false},
+		{"inside limits", 13, 10, &PointDef{ProtocolSourceMin: float64Ptr(-10), ProtocolSourceMax: float64Ptr(10)}, 10, false},
+		{"above max", 13, 10.5, &PointDef{ProtocolSourceMin: float64Ptr(-10), ProtocolSourceMax: float64Ptr(10)}, 10, true},
+		{"below min", 13, -11, &PointDef{ProtocolSourceMin: float64Ptr(-10), ProtocolSourceMax: float64Ptr(10)}, -10, true},
+		{"limits after conversion", 9, -1, &PointDef{ProtocolSourceScale: float64Ptr(500), ProtocolSourceMin: float64Ptr(-400)}, -400, true},
+		{"digital not converted", 1, 1, &PointDef{ProtocolSourceScale: float64Ptr(500), ProtocolSourceOffset: float64Ptr(3), ProtocolSourceMax: float64Ptr(0)}, 1, false},
+		{"double point not converted", 31, 1, &PointDef{ProtocolSourceScale: float64Ptr(-1)}, 1, false},
+	}
+	for _, tt := range tests {
+		upd := PointUpdate{Asdu: tt.asdu, Value: tt.value}.scaled(tt.def)
+		if upd.Value != tt.want || upd.Overflow != tt.overflow {
+			t.Errorf("%s: got value=%g overflow=%v, want value=%g overflow=%v", tt.name, upd.Value, upd.Overflow, tt.want, tt.overflow)
+		}
+	}
+
+	// the overflow flag at source is kept when no limit is applied
+	upd := PointUpdate{Asdu: 13, Value: 1, Overflow: true}.scaled(&PointDef{ProtocolSourceMax: float64Ptr(10)})
+	if !upd.Overflow {
+		t.Error("overflow flag at source lost")
+	}
+}
+
+// normalized values (ASDUs 9/34) are decoded as the fraction of full scale
+func TestNormalizedValue(t *testing.T) {
+	protCon := &ProtocolConnection{sourceLocation: time.UTC}
+	parse := func(asdu uint32, info []byte) PointUpdate {
+		t.Helper()
+		upd, ok := i104mParseObj(info, 1, asdu, decodeCOT(COT_SPONTANEOUS), protCon)
+		if !ok {
+			t.Fatalf("ASDU %d not decoded", asdu)
+		}
+		return upd
+	}
+
+	tests := []struct {
+		info []byte
+		want float64
+	}{
+		{[]byte{0x00, 0x00, 0x00}, 0},
+		{[]byte{0x00, 0x40, 0x00}, 0.5},
+		{[]byte{0x00, 0xC0, 0x00}, -0.5},
+		{[]byte{0x00, 0x80, 0x00}, -1},
+		{[]byte{0xFF, 0x7F, 0x00}, 1 - 1.0/i104mproto.NormalizedFullScale},
+	}
+	for _, asdu := range []uint32{9, 11} {
+		for _, tt := range tests {
+			upd := parse(asdu, tt.info)
+			want := tt.want
+			if asdu == 11 { // scaled values are the integer at source
+				want = tt.want * i104mproto.NormalizedFullScale
+			}
+			if upd.Value != want {
+				t.Errorf("ASDU %d % X: got %g, want %g", asdu, tt.info, upd.Value, want)
+			}
+		}
+	}
+
+	// a converted normalized value: full scale 500 MW
+	upd := parse(9, []byte{0x00, 0x40, 0x00}).scaled(&PointDef{ProtocolSourceScale: float64Ptr(500)})
+	if upd.Value != 250 {
+		t.Errorf("converted normalized value: got %g, want 250", upd.Value)
+	}
+
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"i104mproto"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Server (outstation) mode: realtimeData points with a protocol destination for the connection are sent to the
+// I104M peers (OSHMI consumers), command frames received from the peers are inserted in commandsQueue.
+const ServerDriverName = "I104M_SERVER"
+
+const ServerSendInterval = 200 * time.Millisecond
+const ServerMaxObjectsPerPacket = 100 // up to 16 bytes each, keeps packets under the 2048 bytes buffer of receivers
+const ServerQueueSize = 10000
+
+// Protocol destination of a point (same fields as the IEC104 server)
+type ProtocolDestination struct {
+	ConnectionNumber float64  `bson:"protocolDestinationConnectionNumber"`
+	CommonAddress    float64  `bson:"protocolDestinationCommonAddress"`
+	ObjectAddress    float64  `bson:"protocolDestinationObjectAddress"`
+	ASDU             float64  `bson:"protocolDestinationASDU"`
+	CommandDuration  float64  `bson:"protocolDestinationCommandDuration"`
+	CommandUseSBO    bool     `bson:"protocolDestinationCommandUseSBO"`
+	KConv1           *float64 `bson:"protocolDestinationKConv1"`
+	KConv2           *float64 `bson:"protocolDestinationKConv2"`
+	HoursShift       float64  `bson:"protocolDestinationHoursShift"`
+}
+
+// realtimeData fields used by the server mode
+type ServerPoint struct {
+	Id                             float64               `bson:"_id"`
+	Tag                            string                `bson:"tag"`
+	Type                           string                `bson:"type"`
+	Value                          float64               `bson:"value"`
+	Invalid                        bool                  `bson:"invalid"`
+	Substituted                    bool                  `bson:"substituted"`
+	Transient                      bool                  `bson:"transient"`
+	Overflow                       bool                  `bson:"overflow"`
+	TimeTag                        *time.Time            `bson:"timeTag"`
+	TimeTagAtSource                *time.Time            `bson:"timeTagAtSource"`
+	TimeTagAtSourceOk              bool                  `bson:"timeTagAtSourceOk"`
+	Kconv1                         *float64              `bson:"kconv1"`
+	Kconv2                         *float64              `bson:"kconv2"`
+	ProtocolSourceConnectionNumber float64               `bson:"protocolSourceConnectionNumber"`
+	ProtocolSourceCommonAddress    float64               `bson:"protocolSourceCommonAddress"`
+	ProtocolSourceObjectAddress    float64               `bson:"protocolSourceObjectAddress"`
+	ProtocolSourceASDU             float64               `bson:"protocolSourceASDU"`
+	ProtocolSourceCommandDuration  float64               `bson:"protocolSourceCommandDuration"`
+	ProtocolSourceCommandUseSBO    bool                  `bson:"protocolSourceCommandUseSBO"`
+	ProtocolDestinations           []ProtocolDestination `bson:"protocolDestinations"`
+}
+
+// Command received from a peer, inserted in commandsQueue for the source connection of the point
+type ServerCommand struct {
+	ProtocolSourceConnectionNumber float64   `bson:"protocolSourceConnectionNumber"`
+	ProtocolSourceCommonAddress    float64   `bson:"protocolSourceCommonAddress"`
+	ProtocolSourceObjectAddress    float64   `bson:"protocolSourceObjectAddress"`
+	ProtocolSourceASDU             float64   `bson:"protocolSourceASDU"`
+	ProtocolSourceCommandDuration  float64   `bson:"protocolSourceCommandDuration"`
+	ProtocolSourceCommandUseSBO    bool      `bson:"protocolSourceCommandUseSBO"`
+	PointKey                       float64   `bson:"pointKey"`
+	Tag                            string    `bson:"tag"`
+	TimeTag                        time.Time `bson:"timeTag"`
+	Value                          float64   `bson:"value"`
+	ValueString                    string    `bson:"valueString"`
+	OriginatorUserName             string    `bson:"originatorUserName"`
+	OriginatorIpAddress            string    `bson:"originatorIpAddress"`
+}
+
+// Destination of the commands received from the peers (commandsQueue)
+type CommandQueue interface {
+	InsertCommand(ctx context.Context, cmd ServerCommand) error
+}
+
+type mongoCommandQueue struct {
+	collection *mongo.Collection
+}
+
+func (q *mongoCommandQueue) InsertCommand(ctx context.Context, cmd ServerCommand) error {
+	_, err := q.collection.InsertOne(ctx, cmd)
+	return err
+}
+
+type realtimeDataChange struct {
+	OperationType string      `bson:"operationType"`
+	FullDocument  ServerPoint `bson:"fullDocument"`
+}
+
+type Server struct {
+	protCon    *ProtocolConnection
+	collection *mongo.Collection
+	commands   CommandQueue
+	stream     *mongo.ChangeStream
+	mutex      sync.Mutex
+	points     map[float64]*ServerPoint // points distributed on the connection by _id
+	pending    []*ServerPoint           // changes to send
+}
+
+// start watching realtimeData and load the points distributed on the connection
+func NewServer(ctx context.Context, protCon *ProtocolConnection, collection *mongo.Collection, collectionCommands *mongo.Collection) (*Server, error) {
+	s := &Server{protCon: protCon, collection: collection, commands: &mongoCommandQueue{collection: collectionCommands}, points: map[float64]*ServerPoint{}}
+
+	// watch before loading so no change is lost. Updates with sourceDataUpdate are processed by cs_data_processor,
+	// which then updates the value.
+	var err error
+	s.stream, err = collection.Watch(ctx, mongo.Pipeline{bson.D{{"$match", bson.D{{"$or", bson.A{
+		bson.D{{"operationType", "update"}, {"updateDescription.updatedFields.sourceDataUpdate", bson.D{{"$exists", false}}}},
+		bson.D{{"operationType", "replace"}},
+		bson.D{{"operationType", "insert"}},
+	}}}}}}, options.ChangeStream().SetFullDocument(options.UpdateLookup))
+	if err != nil {
+		return nil, err
+	}
+
+	cur, err := collection.Find(ctx, bson.D{{"protocolDestinations.protocolDestinationConnectionNumber", protCon.ProtocolConnectionNumber}})
+	if err != nil {
+		s.stream.Close(context.Background())
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		p := &ServerPoint{}
+		if err := cur.Decode(p); err != nil {
+			log.Println("Point decode error: ", err)
+			continue
+		}
+		s.points[p.Id] = p
+	}
+	if err := cur.Err(); err != nil {
+		s.stream.Close(context.Background())
+		return nil, err
+	}
+	log.Printf("Points distributed: %d", len(s.points))
+	return s, nil
+}
+
+// destinations of the point on the connection
+func (p *ServerPoint) destinations(connectionNumber int) []ProtocolDestination {
+	var dests []ProtocolDestination
+	for _, d := range p.ProtocolDestinations {
+		if int(d.ConnectionNumber) == connectionNumber {
+			dests = append(dests, d)
+		}
+	}
+	return dests
+}
+
+// update points from the realtimeData change stream until the context is canceled
+func (s *Server) WatchChanges(ctx context.Context) error {
+	defer s.stream.Close(context.Background())
+	for s.stream.Next(ctx) {
+		var change realtimeDataChange
+		if err := s.stream.Decode(&change); err != nil {
+			log.Println(err)
+			continue
+		}
+		p := &change.FullDocument
+		s.mutex.Lock()
+		if len(p.destinations(s.protCon.ProtocolConnectionNumber)) == 0 {
+			delete(s.points, p.Id) // destination removed
+			s.mutex.Unlock()
+			continue
+		}
+		s.points[p.Id] = p
+		if isActive() {
+			if len(s.pending) < ServerQueueSize {
+				s.pending = append(s.pending, p)
+			} else {
+				log.Println("Server queue full. Discarding change of ", p.Tag)
+			}
+		}
+		s.mutex.Unlock()
+		if LogLevel >= LogLevelDetailed {
+			log.Printf("Change %s %f", p.Tag, p.Value)
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return fmt.Errorf("realtimeData change stream closed: %v", s.stream.Err())
+}
+
+// send changes while active and all points (integrity) on activation and every giInterval seconds
+func (s *Server) Run(ctx context.Context) error {
+	wasActive := false
+	var lastIntegrity time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(ServerSendInterval):
+		}
+
+		if !isActive() {
+			wasActive = false
+			continue
+		}
+		if !wasActive || (s.protCon.GiInterval > 0 && time.Since(lastIntegrity) > time.Duration(s.protCon.GiInterval)*time.Second) {
+			wasActive = true
+			lastIntegrity = time.Now()
+			s.sendIntegrity(COT_INTERROGATED_BY_STATION)
+			continue
+		}
+
+		s.mutex.Lock()
+		pending := s.pending
+		s.pending = nil
+		s.mutex.Unlock()
+		s.sendPoints(pending, COT_SPONTANEOUS)
+	}
+}
+
+// send all points, pending changes are included
+func (s *Server) sendIntegrity(cause uint32) {
+	s.mutex.Lock()
+	points := make([]*ServerPoint, 0, len(s.points))
+	for _, p := range s.points {
+		points = append(points, p)
+	}
+	s.pending = nil
+	s.mutex.Unlock()
+	log.Printf("Sending %d points as integrity", len(points))
+	s.sendPoints(points, cause)
+}
+
+// send points grouped in sequence packets by ASDU and common address
+func (s *Server) sendPoints(points []*ServerPoint, cause uint32) {
+	type group struct {
+		asdu, ca, count uint32
+		objects         []byte
+	}
+	var groups []*group
+	index := map[[2]uint32]*group{}
+	send := func(g *group) {
+		if g.count == 0 {
+			return
+		}
+		ok, err_msg := i104mSendToPeers(s.protCon, i104mproto.SequencePacket(g.count, g.asdu, g.ca, cause, g.objects))
+		if !ok && LogLevel >= LogLevelDetailed {
+			log.Println("Can not send packet: ", err_msg)
+		}
+		g.count, g.objects = 0, nil
+	}
+
+	for _, p := range points {
+		for _, d := range p.destinations(s.protCon.ProtocolConnectionNumber) {
+			upd, ok := serverPointUpdate(p, d, cause == COT_SPONTANEOUS)
+			if !ok {
+				continue
+			}
+			info, ok := upd.encode(s.protCon.sourceLocation)
+			if !ok {
+				continue
+			}
+			key := [2]uint32{upd.Asdu, uint32(d.CommonAddress)}
+			g, found := index[key]
+			if !found {
+				g = &group{asdu: upd.Asdu, ca: uint32(d.CommonAddress)}
+				index[key] = g
+				groups = append(groups, g)
+			}
+			var addr [4]byte
+			binary.LittleEndian.PutUint32(addr[:], upd.ObjAddr)
+			g.objects = append(append(g.objects, addr[:]...), info...)
+			g.count++
+			if g.count >= ServerMaxObjectsPerPacket {
+				send(g)
+			}
+		}
+	}
+	for _, g := range groups {
+		send(g)
+	}
+}
+
+// convert a point to the object of a destination. The ASDU is chosen by the point type when the destination has none:
+// 30/36 for changes with source time tag, 1/13 otherwise.
+func serverPointUpdate(p *ServerPoint, d ProtocolDestination, spontaneous bool) (upd PointUpdate, ok bool) {
+	hasSourceTime := p.TimeTagAtSource != nil && !p.TimeTagAtSource.IsZero()
+	asdu := uint32(d.ASDU)
+	if asdu == 0 {
+		switch p.Type {
+		case "digital":
+			asdu = 1
+			if spontaneous && hasSourceTime {
+				asdu = 30
+			}
+		case "analog":
+			asdu = 13
+			if spontaneous && hasSourceTime {
+				asdu = 36
+			}
+		default:
+			return upd, false
+		}
+	}
+
+	k1, k2 := 1.0, 0.0
+	if d.KConv1 != nil {
+		k1 = *d.KConv1
+	}
+	if d.KConv2 != nil {
+		k2 = *d.KConv2
+	}
+	value := p.Value*k1 + k2
+	if p.Type == "digital" {
+		value = p.Value
+		if k1 == -1 { // invert digital for kconv1 -1
+			value = float64(boolToInt(p.Value == 0))
+		}
+	}
+
+	upd = PointUpdate{
+		ObjAddr:     uint32(d.ObjectAddress),
+		Asdu:        asdu,
+		Value:       value,
+		Invalid:     p.Invalid || (p.Transient && asdu != 3 && asdu != 4 && asdu != 31),
+		Substituted: p.Substituted,
+		Overflow:    p.Overflow,
+		Transient:   p.Transient,
+	}
+	if hasSourceTime {
+		upd.HasTime, upd.TimeTag, upd.TimeTagOk = true, p.TimeTagAtSource.Add(time.Duration(d.HoursShift*float64(time.Hour))), p.TimeTagAtSourceOk
+	} else if p.TimeTag != nil {
+		upd.HasTime, upd.TimeTag, upd.TimeTagOk = true, *p.TimeTag, true
+	}
+	return upd, true
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// handle a command frame received from a peer: interrogation, clock sync or a command to be inserted in commandsQueue.
+// Frames are answered with activation confirmation (positive or negative), only by the active node.
+func (s *Server) HandleFrame(packet ReceivedPacket) {
+	frame, ok := i104mproto.ParseCommandFrame(packet.Data)
+	if !ok {
+		if LogLevel >= LogLevelDebug {
+			log.Printf("Ignored packet with %d bytes from %s", len(packet.Data), packet.From)
+		}
+		return
+	}
+	addr, tiType, value, sbo, qu, ca := frame.Addr, frame.TiType, frame.Value, frame.Sbo, frame.Qu, frame.Ca
+	log.Printf("Command frame from %s: address %d type %d value %d sbo %d qu %d ca %d", packet.From, addr, tiType, value, sbo, qu, ca)
+	if !isActive() {
+		return
+	}
+
+	switch tiType {
+	case C_IC_NA_1:
+		s.confirm(addr, tiType, value, ca, COT_ACTIVATION_CON)
+		s.sendIntegrity(COT_INTERROGATED_BY_STATION)
+		s.confirm(addr, tiType, value, ca, COT_ACTIVATION_TERMINATION)
+	case C_CI_NA_1, C_CS_NA_1: // no counters, time is not set by peers
+		s.confirm(addr, tiType, value, ca, COT_ACTIVATION_CON)
+	default:
+		cause := uint32(COT_ACTIVATION_CON)
+		if !s.command(addr, tiType, float64(value), qu, ca, packet.From) {
+			cause |= 0x40 // negative
+		}
+		s.confirm(addr, tiType, value, ca, cause)
+	}
+}
+
+func (s *Server) confirm(addr uint32, tiType uint32, value uint32, ca uint32, cause uint32) {
+	if ok, err_msg := i104mSendToPeers(s.protCon, i104mproto.SinglePacket(addr, tiType, ca, cause, []byte{byte(value)})); !ok {
+		log.Println("Can not send confirmation: ", err_msg)
+	}
+}
+
+// forward a command to the source connection of the point via commandsQueue, false if rejected
+func (s *Server) command(addr uint32, tiType uint32, value float64, qu uint32, ca uint32, from string) bool {
+	if !s.protCon.CommandsEnabled {
+		log.Println("Commands disabled on connection, command rejected!")
+		return false
+	}
+
+	var point ServerPoint
+	var dest ProtocolDestination
+	found := false
+	s.mutex.Lock()
+	for _, p := range s.points {
+		for _, d := range p.destinations(s.protCon.ProtocolConnectionNumber) {
+			if uint32(d.ObjectAddress) == addr && uint32(d.ASDU) == tiType && uint32(d.CommonAddress) == ca {
+				point, dest, found = *p, d, true
+			}
+		}
+	}
+	s.mutex.Unlock()
+
+	if !found {
+		log.Println("Command not found!")
+		return false
+	}
+	if point.ProtocolSourceASDU == 0 {
+		log.Println("Command rejected, no protocol source for ", point.Tag)
+		return false
+	}
+	if qu != uint32(dest.CommandDuration) {
+		log.Printf("Command qualifier not expected: %d, %d wanted", qu, uint32(dest.CommandDuration))
+		return false
+	}
+
+	// as the IEC 104 server: the destination factors convert the peer value to engineering units,
+	// then the factors of the command point convert it to the value for the source connection
+	value = convertCommandValue(tiType, value, dest.KConv1, dest.KConv2)
+	value = convertCommandValue(uint32(point.ProtocolSourceASDU), value, point.Kconv1, point.Kconv2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := s.commands.InsertCommand(ctx, ServerCommand{
+		ProtocolSourceConnectionNumber: point.ProtocolSourceConnectionNumber,
+		ProtocolSourceCommonAddress:    point.ProtocolSourceCommonAddress,
+		ProtocolSourceObjectAddress:    point.ProtocolSourceObjectAddress,
+		ProtocolSourceASDU:             point.ProtocolSourceASDU,
+		ProtocolSourceCommandDuration:  point.ProtocolSourceCommandDuration,
+		ProtocolSourceCommandUseSBO:    point.ProtocolSourceCommandUseSBO,
+		PointKey:                       point.Id,
+		Tag:                            point.Tag,
+		TimeTag:                        time.Now(),
+		Value:                          value,
+		ValueString:                    fmt.Sprint(value),
+		OriginatorUserName:             "Protocol connection: " + s.protCon.Name,
+		OriginatorIpAddress:            from,
+	})
+	if err != nil {
+		log.Println("Can not insert command: ", err)
+		return false
+	}
+	log.Printf("Command %s %g forwarded to connection %d", point.Tag, value, int(point.ProtocolSourceConnectionNumber))
+	return true
+}
+
+// apply conversion factors to a command value, digital commands are inverted for kconv1 -1
+func convertCommandValue(tiType uint32, value float64, kconv1 *float64, kconv2 *float64) float64 {
+	k1, k2 := 1.0, 0.0
+	if kconv1 != nil {
+		k1 = *kconv1
+	}
+	if kconv2 != nil {
+		k2 = *kconv2
+	}
+	switch tiType {
+	case 45, 46, 47, 58, 59, 60: // single, double and step commands
+		if k1 == -1 {
+			return float64(boolToInt(value == 0))
+		}
+		return value
+	}
+	return value*k1 + k2
+}
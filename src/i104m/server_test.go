@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"i104mproto"
+)
+
+// encode and decode an object of each supported ASDU
+func TestEncodeParseRoundTrip(t *testing.T) {
+	protCon := &ProtocolConnection{sourceLocation: time.UTC}
+	if err := protCon.QualityProfile.validate(); err != nil {
+		t.Fatal(err)
+	}
+	// CP24Time2a is completed with the current hour
+	t0 := time.Now().UTC().Truncate(time.Millisecond)
+	tests := []struct {
+		upd  PointUpdate
+		want float64
+	}{
+		{PointUpdate{Asdu: 1, Value: 1}, 1},
+		{PointUpdate{Asdu: 1, Value: 0, Invalid: true}, 0},
+		{PointUpdate{Asdu: 2, Value: 1, HasTime: true, TimeTag: t0, TimeTagOk: true}, 1},
+		{PointUpdate{Asdu: 30, Value: 1, Substituted: true, HasTime: true, TimeTag: t0, TimeTagOk: true}, 1},
+		{PointUpdate{Asdu: 3, Value: 1}, 1},
+		{PointUpdate{Asdu: 3, Value: 0, Blocked: true}, 0},
+		{PointUpdate{Asdu: 3, Transient: true}, 0},
+		{PointUpdate{Asdu: 4, Value: 0, HasTime: true, TimeTag: t0, TimeTagOk: true}, 0},
+		{PointUpdate{Asdu: 31, Value: 1, NotTopical: true, HasTime: true, TimeTag: t0, TimeTagOk: false}, 1},
+		{PointUpdate{Asdu: 5, Value: 17}, 17},
+		{PointUpdate{Asdu: 32, Value: 63, HasTime: true, TimeTag: t0}, 63},
+		{PointUpdate{Asdu: 9, Value: 0.5}, 0.5},
+		{PointUpdate{Asdu: 9, Value: -1}, -1},
+		{PointUpdate{Asdu: 34, Value: 0.25, Overflow: true, HasTime: true, TimeTag: t0}, 0.25},
+		{PointUpdate{Asdu: 11, Value: -1234}, -1234},
+		{PointUpdate{Asdu: 11, Value: 40000, Overflow: true}, 32767}, // limited to int16
+		{PointUpdate{Asdu: 35, Value: 1000, HasTime: true, TimeTag: t0}, 1000},
+		{PointUpdate{Asdu: 13, Value: 230.5}, 230.5},
+		{PointUpdate{Asdu: 36, Value: -0.125, Invalid: true, HasTime: true, TimeTag: t0}, -0.125},
+	}
+	for _, test := range tests {
+		info, ok := test.upd.encode(time.UTC)
+		if !ok {
+			t.Errorf("asdu %d not encoded", test.upd.Asdu)
+			continue
+		}
+		if size, _ := i104mproto.ObjectSize(test.upd.Asdu); uint32(len(info)) != size-4 {
+			t.Errorf("asdu %d: %d bytes, want %d", test.upd.Asdu, len(info), size-4)
+		}
+		got, ok := i104mParseObj(info, 1001, test.upd.Asdu, decodeCOT(COT_SPONTANEOUS), protCon)
+		if !ok {
+			t.Errorf("asdu %d not decoded", test.upd.Asdu)
+			continue
+		}
+		if got.Value != test.want {
+			t.Errorf("asdu %d: value %g, want %g", test.upd.Asdu, got.Value, test.want)
+		}
+		if got.Invalid != test.upd.Invalid || got.NotTopical != test.upd.NotTopical || got.Substituted != test.upd.Substituted ||
+			got.Blocked != test.upd.Blocked || got.Overflow != test.upd.Overflow || got.Transient != test.upd.Transient {
+			t.Errorf("asdu %d: quality %+v, want %+v", test.upd.Asdu, got, test.upd)
+		}
+		if test.upd.HasTime {
+			if !got.HasTime || !got.TimeTag.Equal(test.upd.TimeTag) || got.TimeTagOk != test.upd.TimeTagOk {
+				t.Errorf("asdu %d: time %v %v, want %v %v", test.upd.Asdu, got.TimeTag, got.TimeTagOk, test.upd.TimeTag, test.upd.TimeTagOk)
+			}
+		}
+	}
+
+	if _, ok := (PointUpdate{Asdu: 15}).encode(time.UTC); ok {
+		t.Error("unsupported asdu encoded")
+	}
+}
+
+// step positions (VTI) keep the sign of the 7 bit value and the transient bit
+func TestStepPositionRoundTrip(t *testing.T) {
+	protCon := &ProtocolConnection{sourceLocation: time.UTC}
+	if err := protCon.QualityProfile.validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, asdu := range []uint32{5, 32} {
+		for value := -64; value <= 63; value++ {
+			for _, transient := range []bool{false, true} {
+				upd := PointUpdate{Asdu: asdu, Value: float64(value), Transient: transient}
+				info, ok := upd.encode(time.UTC)
+				if !ok {
+					t.Fatalf("asdu %d not encoded", asdu)
+				}
+				got, ok := i104mParseObj(info, 1001, asdu, decodeCOT(COT_SPONTANEOUS), protCon)
+				if !ok || got.Value != float64(value) || got.Transient != transient {
+					t.Errorf("asdu %d value %d transient %v: decoded %g transient %v (% x)", asdu, value, transient, got.Value, got.Transient, info)
+				}
+			}
+		}
+	}
+
+	// values out of the VTI range are limited
+	for value, want := range map[float64]float64{64: 63, 1000: 63, -65: -64, -1000: -64} {
+		info, _ := (PointUpdate{Asdu: 5, Value: value}).encode(time.UTC)
+		if got, _ := i104mParseObj(info, 1001, 5, decodeCOT(COT_SPONTANEOUS), protCon); got.Value != want {
+			t.Errorf("value %g: decoded %g, want %g", value, got.Value, want)
+		}
+	}
+}
+
+func TestServerPointUpdate(t *testing.T) {
+	t0 := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	t1 := t0.Add(time.Minute)
+	digital := &ServerPoint{Type: "digital", Value: 1, TimeTag: &t1, TimeTagAtSource: &t0, TimeTagAtSourceOk: true}
+	analog := &ServerPoint{Type: "analog", Value: 10, TimeTag: &t1}
+	tests := []struct {
+		name        string
+		p           *ServerPoint
+		d           ProtocolDestination
+		spontaneous bool
+		want        PointUpdate
+	}{
+		{"digital change with source time", digital, ProtocolDestination{ObjectAddress: 1001}, true,
+			PointUpdate{ObjAddr: 1001, Asdu: 30, Value: 1, HasTime: true, TimeTag: t0, TimeTagOk: true}},
+		{"digital integrity", digital, ProtocolDestination{ObjectAddress: 1001}, false,
+			PointUpdate{ObjAddr: 1001, Asdu: 1, Value: 1, HasTime: true, TimeTag: t0, TimeTagOk: true}},
+		{"digital inverted, hours shift", digital, ProtocolDestination{ObjectAddress: 1001, ASDU: 31, KConv1: float64Ptr(-1), HoursShift: -3}, true,
+			PointUpdate{ObjAddr: 1001, Asdu: 31, Value: 0, HasTime: true, TimeTag: t0.Add(-3 * time.Hour), TimeTagOk: true}},
+		{"analog without source time", analog, ProtocolDestination{ObjectAddress: 2001}, true,
+			PointUpdate{ObjAddr: 2001, Asdu: 13, Value: 10, HasTime: true, TimeTag: t1, TimeTagOk: true}},
+		{"analog converted", analog, ProtocolDestination{ObjectAddress: 2001, ASDU: 11, KConv1: float64Ptr(2), KConv2: float64Ptr(5)}, true,
+			PointUpdate{ObjAddr: 2001, Asdu: 11, Value: 25, HasTime: true, TimeTag: t1, TimeTagOk: true}},
+		{"transient digital is invalid", &ServerPoint{Type: "digital", Transient: true}, ProtocolDestination{ObjectAddress: 1002}, false,
+			PointUpdate{ObjAddr: 1002, Asdu: 1, Invalid: true, Transient: true}},
+		{"transient double point", &ServerPoint{Type: "digital", Transient: true}, ProtocolDestination{ObjectAddress: 1002, ASDU: 3}, false,
+			PointUpdate{ObjAddr: 1002, Asdu: 3, Transient: true}},
+	}
+	for _, test := range tests {
+		got, ok := serverPointUpdate(test.p, test.d, test.spontaneous)
+		if !ok {
+			t.Errorf("%s: not converted", test.name)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+	if _, ok := serverPointUpdate(&ServerPoint{Type: "string"}, ProtocolDestination{}, false); ok {
+		t.Error("point without ASDU for its type converted")
+	}
+}
+
+func TestConvertCommandValue(t *testing.T) {
+	tests := []struct {
+		tiType uint32
+		value  float64
+		k1, k2 *float64
+		want   float64
+	}{
+		{45, 1, nil, nil, 1},
+		{45, 1, float64Ptr(-1), nil, 0},
+		{45, 0, float64Ptr(-1), nil, 1},
+		{46, 2, float64Ptr(5), float64Ptr(1), 2}, // digital values are not scaled
+		{58, 0, float64Ptr(-1), float64Ptr(3), 1},
+		{48, 100, float64Ptr(2), float64Ptr(-1), 199},
+		{50, 1.5, nil, float64Ptr(1), 2.5},
+		{63, 10, float64Ptr(0.5), nil, 5},
+	}
+	for _, test := range tests {
+		if got := convertCommandValue(test.tiType, test.value, test.k1, test.k2); got != test.want {
+			t.Errorf("type %d value %g: got %g, want %g", test.tiType, test.value, got, test.want)
+		}
+	}
+}
+
+// server with a setpoint (source connection 1, kconv1 10) and a double command distributed on connection 71
+func newTestServer(t *testing.T) (*Server, *fakeTransport, *fakeCommandQueue) {
+	t.Helper()
+	wasActive, wasEpoch := isActive(), ActiveNodeEpoch()
+	setActiveNode(true, 1)
+	t.Cleanup(func() { setActiveNode(wasActive, wasEpoch) })
+
+	transport := &fakeTransport{}
+	queue := &fakeCommandQueue{}
+	s := &Server{
+		protCon:  &ProtocolConnection{ProtocolConnectionNumber: 71, Name: "SRV", CommandsEnabled: true, sourceLocation: time.UTC, transport: transport},
+		commands: queue,
+		points: map[float64]*ServerPoint{
+			10: {Id: 10, Tag: "SETPOINT", Type: "analog", Value: 50, Kconv1: float64Ptr(10),
+				ProtocolSourceConnectionNumber: 1, ProtocolSourceCommonAddress: 7, ProtocolSourceObjectAddress: 5000, ProtocolSourceASDU: 50,
+				ProtocolDestinations: []ProtocolDestination{{ConnectionNumber: 71, CommonAddress: 1, ObjectAddress: 3000, ASDU: 50,
+					KConv1: float64Ptr(2), KConv2: float64Ptr(1)}}},
+			11: {Id: 11, Tag: "BRK", Type: "digital", Value: 1, Kconv1: float64Ptr(-1),
+				ProtocolSourceConnectionNumber: 1, ProtocolSourceCommonAddress: 7, ProtocolSourceObjectAddress: 6001, ProtocolSourceASDU: 45,
+				ProtocolSourceCommandDuration: 1, ProtocolSourceCommandUseSBO: true,
+				ProtocolDestinations: []ProtocolDestination{{ConnectionNumber: 71, CommonAddress: 1, ObjectAddress: 3001, ASDU: 45, CommandDuration: 1}}},
+		},
+	}
+	return s, transport, queue
+}
+
+func commandFrame(addr, tiType, value, sbo, qu, ca uint32) ReceivedPacket {
+	frame := make([]byte, 28)
+	for i, field := range []uint32{i104mproto.CommandSignature, addr, tiType, value, sbo, qu, ca} {
+		binary.LittleEndian.PutUint32(frame[4*i:], field)
+	}
+	return ReceivedPacket{Data: frame, From: "10.0.0.5"}
+}
+
+// cause of transmission of the confirmation (single packet) sent last
+func lastConfirmation(t *testing.T, transport *fakeTransport) (addr, tiType, cause uint32) {
+	t.Helper()
+	if len(transport.sent) == 0 {
+		t.Fatal("no confirmation sent")
+	}
+	frame := transport.sent[len(transport.sent)-1]
+	if binary.LittleEndian.Uint32(frame) != i104mproto.SingleSignature {
+		t.Fatalf("confirmation is not a single packet: % x", frame)
+	}
+	return binary.LittleEndian.Uint32(frame[4:]), binary.LittleEndian.Uint32(frame[8:]), binary.LittleEndian.Uint32(frame[20:])
+}
+
+func TestServerCommands(t *testing.T) {
+	s, transport, queue := newTestServer(t)
+
+	// setpoint: peer value * destination kconv + kconv2, then * kconv of the command point
+	s.HandleFrame(commandFrame(3000, 50, 5, 0, 0, 1))
+	if addr, tiType, cause := lastConfirmation(t, transport); addr != 3000 || tiType != 50 || cause != COT_ACTIVATION_CON {
+		t.Errorf("confirmation %d %d cause %d", addr, tiType, cause)
+	}
+	if len(queue.commands) != 1 {
+		t.Fatalf("want 1 command queued, got %d", len(queue.commands))
+	}
+	cmd := queue.commands[0]
+	if cmd.Value != 110 || cmd.ValueString != "110" || cmd.ProtocolSourceConnectionNumber != 1 || cmd.ProtocolSourceObjectAddress != 5000 ||
+		cmd.ProtocolSourceASDU != 50 || cmd.ProtocolSourceCommonAddress != 7 || cmd.PointKey != 10 || cmd.Tag != "SETPOINT" ||
+		cmd.OriginatorIpAddress != "10.0.0.5" || cmd.OriginatorUserName != "Protocol connection: SRV" {
+		t.Errorf("command queued %+v", cmd)
+	}
+
+	// digital command inverted by the command point
+	s.HandleFrame(commandFrame(3001, 45, 1, 0, 1, 1))
+	if _, _, cause := lastConfirmation(t, transport); cause != COT_ACTIVATION_CON {
+		t.Errorf("confirmation cause %d", cause)
+	}
+	if cmd := queue.commands[len(queue.commands)-1]; cmd.Value != 0 || !cmd.ProtocolSourceCommandUseSBO || cmd.ProtocolSourceCommandDuration != 1 {
+		t.Errorf("command queued %+v", cmd)
+	}
+
+	rejected := []struct {
+		name  string
+		frame ReceivedPacket
+	}{
+		{"unknown address", commandFrame(3999, 45, 1, 0, 1, 1)},
+		{"other ASDU", commandFrame(3001, 46, 1, 0, 1, 1)},
+		{"other common address", commandFrame(3001, 45, 1, 0, 1, 2)},
+		{"qualifier not expected", commandFrame(3001, 45, 1, 0, 0, 1)},
+	}
+	for _, test := range rejected {
+		n := len(queue.commands)
+		s.HandleFrame(test.frame)
+		if _, _, cause := lastConfirmation(t, transport); cause != COT_ACTIVATION_CON|0x40 {
+			t.Errorf("%s: confirmation cause %d, want negative", test.name, cause)
+		}
+		if len(queue.commands) != n {
+			t.Errorf("%s: command queued", test.name)
+		}
+	}
+
+	queue.err = errStoreUnreachable
+	s.HandleFrame(commandFrame(3000, 50, 5, 0, 0, 1))
+	if _, _, cause := lastConfirmation(t, transport); cause != COT_ACTIVATION_CON|0x40 {
+		t.Errorf("insert error: confirmation cause %d, want negative", cause)
+	}
+	queue.err = nil
+
+	s.protCon.CommandsEnabled = false
+	s.HandleFrame(commandFrame(3000, 50, 5, 0, 0, 1))
+	if _, _, cause := lastConfirmation(t, transport); cause != COT_ACTIVATION_CON|0x40 {
+		t.Errorf("commands disabled: confirmation cause %d, want negative", cause)
+	}
+	s.protCon.CommandsEnabled = true
+
+	// not answered while inactive, other frames ignored
+	n := len(transport.sent)
+	setActiveNode(false, 0)
+	s.HandleFrame(commandFrame(3000, 50, 5, 0, 0, 1))
+	setActiveNode(true, 2)
+	s.HandleFrame(ReceivedPacket{Data: singlePacket(t, COT_SPONTANEOUS, PointUpdate{ObjAddr: 1, Asdu: 1})})
+	if len(transport.sent) != n {
+		t.Errorf("%d frames sent", len(transport.sent)-n)
+	}
+}
+
+// interrogation: confirmation, all points as interrogated and termination, decoded by a client ingest
+func TestServerInterrogation(t *testing.T) {
+	s, transport, _ := newTestServer(t)
+	s.points[20] = &ServerPoint{Id: 20, Tag: "KV", Type: "analog", Value: 138.5,
+		ProtocolDestinations: []ProtocolDestination{{ConnectionNumber: 71, CommonAddress: 1, ObjectAddress: 2001},
+			{ConnectionNumber: 72, CommonAddress: 1, ObjectAddress: 9999}}} // other connection
+	s.points[21] = &ServerPoint{Id: 21, Tag: "BRK-POS", Type: "digital", Value: 1,
+		ProtocolDestinations: []ProtocolDestination{{ConnectionNumber: 71, CommonAddress: 1, ObjectAddress: 1001, ASDU: 3}}}
+
+	s.HandleFrame(commandFrame(0, C_IC_NA_1, 20, 0, 0, 1))
+	if len(transport.sent) < 3 {
+		t.Fatalf("%d frames sent", len(transport.sent))
+	}
+	if _, tiType, cause := lastConfirmation(t, transport); tiType != C_IC_NA_1 || cause != COT_ACTIVATION_TERMINATION {
+		t.Errorf("termination %d cause %d", tiType, cause)
+	}
+	first := transport.sent[0]
+	if binary.LittleEndian.Uint32(first[8:]) != C_IC_NA_1 || binary.LittleEndian.Uint32(first[20:]) != COT_ACTIVATION_CON {
+		t.Errorf("confirmation % x", first[:28])
+	}
+
+	in, writer := newTestIngest(t, nil)
+	for _, frame := range transport.sent[1 : len(transport.sent)-1] {
+		if err := in.Process(context.Background(), frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	values := map[uint32]float64{}
+	for _, upd := range writer.updates() {
+		if upd.Cot.Cause != COT_INTERROGATED_BY_STATION {
+			t.Errorf("cause %d", upd.Cot.Cause)
+		}
+		values[upd.ObjAddr] = upd.Value
+	}
+	// the analog setpoint (50) and the digital command (45) are command ASDUs, not sent
+	want := map[uint32]float64{2001: 138.5, 1001: 1}
+	if len(values) != len(want) {
+		t.Errorf("values %v, want %v", values, want)
+	}
+	for addr, v := range want {
+		if values[addr] != v {
+			t.Errorf("address %d: %g, want %g", addr, values[addr], v)
+		}
+	}
+
+	// clock synchronization is only confirmed
+	n := len(transport.sent)
+	s.HandleFrame(commandFrame(0, C_CS_NA_1, 0, 0, 0, 1))
+	if len(transport.sent) != n+1 {
+		t.Errorf("%d frames sent for clock sync", len(transport.sent)-n)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Last value received for each object address, kept also while inactive (hot standby)
+type ValueCache struct {
+	values map[uint32]PointUpdate
+}
+
+func NewValueCache() *ValueCache {
+	return &ValueCache{values: map[uint32]PointUpdate{}}
+}
+
+func (c *ValueCache) Store(upd PointUpdate) {
+	c.values[upd.ObjAddr] = upd
+}
+
+func (c *ValueCache) Len() int {
+	return len(c.values)
+}
+
+// write all cached values, used when a hot standby node becomes active.
+// Values are written as integrity data (without source time tags) to not repeat events already processed by the previous active node.
+func flushSnapshot(writer PointWriter, cache *ValueCache, changeFilter *ChangeFilter, pointDefs PointDefs, protCon *ProtocolConnection) {
+	if cache.Len() == 0 {
+		return
+	}
+	t1 := time.Now()
+	changeFilter.Reset()
+	upds := make([]PointUpdate, 0, cache.Len())
+	for _, upd := range cache.values {
+		upd.HasTime = false
+		changeFilter.Accept(upd, pointDefs[upd.ObjAddr], protCon, t1)
+		upds = append(upds, upd)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := writer.WritePoints(ctx, upds, pointDefs); err != nil {
+		log.Println("Error writing snapshot: ", err)
+		return
+	}
+	log.Printf("Snapshot of %d values written in %d ms\n", len(upds), time.Since(t1).Milliseconds())
+}
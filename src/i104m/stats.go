@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const ConnectionStatsCollectionName = "protocolConnectionsStats"
+const StatsInterval = 30 * time.Second
+const MaxUnmappedAddresses = 100 // unmapped addresses recorded (the first ones received) and listed on the statistics document
+
+// reasons of packets rejected
+const (
+	RejectTooShort        = "tooShort"
+	RejectAuthentication  = "authentication"
+	RejectSignature       = "unknownSignature"
+	RejectCause           = "causeOfTransmission"
+	RejectUnsupportedAsdu = "unsupportedAsdu"
+	RejectTruncated       = "truncated"
+	RejectDuplicate       = "duplicate"
+	RejectPeerNotAllowed  = "peerNotAllowed" // datagram or connection from an address not in "ipAddresses"
+)
+
+// Traffic counters of a connection since the driver started, safe for concurrent use and for a nil receiver (disabled)
+type TrafficStats struct {
+	mutex             sync.Mutex
+	startTime         time.Time
+	packetsReceived   int64
+	packetsRejected   map[string]int64
+	pointsUpdated     int64
+	unmappedUpdates   int64
+	unmappedAddresses map[uint32]bool
+	channelDrops      int64
+	commandsSent      int64
+	commandsConfirmed int64
+	commandsFailed    int64
+	lastPacketTime    time.Time
+	lastPacketFrom    string
+}
+
+// Counters written to the statistics document of the connection
+type TrafficStatsSnapshot struct {
+	StartTimeTag      time.Time        `bson:"startTimeTag"`
+	PacketsReceived   int64            `bson:"packetsReceived"`
+	PacketsRejected   map[string]int64 `bson:"packetsRejected"`
+	PointsUpdated     int64            `bson:"pointsUpdated"`
+	UnmappedUpdates   int64            `bson:"unmappedUpdates"`
+	UnmappedAddresses []uint32         `bson:"unmappedAddresses"`
+	ChannelDrops      int64            `bson:"channelDrops"`
+	CommandsSent      int64            `bson:"commandsSent"`
+	CommandsConfirmed int64            `bson:"commandsConfirmed"`
+	CommandsFailed    int64            `bson:"commandsFailed"`
+	LastPacketTimeTag time.Time        `bson:"lastPacketTimeTag"`
+	LastPacketFrom    string           `bson:"lastPacketFrom"`
+}
+
+func NewTrafficStats(now time.Time) *TrafficStats {
+	return &TrafficStats{
+		startTime:         now,
+		packetsRejected:   map[string]int64{},
+		unmappedAddresses: map[uint32]bool{},
+	}
+}
+
+func (s *TrafficStats) PacketReceived(from string, t time.Time) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.packetsReceived++
+	s.lastPacketTime = t
+	s.lastPacketFrom = from
+}
+
+func (s *TrafficStats) PacketRejected(reason string) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.packetsRejected[reason]++
+}
+
+func (s *TrafficStats) PointsUpdated(n int) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pointsUpdated += int64(n)
+}
+
+// update received for an object address without point definition
+func (s *TrafficStats) Unmapped(objAddr uint32) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.unmappedUpdates++
+	if len(s.unmappedAddresses) < MaxUnmappedAddresses {
+		s.unmappedAddresses[objAddr] = true
+	}
+}
+
+func (s *TrafficStats) ChannelDrop() {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.channelDrops++
+}
+
+func (s *TrafficStats) CommandSent() {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.commandsSent++
+}
+
+func (s *TrafficStats) CommandConfirmed() {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.commandsConfirmed++
+}
+
+func (s *TrafficStats) CommandFailed() {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.commandsFailed++
+}
+
+func (s *TrafficStats) Snapshot() TrafficStatsSnapshot {
+	if s == nil {
+		return TrafficStatsSnapshot{PacketsRejected: map[string]int64{}, UnmappedAddresses: []uint32{}}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	snap := TrafficStatsSnapshot{
+		StartTimeTag:      s.startTime,
+		PacketsReceived:   s.packetsReceived,
+		PacketsRejected:   map[string]int64{},
+		PointsUpdated:     s.pointsUpdated,
+		UnmappedUpdates:   s.unmappedUpdates,
+		UnmappedAddresses: []uint32{},
+		ChannelDrops:      s.channelDrops,
+		CommandsSent:      s.commandsSent,
+		CommandsConfirmed: s.commandsConfirmed,
+		CommandsFailed:    s.commandsFailed,
+		LastPacketTimeTag: s.lastPacketTime,
+		LastPacketFrom:    s.lastPacketFrom,
+	}
+	for reason, n := range s.packetsRejected {
+		snap.PacketsRejected[reason] = n
+	}
+	for objAddr := range s.unmappedAddresses {
+		snap.UnmappedAddresses = append(snap.UnmappedAddresses, objAddr)
+	}
+	sort.Slice(snap.UnmappedAddresses, func(i, j int) bool { return snap.UnmappedAddresses[i] < snap.UnmappedAddresses[j] })
+	return snap
+}
+
+// statistics document of a connection on a node
+type connectionStats struct {
+	Name                 string `bson:"name"`
+	IsActive             bool   `bson:"isActive"`
+	TrafficStatsSnapshot `bson:",inline"`
+}
+
+// upsert the statistics document of the connection on this node every StatsInterval, and on shutdown
+func writeTrafficStats(ctx context.Context, collection *mongo.Collection, protCon *ProtocolConnection, nodeName string) error {
+	write := func() {
+		wctx, cancel := context.WithTimeout(context.Background(), StatsInterval)
+		defer cancel()
+		_, err := collection.UpdateOne(wctx,
+			bson.D{
+				{"protocolDriver", protCon.ProtocolDriver},
+				{"protocolDriverInstanceNumber", protCon.ProtocolDriverInstanceNumber},
+				{"protocolConnectionNumber", protCon.ProtocolConnectionNumber},
+				{"nodeName", nodeName},
+			},
+			bson.D{
+				{"$set", connectionStats{
+					Name:                 protCon.Name,
+					IsActive:             isActive(),
+					TrafficStatsSnapshot: protCon.stats.Snapshot(),
+				}},
+				{"$currentDate", bson.D{{"timeTag", true}}},
+			},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			log.Println("Error writing connection statistics: ", err)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			write()
+			return nil
+		case <-time.After(StatsInterval):
+			write()
+		}
+	}
+}
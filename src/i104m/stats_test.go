@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestTrafficStats(t *testing.T) {
+	in, _ := newTestIngest(t, PointDefs{100: {Tag: "P100"}})
+	stats := NewTrafficStats(time.Now())
+	in.protCon.stats = stats
+	ctx := context.Background()
+
+	single := singlePacket(t, COT_SPONTANEOUS, PointUpdate{ObjAddr: 100, Asdu: 1, Value: 1})
+	in.Process(ctx, single)
+	in.Process(ctx, single) // duplicate
+	in.Process(ctx, sequencePacket(t, 13, COT_INTERROGATED_BY_STATION,
+		PointUpdate{ObjAddr: 100, Value: 1},
+		PointUpdate{ObjAddr: 205, Value: 2},
+		PointUpdate{ObjAddr: 201, Value: 3}))
+	in.Process(ctx, single[:20])                                                               // too short
+	in.Process(ctx, append([]byte{1, 2, 3, 4}, single[4:]...))                                 // signature
+	in.Process(ctx, singlePacket(t, COT_SPONTANEOUS|0x80, PointUpdate{ObjAddr: 100, Asdu: 1})) // test data
+
+	tracker, store, protCon, _ := newTestTracker(t, "")
+	tracker.stats = stats
+	now := time.Now()
+	cmd := newTestCommand(now)
+	store.insert(cmd)
+	forwardCommand(cmd, protCon, tracker, now)
+	tracker.Confirm(6001, 46, decodeCOT(COT_ACTIVATION_CON), []byte{0x02}, now)
+	failed, _, failProtCon, _ := newTestTracker(t, "UDP send error")
+	failed.stats = stats
+	forwardCommand(newTestCommand(now), failProtCon, failed, now)
+
+	snap := stats.Snapshot()
+	if snap.PointsUpdated != 4 {
+		t.Errorf("points updated %d, want 4", snap.PointsUpdated)
+	}
+	if snap.UnmappedUpdates != 2 || len(snap.UnmappedAddresses) != 2 || snap.UnmappedAddresses[0] != 201 || snap.UnmappedAddresses[1] != 205 {
+		t.Errorf("unmapped %d %v, want 2 [201 205]", snap.UnmappedUpdates, snap.UnmappedAddresses)
+	}
+	wantRejected := map[string]int64{RejectDuplicate: 1, RejectTooShort: 1, RejectSignature: 1, RejectCause: 1}
+	for reason, n := range wantRejected {
+		if snap.PacketsRejected[reason] != n {
+			t.Errorf("rejected %s: %d, want %d", reason, snap.PacketsRejected[reason], n)
+		}
+	}
+	if snap.CommandsSent != 1 || snap.CommandsConfirmed != 1 || snap.CommandsFailed != 1 {
+		t.Errorf("commands sent %d confirmed %d failed %d, want 1 1 1", snap.CommandsSent, snap.CommandsConfirmed, snap.CommandsFailed)
+	}
+
+	stats.PacketReceived("10.0.0.1", now)
+	stats.ChannelDrop()
+	doc, err := bson.Marshal(connectionStats{Name: "I104M-1", TrafficStatsSnapshot: stats.Snapshot()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := bson.Raw(doc)
+	if v := raw.Lookup("packetsReceived").AsInt64(); v != 1 {
+		t.Errorf("packetsReceived %d on document, want 1", v)
+	}
+	if v := raw.Lookup("channelDrops").AsInt64(); v != 1 {
+		t.Errorf("channelDrops %d on document, want 1", v)
+	}
+	if v := raw.Lookup("lastPacketFrom").StringValue(); v != "10.0.0.1" {
+		t.Errorf("lastPacketFrom %s on document", v)
+	}
+}
+
+// the unmapped addresses recorded are bounded, a nil statistics (disabled) has an empty snapshot
+func TestTrafficStatsLimits(t *testing.T) {
+	stats := NewTrafficStats(time.Now())
+	for objAddr := uint32(1000); objAddr > 0; objAddr-- {
+		stats.Unmapped(objAddr)
+	}
+	if n := len(stats.unmappedAddresses); n != MaxUnmappedAddresses {
+		t.Errorf("%d unmapped addresses recorded, want %d", n, MaxUnmappedAddresses)
+	}
+	snap := stats.Snapshot()
+	if snap.UnmappedUpdates != 1000 || len(snap.UnmappedAddresses) != MaxUnmappedAddresses || snap.UnmappedAddresses[0] != 901 {
+		t.Errorf("unmapped %d, addresses %v, want 1000 and 901-1000", snap.UnmappedUpdates, snap.UnmappedAddresses)
+	}
+
+	var disabled *TrafficStats
+	disabled.Unmapped(1)
+	disabled.PacketRejected(RejectPeerNotAllowed)
+	snap = disabled.Snapshot()
+	if snap.PacketsReceived != 0 || snap.PacketsRejected == nil || snap.UnmappedAddresses == nil {
+		t.Errorf("snapshot of nil statistics %+v", snap)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// transports of a connection ("transport")
+const (
+	TransportUDP  = "udp"  // datagrams (default, OSHMI peers)
+	TransportTCP  = "tcp"  // length prefixed frames over TCP, the driver listens for peers
+	TransportUnix = "unix" // length prefixed frames over a Unix domain socket, the driver listens for peers
+)
+
+// Carries I104M frames (packets, command frames, authenticated or not) between the driver and its peers
+type Transport interface {
+	// receive frames until the context is canceled, handler is called for each frame received from an allowed peer
+	// (the frame buffer may be reused after the handler returns)
+	Receive(ctx context.Context, handler func(frame []byte, from string)) error
+	// send a frame to all peers, ok if delivered to at least one
+	Send(frame []byte) (ok bool, err_msg string)
+	Close() error
+}
+
+// open the transport selected for the connection, peers refused are counted on the statistics of the connection
+func newTransport(protCon *ProtocolConnection) (Transport, error) {
+	switch strings.ToLower(strings.TrimSpace(protCon.Transport)) {
+	case "", TransportUDP:
+		t, err := newUdpTransport(protCon.IpAddressLocalBind, NewPeerAllowList(protCon.IpAddresses), peerDestinations(protCon.IpAddresses))
+		if err != nil {
+			return nil, err
+		}
+		t.stats = protCon.stats
+		return t, nil
+	case TransportTCP:
+		t, err := newStreamTransport("tcp", protCon.IpAddressLocalBind, NewPeerAllowList(protCon.IpAddresses))
+		if err != nil {
+			return nil, err
+		}
+		t.stats = protCon.stats
+		return t, nil
+	case TransportUnix:
+		return newStreamTransport("unix", protCon.IpAddressLocalBind, nil)
+	}
+	return nil, fmt.Errorf("invalid transport '%s'", protCon.Transport)
+}
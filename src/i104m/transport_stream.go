@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const StreamMaxFrameSize = 65535
+const StreamWriteTimeout = 5 * time.Second
+
+// I104M over a stream (TCP or Unix domain socket): each frame is preceded by its length (uint32 little endian).
+// The driver listens on the bind address (IP:port or socket path), peers connect to it.
+// For TCP only peers from the allow-list ("ipAddresses") are accepted. Frames to send go to all connected peers.
+type streamTransport struct {
+	network    string
+	socketPath string // unix socket file, removed on close
+	listener   net.Listener
+	peers      *PeerAllowList
+	stats      *TrafficStats // connections refused
+	mutex      sync.Mutex
+	conns      map[net.Conn]bool
+	closed     bool // no more connections are accepted
+}
+
+func newStreamTransport(network string, bindAddress string, peers *PeerAllowList) (*streamTransport, error) {
+	socketPath := ""
+	if network == "unix" {
+		socketPath = bindAddress
+		removeSocketFile(socketPath) // left by a previous run
+	}
+	listener, err := net.Listen(network, bindAddress)
+	if err != nil {
+		return nil, err
+	}
+	return &streamTransport{
+		network:    network,
+		socketPath: socketPath,
+		listener:   listener,
+		peers:      peers,
+		conns:      map[net.Conn]bool{},
+	}, nil
+}
+
+// remove a unix socket file, other files are kept
+func removeSocketFile(path string) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+}
+
+func (t *streamTransport) Receive(ctx context.Context, handler func(frame []byte, from string)) error {
+	var waitGroup sync.WaitGroup
+	go func() {
+		<-ctx.Done()
+		t.closeConns()
+	}()
+
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil || t.isClosed() {
+				break
+			}
+			log.Println("Accept error: ", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		from := conn.RemoteAddr().String()
+		if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			if !t.peers.Allowed(tcpAddr.IP) {
+				log.Println("Connection refused from ", from)
+				t.stats.PacketRejected(RejectPeerNotAllowed)
+				conn.Close()
+				continue
+			}
+			from = tcpAddr.IP.String()
+		} else {
+			from = "unix:" + t.listener.Addr().String() // unix peers are unnamed
+		}
+		if !t.track(conn) {
+			break // accepted while shutting down
+		}
+		log.Println("Peer connected: ", from)
+
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			err := readFrames(conn, func(frame []byte) { handler(frame, from) })
+			if ctx.Err() == nil {
+				log.Println("Peer disconnected: ", from, " ", err)
+			}
+			t.mutex.Lock()
+			delete(t.conns, conn)
+			t.mutex.Unlock()
+			conn.Close()
+		}()
+	}
+
+	waitGroup.Wait()
+	return nil
+}
+
+// register an accepted connection, false (connection closed) when the transport is shutting down
+func (t *streamTransport) track(conn net.Conn) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed {
+		conn.Close()
+		return false
+	}
+	t.conns[conn] = true
+	return true
+}
+
+// stop accepting and close the connections, readers return
+func (t *streamTransport) closeConns() {
+	t.listener.Close()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.closed = true
+	for conn := range t.conns {
+		conn.Close()
+	}
+}
+
+func (t *streamTransport) isClosed() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.closed
+}
+
+// read length prefixed frames until error or end of stream
+func readFrames(r io.Reader, handle func(frame []byte)) error {
+	var lenBuf [4]byte
+	buf := make([]byte, StreamMaxFrameSize)
+	for {
+		if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+			return err
+		}
+		size := binary.LittleEndian.Uint32(lenBuf[:])
+		if size == 0 || size > StreamMaxFrameSize {
+			return fmt.Errorf("invalid frame size %d", size)
+		}
+		if _, err := io.ReadFull(r, buf[:size]); err != nil {
+			return err
+		}
+		handle(buf[:size])
+	}
+}
+
+func (t *streamTransport) Send(frame []byte) (ok bool, err_msg string) {
+	if len(frame) > StreamMaxFrameSize {
+		return false, "frame too large"
+	}
+	msg := make([]byte, 4, 4+len(frame))
+	binary.LittleEndian.PutUint32(msg, uint32(len(frame)))
+	msg = append(msg, frame...)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	err_msg = "no peer connected"
+	for conn := range t.conns {
+		conn.SetWriteDeadline(time.Now().Add(StreamWriteTimeout))
+		if _, err := conn.Write(msg); err != nil {
+			err_msg = "send error"
+			log.Println("Error sending to ", conn.RemoteAddr(), ": ", err)
+			conn.Close() // the reader removes it
+			continue
+		}
+		if LogLevel >= LogLevelDetailed {
+			log.Println("Frame sent to: ", conn.RemoteAddr())
+		}
+		ok = true
+	}
+	if ok {
+		err_msg = ""
+	}
+	return ok, err_msg
+}
+
+func (t *streamTransport) Close() error {
+	t.closeConns()
+	if t.socketPath != "" {
+		removeSocketFile(t.socketPath)
+	}
+	return nil
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func lengthPrefixed(frame []byte) []byte {
+	msg := make([]byte, 4, 4+len(frame))
+	binary.LittleEndian.PutUint32(msg, uint32(len(frame)))
+	return append(msg, frame...)
+}
+
+// frames read from the reader until it fails
+func readAllFrames(r io.Reader) ([][]byte, error) {
+	var frames [][]byte
+	err := readFrames(r, func(frame []byte) { frames = append(frames, append([]byte(nil), frame...)) })
+	return frames, err
+}
+
+func TestReadFrames(t *testing.T) {
+	first, second := []byte{1, 2, 3}, bytes.Repeat([]byte{7}, StreamMaxFrameSize)
+	oversized := make([]byte, 4)
+	binary.LittleEndian.PutUint32(oversized, StreamMaxFrameSize+1)
+	tests := []struct {
+		name   string
+		stream []byte
+		frames int
+		err    error  // expected error, nil to check errMsg
+		errMsg string // part of the error message
+	}{
+		{"two frames, end of stream", append(lengthPrefixed(first), lengthPrefixed(second)...), 2, io.EOF, ""},
+		{"closed in the length", append(lengthPrefixed(first), 5, 0), 1, io.ErrUnexpectedEOF, ""},
+		{"closed in the frame", append(lengthPrefixed(first), lengthPrefixed(second)[:100]...), 1, io.ErrUnexpectedEOF, ""},
+		{"oversized length", append(lengthPrefixed(first), oversized...), 1, nil, "invalid frame size 65536"},
+		{"zero length", append(lengthPrefixed(first), 0, 0, 0, 0), 1, nil, "invalid frame size 0"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frames, err := readAllFrames(bytes.NewReader(test.stream))
+			if len(frames) != test.frames {
+				t.Errorf("%d frames read, want %d", len(frames), test.frames)
+			}
+			if len(frames) > 0 && !bytes.Equal(frames[0], first) {
+				t.Errorf("first frame % x", frames[0])
+			}
+			if test.err != nil && !errors.Is(err, test.err) || test.err == nil && (err == nil || !strings.Contains(err.Error(), test.errMsg)) {
+				t.Errorf("error %v", err)
+			}
+		})
+	}
+}
+
+// frames written in small pieces, as delivered by a stream
+func TestReadFramesPartial(t *testing.T) {
+	reader, writer := net.Pipe()
+	defer reader.Close()
+	frames := [][]byte{{1}, bytes.Repeat([]byte{2}, 3000), {3, 3}}
+	go func() {
+		var stream []byte
+		for _, frame := range frames {
+			stream = append(stream, lengthPrefixed(frame)...)
+		}
+		for i := 0; i < len(stream); i += 7 {
+			end := i + 7
+			if end > len(stream) {
+				end = len(stream)
+			}
+			if _, err := writer.Write(stream[i:end]); err != nil {
+				return
+			}
+		}
+		writer.Close()
+	}()
+	got, err := readAllFrames(reader)
+	if err != io.EOF {
+		t.Errorf("error %v, want EOF", err)
+	}
+	if len(got) != len(frames) {
+		t.Fatalf("%d frames read", len(got))
+	}
+	for i := range frames {
+		if !bytes.Equal(got[i], frames[i]) {
+			t.Errorf("frame %d: %d bytes, want %d", i, len(got[i]), len(frames[i]))
+		}
+	}
+}
+
+// frames received by the transport
+type receivedFrames struct {
+	mutex  sync.Mutex
+	frames []ReceivedPacket
+	signal chan struct{}
+}
+
+func newReceivedFrames() *receivedFrames {
+	return &receivedFrames{signal: make(chan struct{}, 100)}
+}
+
+func (r *receivedFrames) handle(frame []byte, from string) {
+	r.mutex.Lock()
+	r.frames = append(r.frames, ReceivedPacket{Data: append([]byte(nil), frame...), From: from})
+	r.mutex.Unlock()
+	r.signal <- struct{}{}
+}
+
+func (r *receivedFrames) wait(t *testing.T, n int) []ReceivedPacket {
+	t.Helper()
+	for {
+		r.mutex.Lock()
+		frames := append([]ReceivedPacket(nil), r.frames...)
+		r.mutex.Unlock()
+		if len(frames) >= n {
+			return frames
+		}
+		select {
+		case <-r.signal:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d frames received, want %d", len(frames), n)
+		}
+	}
+}
+
+// run the receiver of a transport until the test ends
+func startReceive(t *testing.T, transport Transport) *receivedFrames {
+	t.Helper()
+	received := newReceivedFrames()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		transport.Receive(ctx, received.handle)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		transport.Close()
+	})
+	return received
+}
+
+// wait until the transport has n peers connected
+func waitPeers(t *testing.T, transport *streamTransport, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		transport.mutex.Lock()
+		connected := len(transport.conns)
+		transport.mutex.Unlock()
+		if connected == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d peers connected, want %d", connected, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStreamTransportTCP(t *testing.T) {
+	transport, err := newStreamTransport("tcp", "127.0.0.1:0", NewPeerAllowList([]string{"127.0.0.1"}))
+	if err != nil {
+		t.Skip("TCP loopback not available: ", err)
+	}
+	received := startReceive(t, transport)
+	if ok, errMsg := transport.Send([]byte{1}); ok || errMsg != "no peer connected" {
+		t.Errorf("send without peers: %v %s", ok, errMsg)
+	}
+
+	conn, err := net.Dial("tcp", transport.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(append(lengthPrefixed([]byte{1, 2}), lengthPrefixed([]byte{3})...))
+	frames := received.wait(t, 2)
+	if !bytes.Equal(frames[0].Data, []byte{1, 2}) || !bytes.Equal(frames[1].Data, []byte{3}) || frames[0].From != "127.0.0.1" {
+		t.Errorf("frames %+v", frames)
+	}
+
+	// driver to peer
+	waitPeers(t, transport, 1)
+	if ok, errMsg := transport.Send([]byte{9, 8, 7}); !ok {
+		t.Fatal(errMsg)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg := make([]byte, 7)
+	if _, err := io.ReadFull(conn, msg); err != nil || !bytes.Equal(msg, lengthPrefixed([]byte{9, 8, 7})) {
+		t.Errorf("frame sent % x %v", msg, err)
+	}
+	if ok, errMsg := transport.Send(make([]byte, StreamMaxFrameSize+1)); ok || errMsg != "frame too large" {
+		t.Errorf("large frame: %v %s", ok, errMsg)
+	}
+
+	// peer closes in the middle of a frame, the partial frame is discarded
+	conn.Write(lengthPrefixed([]byte{4, 5, 6})[:5])
+	conn.Close()
+	waitPeers(t, transport, 0)
+
+	// reconnect
+	conn, err = net.Dial("tcp", transport.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(lengthPrefixed([]byte{10}))
+	frames = received.wait(t, 3)
+	if len(frames) != 3 || !bytes.Equal(frames[2].Data, []byte{10}) {
+		t.Errorf("frames after reconnect %+v", frames)
+	}
+
+	// an oversized length drops the connection
+	waitPeers(t, transport, 1)
+	conn.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	waitPeers(t, transport, 0)
+}
+
+func TestStreamTransportRefused(t *testing.T) {
+	transport, err := newStreamTransport("tcp", "127.0.0.1:0", NewPeerAllowList([]string{"10.0.0.1"}))
+	if err != nil {
+		t.Skip("TCP loopback not available: ", err)
+	}
+	transport.stats = NewTrafficStats(time.Now())
+	received := startReceive(t, transport)
+	conn, err := net.Dial("tcp", transport.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(lengthPrefixed([]byte{1}))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("connection from peer not allowed kept open")
+	}
+	received.mutex.Lock()
+	defer received.mutex.Unlock()
+	if len(received.frames) != 0 {
+		t.Errorf("frames received from peer not allowed: %+v", received.frames)
+	}
+	if n := transport.stats.Snapshot().PacketsRejected[RejectPeerNotAllowed]; n != 1 {
+		t.Errorf("%d connections counted as %s, want 1", n, RejectPeerNotAllowed)
+	}
+}
+
+func TestStreamTransportUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "i104m.sock")
+	transport, err := newStreamTransport("unix", path, nil)
+	if err != nil {
+		t.Skip("Unix sockets not available: ", err)
+	}
+	received := startReceive(t, transport)
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(lengthPrefixed([]byte{1, 2, 3}))
+	if frames := received.wait(t, 1); !bytes.Equal(frames[0].Data, []byte{1, 2, 3}) || !strings.HasPrefix(frames[0].From, "unix:") {
+		t.Errorf("frames %+v", frames)
+	}
+}
+
+func TestUdpTransportAllowList(t *testing.T) {
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip("UDP loopback not available: ", err)
+	}
+	defer peer.Close()
+	transport, err := newUdpTransport("127.0.0.1:0", NewPeerAllowList([]string{"10.0.0.1"}), []string{peer.LocalAddr().String(), "bad address"})
+	if err != nil {
+		t.Skip("UDP loopback not available: ", err)
+	}
+	transport.stats = NewTrafficStats(time.Now())
+	received := startReceive(t, transport)
+
+	// from a peer not allowed
+	peer.WriteToUDP([]byte{1, 2, 3}, transport.conn.LocalAddr().(*net.UDPAddr))
+	time.Sleep(100 * time.Millisecond)
+	received.mutex.Lock()
+	if len(received.frames) != 0 {
+		t.Errorf("frames received from peer not allowed: %+v", received.frames)
+	}
+	received.mutex.Unlock()
+	if n := transport.stats.Snapshot().PacketsRejected[RejectPeerNotAllowed]; n != 1 {
+		t.Errorf("%d datagrams counted as %s, want 1", n, RejectPeerNotAllowed)
+	}
+
+	// sent to the destinations that resolve
+	if ok, errMsg := transport.Send([]byte{4, 5}); !ok {
+		t.Fatal(errMsg)
+	}
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 10)
+	if n, _, err := peer.ReadFromUDP(buf); err != nil || !bytes.Equal(buf[:n], []byte{4, 5}) {
+		t.Errorf("frame sent % x %v", buf[:n], err)
+	}
+}
+
+// shutdown with peers connected and idle: the receiver returns, connections are closed
+func TestStreamTransportShutdown(t *testing.T) {
+	transport, err := newStreamTransport("tcp", "127.0.0.1:0", NewPeerAllowList([]string{"127.0.0.1"}))
+	if err != nil {
+		t.Skip("TCP loopback not available: ", err)
+	}
+	defer transport.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		transport.Receive(ctx, func(frame []byte, from string) {})
+		close(done)
+	}()
+
+	idle, err := net.Dial("tcp", transport.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	partial, err := net.Dial("tcp", transport.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer partial.Close()
+	partial.Write([]byte{10, 0}) // blocked in the middle of the length
+	waitPeers(t, transport, 2)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("receiver blocked by connected peers on shutdown")
+	}
+	idle.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := idle.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("peer connection not closed on shutdown: %v", err)
+	}
+}
+
+// a connection accepted while shutting down is closed and not kept
+func TestStreamTransportAcceptOnShutdown(t *testing.T) {
+	transport, err := newStreamTransport("tcp", "127.0.0.1:0", nil)
+	if err != nil {
+		t.Skip("TCP loopback not available: ", err)
+	}
+	transport.closeConns()
+	local, remote := net.Pipe()
+	defer remote.Close()
+	if transport.track(local) {
+		t.Error("connection kept after shutdown")
+	}
+	if _, err := remote.Write([]byte{1}); err == nil {
+		t.Error("connection accepted on shutdown not closed")
+	}
+	if len(transport.conns) != 0 {
+		t.Errorf("%d connections kept", len(transport.conns))
+	}
+}
+
+// the socket file is removed on close, and a stale one left by a crash does not block the start
+func TestStreamTransportUnixSocketFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "i104m.sock")
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Skip("Unix sockets not available: ", err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal("stale socket file not left: ", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		transport, err := newStreamTransport("unix", path, nil)
+		if err != nil {
+			t.Fatalf("start %d: %v", i, err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			transport.Receive(ctx, func(frame []byte, from string) {})
+			close(done)
+		}()
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitPeers(t, transport, 1)
+		cancel()
+		<-done
+		conn.Close()
+		transport.Close()
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("start %d: socket file not removed on close: %v", i, err)
+		}
+	}
+
+	// other files are not removed
+	if err := os.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newStreamTransport("unix", path, nil); err == nil {
+		t.Error("listening over a regular file")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Error("regular file removed: ", err)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"time"
+)
+
+// I104M over UDP, frames are received on the bind address from allowed peers and sent to all destinations (host:port)
+type udpTransport struct {
+	conn         *net.UDPConn
+	peers        *PeerAllowList
+	destinations []string
+	stats        *TrafficStats
+}
+
+func newUdpTransport(bindAddress string, peers *PeerAllowList, destinations []string) (*udpTransport, error) {
+	// Lets prepare an server address at any address at port 10001
+	ServerAddr, err := net.ResolveUDPAddr("udp", bindAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	// Now listen at selected port
+	ServerConn, err := net.ListenUDP("udp", ServerAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &udpTransport{conn: ServerConn, peers: peers, destinations: destinations}, nil
+}
+
+func (t *udpTransport) Receive(ctx context.Context, handler func(frame []byte, from string)) error {
+	buf := make([]byte, 2048)
+
+	for ctx.Err() == nil {
+		// read deadline to check for shutdown periodically
+		t.conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, addr, err := t.conn.ReadFromUDP(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+				log.Printf("%s \n", err)
+			}
+			continue
+		}
+
+		if !t.peers.Allowed(addr.IP) {
+			t.stats.PacketRejected(RejectPeerNotAllowed)
+			continue
+		}
+		handler(buf[:n], addr.IP.String())
+	}
+	return nil
+}
+
+func (t *udpTransport) Send(frame []byte) (ok bool, err_msg string) {
+	err_msg = "no IP destination"
+	for _, ipAddressDest := range t.destinations {
+		udpAddr, err := net.ResolveUDPAddr("udp", ipAddressDest)
+		if err != nil {
+			err_msg = "IP address error"
+			log.Println("Error on IP: ", err)
+			continue
+		}
+		_, err = t.conn.WriteToUDP(frame, udpAddr)
+		if err != nil {
+			err_msg = "UDP send error"
+			log.Println("Error on IP: ", err)
+			continue
+		}
+		// success delivering frame
+		if LogLevel >= LogLevelDetailed {
+			log.Println("Frame sent to: ", ipAddressDest)
+		}
+		ok = true
+	}
+	if ok {
+		err_msg = ""
+	}
+	return ok, err_msg
+}
+
+func (t *udpTransport) Close() error {
+	return t.conn.Close()
+}
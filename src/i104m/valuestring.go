@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// format the value at source for humans: state texts for digitals, engineering value with unit for analogs.
+// upd is the update as written (after the point settings), the inversion or conversion done by the driver
+// replaces the one of kconv1/kconv2, so a value is never inverted or converted twice.
+func formatValueString(upd PointUpdate, def *PointDef, protCon *ProtocolConnection) string {
+	decimalPlaces := protCon.DecimalPlaces
+	if def != nil && def.DecimalPlaces != nil {
+		decimalPlaces = *def.DecimalPlaces
+	}
+	if decimalPlaces < 0 {
+		decimalPlaces = -1 // shortest representation
+	}
+
+	if def == nil {
+		return strconv.FormatFloat(upd.Value, 'f', decimalPlaces, 64)
+	}
+
+	var str string
+	if isDigitalAsdu(upd.Asdu) {
+		value := upd.Value
+		if def.Kconv1 != nil && *def.Kconv1 == -1 && !def.ProtocolSourceInvert { // inverted digital
+			if value == 0 {
+				value = 1
+			} else {
+				value = 0
+			}
+		}
+		switch {
+		case isDoublePointAsdu(upd.Asdu) && upd.Transient:
+			str = protCon.StateTextTransit
+		case value != 0:
+			str = def.StateTextTrue
+		default:
+			str = def.StateTextFalse
+		}
+		if strings.TrimSpace(str) == "" {
+			str = strconv.FormatFloat(value, 'f', 0, 64)
+		}
+	} else {
+		value := upd.Value
+		convertedAtIngest := def.ProtocolSourceScale != nil || def.ProtocolSourceOffset != nil
+		if def.Kconv1 != nil && *def.Kconv1 != 0 && !convertedAtIngest {
+			value = value * *def.Kconv1
+			if def.Kconv2 != nil {
+				value += *def.Kconv2
+			}
+		}
+		str = strconv.FormatFloat(value, 'f', decimalPlaces, 64)
+	}
+
+	if strings.TrimSpace(def.Unit) != "" {
+		str += " " + strings.TrimSpace(def.Unit)
+	}
+	return str
+}
+
+func isDoublePointAsdu(iecAsdu uint32) bool {
+	return iecAsdu == 3 || iecAsdu == 4 || iecAsdu == 31
+}
@@ -0,0 +1,83 @@
+package main
+
+import "testing"
+
+func intPtr(v int) *int {
+	return &v
+}
+
+func TestFormatValueString(t *testing.T) {
+	protCon := &ProtocolConnection{DecimalPlaces: 3, StateTextTransit: "TRANSIT"}
+	breaker := &PointDef{StateTextTrue: "CLOSED", StateTextFalse: "OPEN"}
+	inverted := &PointDef{StateTextTrue: "CLOSED", StateTextFalse: "OPEN", Kconv1: float64Ptr(-1)}
+	tests := []struct {
+		name string
+		upd  PointUpdate
+		def  *PointDef
+		want string
+	}{
+		{"no definition", PointUpdate{Asdu: 13, Value: 1.23456}, nil, "1.235"},
+		{"no definition digital", PointUpdate{Asdu: 1, Value: 1}, nil, "1.000"},
+		{"single on", PointUpdate{Asdu: 1, Value: 1}, breaker, "CLOSED"},
+		{"single off", PointUpdate{Asdu: 30, Value: 0}, breaker, "OPEN"},
+		{"single inverted", PointUpdate{Asdu: 1, Value: 1}, inverted, "OPEN"},
+		{"double inverted", PointUpdate{Asdu: 3, Value: 0}, inverted, "CLOSED"},
+		{"double in transit", PointUpdate{Asdu: 31, Value: 1, Transient: true}, breaker, "TRANSIT"},
+		{"double in transit inverted", PointUpdate{Asdu: 3, Value: 0, Transient: true}, inverted, "TRANSIT"},
+		{"single transient not transit", PointUpdate{Asdu: 1, Value: 1, Transient: true}, breaker, "CLOSED"},
+		{"no state texts", PointUpdate{Asdu: 1, Value: 1}, &PointDef{}, "1"},
+		{"no state texts inverted", PointUpdate{Asdu: 1, Value: 1}, &PointDef{Kconv1: float64Ptr(-1)}, "0"},
+		{"blank state text", PointUpdate{Asdu: 1, Value: 0}, &PointDef{StateTextTrue: "ON", StateTextFalse: " "}, "0"},
+		{"digital with unit", PointUpdate{Asdu: 1, Value: 1}, &PointDef{StateTextTrue: "ON", Unit: "state"}, "ON state"},
+		{"analog", PointUpdate{Asdu: 13, Value: 12.3456}, &PointDef{}, "12.346"},
+		{"analog with unit", PointUpdate{Asdu: 13, Value: 12.3456}, &PointDef{Unit: " MW "}, "12.346 MW"},
+		{"analog kconv", PointUpdate{Asdu: 11, Value: 100}, &PointDef{Kconv1: float64Ptr(0.5), Kconv2: float64Ptr(-10)}, "40.000"},
+		{"analog kconv1 only", PointUpdate{Asdu: 11, Value: 100}, &PointDef{Kconv1: float64Ptr(-1)}, "-100.000"},
+		{"analog kconv1 zero", PointUpdate{Asdu: 11, Value: 100}, &PointDef{Kconv1: float64Ptr(0), Kconv2: float64Ptr(5)}, "100.000"},
+		{"point decimals", PointUpdate{Asdu: 13, Value: 12.3456}, &PointDef{DecimalPlaces: intPtr(1), Unit: "kV"}, "12.3 kV"},
+		{"point decimals zero", PointUpdate{Asdu: 13, Value: 12.5}, &PointDef{DecimalPlaces: intPtr(0)}, "12"},
+		{"shortest", PointUpdate{Asdu: 13, Value: 12.3456}, &PointDef{DecimalPlaces: intPtr(-1)}, "12.3456"},
+		{"inverted in the driver and kconv1 -1", PointUpdate{Asdu: 1, Value: 1},
+			&PointDef{StateTextTrue: "CLOSED", StateTextFalse: "OPEN", Kconv1: float64Ptr(-1), ProtocolSourceInvert: true}, "CLOSED"},
+		{"converted in the driver and kconv", PointUpdate{Asdu: 9, Value: 250},
+			&PointDef{Kconv1: float64Ptr(2), Kconv2: float64Ptr(1), ProtocolSourceScale: float64Ptr(500), Unit: "MW"}, "250.000 MW"},
+		{"offset in the driver and kconv", PointUpdate{Asdu: 11, Value: 80},
+			&PointDef{Kconv1: float64Ptr(2), ProtocolSourceOffset: float64Ptr(-20)}, "80.000"},
+	}
+	for _, tt := range tests {
+		if got := formatValueString(tt.upd, tt.def, protCon); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// the string agrees with the value written, whatever the combination of driver settings and kconv1
+func TestFormatValueStringAfterPointDef(t *testing.T) {
+	protCon := &ProtocolConnection{DecimalPlaces: 1}
+	texts := func(def PointDef) *PointDef {
+		def.StateTextTrue, def.StateTextFalse = "ON", "OFF"
+		return &def
+	}
+	tests := []struct {
+		name string
+		upd  PointUpdate
+		def  *PointDef
+		want string
+	}{
+		{"invert", PointUpdate{Asdu: 1, Value: 1}, texts(PointDef{ProtocolSourceInvert: true}), "OFF"},
+		{"invert and kconv1 -1", PointUpdate{Asdu: 1, Value: 1}, texts(PointDef{ProtocolSourceInvert: true, Kconv1: float64Ptr(-1)}), "OFF"},
+		{"invert and kconv1 -1 double", PointUpdate{Asdu: 31, Value: 0}, texts(PointDef{ProtocolSourceInvert: true, Kconv1: float64Ptr(-1)}), "ON"},
+		{"substitute and invert", PointUpdate{Asdu: 1, Value: 0},
+			texts(PointDef{ProtocolSourceInvert: true, Kconv1: float64Ptr(-1), ProtocolSourceSubstituted: true, ProtocolSourceSubstituteValue: float64Ptr(1)}), "ON"},
+		{"scale and kconv", PointUpdate{Asdu: 9, Value: 0.5}, &PointDef{ProtocolSourceScale: float64Ptr(500), Kconv1: float64Ptr(500)}, "250.0"},
+	}
+	for _, tt := range tests {
+		upd, ok := tt.upd.applyPointDef(tt.def)
+		if !ok {
+			t.Fatalf("%s: update dropped", tt.name)
+		}
+		if got := formatValueString(upd, tt.def, protCon); got != tt.want {
+			t.Errorf("%s: got %q, want %q (valueAtSource %g)", tt.name, got, tt.want, upd.Value)
+		}
+	}
+}
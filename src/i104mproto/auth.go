@@ -0,0 +1,82 @@
+package i104mproto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Authenticated I104M datagram:
+//
+//	signature 0x48484848 (uint32) | key id (uint32) | sequence (uint64) | I104M packet or command frame | HMAC-SHA256 (32 bytes)
+//
+// all little endian, the HMAC covers all bytes before it. The sequence must increase on every datagram sent with the key,
+// it is derived from the sender clock (microseconds since 1970-01-01 UTC) so it also increases across restarts.
+const (
+	AuthSignature  uint32 = 0x48484848
+	AuthHeaderSize        = 16
+	AuthMacSize           = sha256.Size
+)
+
+// sequences of the datagrams sent with a key
+type Sequence struct {
+	mutex sync.Mutex
+	last  uint64
+}
+
+// next sequence: the clock in microseconds, incremented when needed
+func (s *Sequence) Next(now time.Time) uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	seq := uint64(now.UnixNano() / 1000)
+	if seq <= s.last {
+		seq = s.last + 1
+	}
+	s.last = seq
+	return seq
+}
+
+// true when the datagram has the signature of an authenticated datagram
+func IsAuthenticated(datagram []byte) bool {
+	return len(datagram) >= 4 && binary.LittleEndian.Uint32(datagram) == AuthSignature
+}
+
+// sign a frame with the key
+func Sign(keyId uint32, key []byte, seq uint64, frame []byte) []byte {
+	datagram := make([]byte, AuthHeaderSize, AuthHeaderSize+len(frame)+AuthMacSize)
+	binary.LittleEndian.PutUint32(datagram[0:], AuthSignature)
+	binary.LittleEndian.PutUint32(datagram[4:], keyId)
+	binary.LittleEndian.PutUint64(datagram[8:], seq)
+	datagram = append(datagram, frame...)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(datagram)
+	return mac.Sum(datagram)
+}
+
+// verify the HMAC of an authenticated datagram with the key of its key id (key returns false for unknown key ids),
+// returns the key id, the sequence and the I104M packet. The sequence is not checked.
+func Verify(datagram []byte, key func(keyId uint32) ([]byte, bool)) (keyId uint32, seq uint64, payload []byte, err error) {
+	if !IsAuthenticated(datagram) {
+		return 0, 0, nil, errors.New("not an authenticated datagram")
+	}
+	if len(datagram) < AuthHeaderSize+AuthMacSize+4 {
+		return 0, 0, nil, errors.New("authenticated datagram too short")
+	}
+	keyId = binary.LittleEndian.Uint32(datagram[4:])
+	seq = binary.LittleEndian.Uint64(datagram[8:])
+	k, ok := key(keyId)
+	if !ok {
+		return keyId, seq, nil, fmt.Errorf("unknown key id %d", keyId)
+	}
+	signed := datagram[:len(datagram)-AuthMacSize]
+	mac := hmac.New(sha256.New, k)
+	mac.Write(signed)
+	if !hmac.Equal(mac.Sum(nil), datagram[len(signed):]) {
+		return keyId, seq, nil, fmt.Errorf("invalid HMAC (key id %d)", keyId)
+	}
+	return keyId, seq, signed[AuthHeaderSize:], nil
+}
@@ -0,0 +1,60 @@
+package i104mproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	key := bytes.Repeat([]byte{0x5a}, 32)
+	keys := func(keyId uint32) ([]byte, bool) {
+		return key, keyId == 3
+	}
+	frame := SinglePacket(1000, 1, 1, 3, []byte{0x01})
+	datagram := Sign(3, key, 12345, frame)
+	if !IsAuthenticated(datagram) || IsAuthenticated(frame) {
+		t.Error("authenticated datagram not recognized")
+	}
+	if len(datagram) != AuthHeaderSize+len(frame)+AuthMacSize || binary.LittleEndian.Uint32(datagram[4:]) != 3 {
+		t.Errorf("datagram % x", datagram[:AuthHeaderSize])
+	}
+	keyId, seq, payload, err := Verify(datagram, keys)
+	if err != nil || keyId != 3 || seq != 12345 || !bytes.Equal(payload, frame) {
+		t.Errorf("verify: key id %d sequence %d error %v payload % x", keyId, seq, err, payload)
+	}
+
+	tampered := append([]byte(nil), datagram...)
+	tampered[AuthHeaderSize] ^= 1
+	for _, test := range []struct {
+		datagram []byte
+		err      string
+	}{
+		{frame, "not an authenticated"},
+		{datagram[:AuthHeaderSize+AuthMacSize], "too short"},
+		{Sign(4, key, 12345, frame), "unknown key id 4"},
+		{tampered, "invalid HMAC"},
+		{Sign(3, bytes.Repeat([]byte{0x33}, 32), 12345, frame), "invalid HMAC"},
+	} {
+		if _, _, _, err := Verify(test.datagram, keys); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("error %v, want %q", err, test.err)
+		}
+	}
+}
+
+func TestSequence(t *testing.T) {
+	var s Sequence
+	now := time.Now()
+	first := s.Next(now)
+	if first != uint64(now.UnixNano()/1000) {
+		t.Errorf("sequence %d is not the clock in microseconds", first)
+	}
+	if second := s.Next(now); second != first+1 {
+		t.Errorf("same clock: sequence %d, want %d", second, first+1)
+	}
+	if back := s.Next(now.Add(-time.Second)); back != first+2 {
+		t.Errorf("clock stepped back: sequence %d, want %d", back, first+2)
+	}
+}
@@ -0,0 +1,48 @@
+package i104mproto
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Binary time tags (IEC60870-5-4)
+//
+// CP56Time2a (7 bytes)         CP24Time2a (3 bytes)
+//
+//	0-1: milliseconds 0-59999    0-1: milliseconds 0-59999
+//	  2: IV RES1 minutes(6)        2: IV RES1 minutes(6)
+//	  3: SU RES2 hours(5)
+//	  4: day of week(3) day of month(5)
+//	  5: RES3 month(4)
+//	  6: RES4 year(7)
+const (
+	TimeTagInvalidBit = 0x80 // IV
+	TimeTagSummerBit  = 0x80 // SU
+)
+
+// convert Go weekday to ISO numbering used in CP56Time2a (1=monday ... 7=sunday)
+func ISOWeekday(wd time.Weekday) int {
+	if wd == time.Sunday {
+		return 7
+	}
+	return int(wd)
+}
+
+// encode a CP56Time2a time tag in the destination time zone, IV bit set when the time is not ok
+func EncodeCP56Time2a(t time.Time, timeOk bool, loc *time.Location) []byte {
+	t = t.In(loc)
+	b := make([]byte, 7)
+	binary.LittleEndian.PutUint16(b[0:], uint16(t.Second()*1000+t.Nanosecond()/int(time.Millisecond)))
+	b[2] = byte(t.Minute())
+	if !timeOk {
+		b[2] |= TimeTagInvalidBit
+	}
+	b[3] = byte(t.Hour())
+	if t.IsDST() {
+		b[3] |= TimeTagSummerBit
+	}
+	b[4] = byte(t.Day()) | byte(ISOWeekday(t.Weekday())<<5)
+	b[5] = byte(t.Month())
+	b[6] = byte(t.Year()-2000) & 0x7F
+	return b
+}
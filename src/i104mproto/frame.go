@@ -0,0 +1,107 @@
+// Package i104mproto has the I104M packet framing, information encoding, time tags and datagram authentication
+// shared by the I104M driver and the simulator.
+// {json:scada} - Copyright 2020 - Ricardo L. Olsen
+package i104mproto
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// I104M packets (all fields little endian uint32):
+//
+//	sequence: signature | number of objects | ASDU | common address | 0 | cause | info size | objects (address + info)
+//	single:   signature | object address | ASDU | common address | 0 | cause | info size | info
+//	command:  signature | object address | ASDU | value | select (sbo) | qualifier | common address
+const (
+	SequenceSignature uint32 = 0x64646464
+	SingleSignature   uint32 = 0x53535353
+	CommandSignature  uint32 = 0x4b4b4b4b
+	CommandFrameSize         = 28
+)
+
+// fields of a command frame
+type Command struct {
+	Addr   uint32
+	TiType uint32
+	Value  uint32
+	Sbo    uint32
+	Qu     uint32
+	Ca     uint32
+}
+
+// size of an information object (address + value + time tag) of a I104M ASDU
+func ObjectSize(iecASDU uint32) (uint32, bool) {
+	switch iecASDU {
+	case 1, // simples sem tag
+		3: // duplo sem tag
+		return 4 + 1, true
+	case 2, // simples com tag
+		4: // duplo com tag
+		return 4 + 1 + 3, true
+	case 30, // simples com tag longa
+		31: // duplo com tag longa
+		return 4 + 1 + 7, true
+	case 5: // reg pos
+		return 4 + 2, true
+	case 32: // reg pos c/ tag
+		return 4 + 2 + 7, true
+	case 9, // normalized
+		11: // scaled
+		return 4 + 3, true
+	case 34, // normalized c/ tag
+		35: // scaled c/ tag
+		return 4 + 3 + 7, true
+	case 13: // ponto flutuante
+		return 4 + 5, true
+	case 36: // ponto flutuante c/ tag
+		return 4 + 5 + 7, true
+	case 15:
+		return 4 + 5, true
+	}
+	return 0, false
+}
+
+// build a sequence packet from encoded objects (object address + information)
+func SequencePacket(numPoints uint32, iecAsdu uint32, commonAddress uint32, cause uint32, objects []byte) []byte {
+	objSize, _ := ObjectSize(iecAsdu)
+	infoSize := uint32(0)
+	if objSize > 4 {
+		infoSize = objSize - 4
+	}
+	return packet([]uint32{SequenceSignature, numPoints, iecAsdu, commonAddress, 0, cause, infoSize}, objects)
+}
+
+// build a single packet (one object)
+func SinglePacket(objAddr uint32, iecAsdu uint32, commonAddress uint32, cause uint32, info []byte) []byte {
+	return packet([]uint32{SingleSignature, objAddr, iecAsdu, commonAddress, 0, cause, uint32(len(info))}, info)
+}
+
+// build a command frame
+func CommandFrame(cmd Command) []byte {
+	return packet([]uint32{CommandSignature, cmd.Addr, cmd.TiType, cmd.Value, cmd.Sbo, cmd.Qu, cmd.Ca}, nil)
+}
+
+// decode a command frame, false when the frame is not a command frame
+func ParseCommandFrame(frame []byte) (Command, bool) {
+	if len(frame) < CommandFrameSize || binary.LittleEndian.Uint32(frame) != CommandSignature {
+		return Command{}, false
+	}
+	return Command{
+		Addr:   binary.LittleEndian.Uint32(frame[4:]),
+		TiType: binary.LittleEndian.Uint32(frame[8:]),
+		Value:  binary.LittleEndian.Uint32(frame[12:]),
+		Sbo:    binary.LittleEndian.Uint32(frame[16:]),
+		Qu:     binary.LittleEndian.Uint32(frame[20:]),
+		Ca:     binary.LittleEndian.Uint32(frame[24:]),
+	}, true
+}
+
+func packet(header []uint32, data []byte) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, 4*len(header)+len(data)))
+	for _, field := range header {
+		binary.Write(buf, binary.LittleEndian, field)
+	}
+	buf.Write(data)
+	return buf.Bytes()
+}
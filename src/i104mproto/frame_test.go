@@ -0,0 +1,50 @@
+package i104mproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func checkHeader(t *testing.T, name string, packet []byte, want ...uint32) {
+	t.Helper()
+	for i, w := range want {
+		if got := binary.LittleEndian.Uint32(packet[4*i:]); got != w {
+			t.Errorf("%s header field %d: %d, want %d", name, i, got, w)
+		}
+	}
+}
+
+func TestPackets(t *testing.T) {
+	objects := []byte{1, 0, 0, 0, 1, 2, 3, 4, 5, 2, 0, 0, 0, 6, 7, 8, 9, 10}
+	seq := SequencePacket(2, 13, 7, 20, objects)
+	checkHeader(t, "sequence", seq, SequenceSignature, 2, 13, 7, 0, 20, 5)
+	if !bytes.Equal(seq[28:], objects) {
+		t.Errorf("sequence objects % x", seq[28:])
+	}
+
+	single := SinglePacket(6001, 46, 7, 7, []byte{0x82})
+	checkHeader(t, "single", single, SingleSignature, 6001, 46, 7, 0, 7, 1)
+	if len(single) != 29 || single[28] != 0x82 {
+		t.Errorf("single packet % x", single)
+	}
+}
+
+func TestCommandFrame(t *testing.T) {
+	cmd := Command{Addr: 6001, TiType: 46, Value: 2, Sbo: 1, Qu: 3, Ca: 7}
+	frame := CommandFrame(cmd)
+	if len(frame) != CommandFrameSize {
+		t.Fatalf("command frame with %d bytes", len(frame))
+	}
+	checkHeader(t, "command", frame, CommandSignature, 6001, 46, 2, 1, 3, 7)
+	if got, ok := ParseCommandFrame(frame); !ok || got != cmd {
+		t.Errorf("parsed %+v %v, want %+v", got, ok, cmd)
+	}
+
+	if _, ok := ParseCommandFrame(frame[:CommandFrameSize-1]); ok {
+		t.Error("short frame parsed")
+	}
+	if _, ok := ParseCommandFrame(SinglePacket(6001, 46, 7, 7, []byte{0x82})); ok {
+		t.Error("single packet parsed as command")
+	}
+}
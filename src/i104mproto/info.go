@@ -0,0 +1,100 @@
+package i104mproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+// full scale of normalized values (ASDUs 9/34): the int16 at source is a fraction of 32768 (-1 to +1-2^-15)
+const NormalizedFullScale = 32768
+
+// value, quality and time tag of an information object
+type Info struct {
+	Value       float64 // normalized values as fraction (-1 to +1)
+	Invalid     bool
+	NotTopical  bool
+	Substituted bool
+	Blocked     bool
+	Overflow    bool // analogs
+	Transient   bool // double points and step positions
+	Time        time.Time
+	TimeOk      bool // IV bit of the time tag cleared
+}
+
+// encode the information of an object (value, quality and time tag) for its ASDU, false for ASDUs not supported.
+// Time tags are encoded in the time zone loc.
+func EncodeInfo(iecAsdu uint32, info Info, loc *time.Location) ([]byte, bool) {
+	var flags byte
+	if info.Invalid {
+		flags |= 0x80
+	}
+	if info.NotTopical {
+		flags |= 0x40
+	}
+	if info.Substituted {
+		flags |= 0x20
+	}
+	if info.Blocked {
+		flags |= 0x10
+	}
+
+	buf := new(bytes.Buffer)
+	switch iecAsdu {
+	case 1, 2, 30: // single
+		if info.Value != 0 {
+			flags |= 0x01
+		}
+		buf.WriteByte(flags)
+	case 3, 4, 31: // double: 10=on, 01=off, 00=transient
+		if !info.Transient {
+			if info.Value != 0 {
+				flags |= 0x02
+			} else {
+				flags |= 0x01
+			}
+		}
+		buf.WriteByte(flags)
+	case 5, 32: // step position
+		vti := byte(int8(math.Max(-64, math.Min(63, math.Round(info.Value))))) & 0x7F
+		if info.Transient {
+			vti |= 0x80
+		}
+		buf.WriteByte(vti)
+		buf.WriteByte(flags)
+	case 9, 34: // normalized
+		if info.Overflow {
+			flags |= 0x01
+		}
+		binary.Write(buf, binary.LittleEndian, NormalizedToInt16(info.Value))
+		buf.WriteByte(flags)
+	case 11, 35: // scaled
+		if info.Overflow {
+			flags |= 0x01
+		}
+		binary.Write(buf, binary.LittleEndian, int16(math.Max(math.MinInt16, math.Min(math.MaxInt16, math.Round(info.Value)))))
+		buf.WriteByte(flags)
+	case 13, 36: // float
+		if info.Overflow {
+			flags |= 0x01
+		}
+		binary.Write(buf, binary.LittleEndian, float32(info.Value))
+		buf.WriteByte(flags)
+	default:
+		return nil, false
+	}
+
+	switch iecAsdu {
+	case 2, 4: // CP24Time2a
+		buf.Write(EncodeCP56Time2a(info.Time, info.TimeOk, loc)[:3])
+	case 30, 31, 32, 34, 35, 36: // CP56Time2a
+		buf.Write(EncodeCP56Time2a(info.Time, info.TimeOk, loc))
+	}
+	return buf.Bytes(), true
+}
+
+// normalized value (fraction) to the int16 at source, limited to the int16 range
+func NormalizedToInt16(value float64) int16 {
+	return int16(math.Max(math.MinInt16, math.Min(math.MaxInt16, math.Round(value*NormalizedFullScale))))
+}
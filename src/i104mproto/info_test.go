@@ -0,0 +1,78 @@
+package i104mproto
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestEncodeInfo(t *testing.T) {
+	t0 := time.Date(2024, 3, 1, 10, 20, 30, 456000000, time.UTC) // friday
+	cp56 := []byte{0xF8, 0x76, 20, 10, 1 | 5<<5, 3, 24}
+	cp56Invalid := []byte{0xF8, 0x76, 20 | TimeTagInvalidBit, 10, 1 | 5<<5, 3, 24}
+	tests := []struct {
+		asdu uint32
+		info Info
+		want []byte
+	}{
+		{1, Info{Value: 1}, []byte{0x01}},
+		{1, Info{Invalid: true}, []byte{0x80}},
+		{3, Info{Value: 1}, []byte{0x02}},
+		{3, Info{Substituted: true}, []byte{0x21}},
+		{3, Info{Value: 1, Transient: true}, []byte{0x00}},
+		{30, Info{Value: 1, TimeOk: true}, append([]byte{0x01}, cp56...)},
+		{31, Info{TimeOk: true}, append([]byte{0x01}, cp56...)},
+		{2, Info{Value: 1, TimeOk: true}, append([]byte{0x01}, cp56[:3]...)},
+		{4, Info{Value: 1}, append([]byte{0x02}, cp56Invalid[:3]...)},
+		{5, Info{Value: -3}, []byte{0x7D, 0x00}},
+		{5, Info{Value: 100, Transient: true}, []byte{0xBF, 0x00}}, // clamped to 63
+		{32, Info{Value: 5, Blocked: true, TimeOk: true}, append([]byte{0x05, 0x10}, cp56...)},
+		{9, Info{Value: 0.5}, []byte{0x00, 0x40, 0x00}},
+		{9, Info{Value: -2, Overflow: true}, []byte{0x00, 0x80, 0x01}}, // clamped to -1
+		{34, Info{Value: 1, TimeOk: true}, append([]byte{0xFF, 0x7F, 0x00}, cp56...)},
+		{11, Info{Value: 1000}, []byte{0xE8, 0x03, 0x00}},
+		{11, Info{Value: 40000}, []byte{0xFF, 0x7F, 0x00}}, // clamped
+		{35, Info{Value: -1, NotTopical: true, TimeOk: true}, append([]byte{0xFF, 0xFF, 0x40}, cp56...)},
+		{13, Info{Value: 1.5}, []byte{0x00, 0x00, 0xC0, 0x3F, 0x00}},
+		{36, Info{Value: 1.5, Invalid: true}, append([]byte{0x00, 0x00, 0xC0, 0x3F, 0x80}, cp56Invalid...)},
+	}
+	for _, test := range tests {
+		test.info.Time = t0
+		got, ok := EncodeInfo(test.asdu, test.info, time.UTC)
+		if !ok {
+			t.Errorf("asdu %d: not encoded", test.asdu)
+			continue
+		}
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("asdu %d %+v: % x, want % x", test.asdu, test.info, got, test.want)
+		}
+		if size, _ := ObjectSize(test.asdu); uint32(len(got)) != size-4 {
+			t.Errorf("asdu %d: %d bytes, object size %d", test.asdu, len(got), size)
+		}
+	}
+
+	for _, asdu := range []uint32{0, 7, 15, 45, 100} {
+		if _, ok := EncodeInfo(asdu, Info{Value: 1}, time.UTC); ok {
+			t.Errorf("asdu %d encoded", asdu)
+		}
+	}
+}
+
+func TestNormalizedToInt16(t *testing.T) {
+	for _, tt := range []struct {
+		value float64
+		want  int16
+	}{
+		{0, 0},
+		{0.5, 16384},
+		{-1, math.MinInt16},
+		{1, math.MaxInt16},
+		{-2, math.MinInt16},
+		{3, math.MaxInt16},
+	} {
+		if got := NormalizedToInt16(tt.value); got != tt.want {
+			t.Errorf("NormalizedToInt16(%g): got %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
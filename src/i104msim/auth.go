@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"i104mproto"
+)
+
+// Authenticated datagrams, as the driver with "authMode" "required" (see the i104m README and i104mproto)
+
+// signs frames sent and verifies frames received with one key, nil = no authentication
+type Authenticator struct {
+	keyId   uint32
+	key     []byte
+	sendSeq i104mproto.Sequence
+}
+
+// nil when the key is not configured
+func NewAuthenticator(keyId int, hexKey string) (*Authenticator, error) {
+	hexKey = strings.TrimSpace(hexKey)
+	if hexKey == "" {
+		return nil, nil
+	}
+	key, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid authKey: %v", err)
+	}
+	if len(key) < 16 {
+		return nil, errors.New("invalid authKey: key must have 16 bytes or more")
+	}
+	return &Authenticator{keyId: uint32(keyId), key: key}, nil
+}
+
+// sign a frame, the sequence is the clock in microseconds (incremented when needed)
+func (a *Authenticator) Seal(frame []byte, now time.Time) []byte {
+	if a == nil {
+		return frame
+	}
+	return i104mproto.Sign(a.keyId, a.key, a.sendSeq.Next(now), frame)
+}
+
+// verify a received frame and return the payload, unsigned frames are returned as is.
+// Sequences are not checked for replays (test tool).
+func (a *Authenticator) Open(datagram []byte) ([]byte, error) {
+	if !i104mproto.IsAuthenticated(datagram) {
+		return datagram, nil
+	}
+	if a == nil {
+		return nil, errors.New("authenticated frame received, authKey not configured")
+	}
+	_, _, payload, err := i104mproto.Verify(datagram, func(keyId uint32) ([]byte, bool) {
+		return a.key, keyId == a.keyId
+	})
+	return payload, err
+}
@@ -0,0 +1,471 @@
+// I104M peer simulator: plays the role of an OSHMI gateway for testing and commissioning of the I104M driver.
+// Sends points (generated or scripted) to the driver and answers command frames with confirmations.
+// {json:scada} - Copyright 2020 - Ricardo L. Olsen
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"i104mproto"
+)
+
+var Version string = "{json:scada} I104M Peer Simulator v.0.1 - Copyright 2020 Ricardo L. Olsen"
+
+const MaxPointsPerPacket = 100
+
+// causes of transmission
+const (
+	COT_PERIODIC      = 1
+	COT_SPONTANEOUS   = 3
+	COT_ACTCON        = 7
+	COT_ACTTERM       = 10
+	COT_INTERROGATED  = 20
+	COT_NEGATIVE_FLAG = 0x40
+	C_IC_NA_1         = 100
+	C_CS_NA_1         = 103
+)
+
+// Scenario file (JSON)
+type Scenario struct {
+	DriverAddress        string         `json:"driverAddress"`        // where to send packets (host:port, or socket path for unix)
+	ListenAddress        string         `json:"listenAddress"`        // local UDP address to send from and receive commands
+	Transport            string         `json:"transport"`            // "udp" (default), "tcp" or "unix" (connects to the driver)
+	CommonAddress        int            `json:"commonAddress"`        // primary address of packets
+	TimeZone             string         `json:"timeZone"`             // time zone of time tags ("UTC" default)
+	ConfirmCommands      *bool          `json:"confirmCommands"`      // answer command frames with activation confirmation (default true)
+	RejectAddresses      []int          `json:"rejectAddresses"`      // commands to these addresses are confirmed negative
+	CommandFeedback      map[string]int `json:"commandFeedback"`      // command address -> point address updated with the command value
+	CommandResponseDelay int            `json:"commandResponseDelay"` // delay of command confirmations in ms
+	AuthKeyId            int            `json:"authKeyId"`            // key id to sign frames
+	AuthKey              string         `json:"authKey"`              // HMAC key (hex) to sign frames, "" = unsigned (legacy)
+	Points               []PointSim     `json:"points"`
+	Script               []ScriptStep   `json:"script"`
+	RepeatScript         bool           `json:"repeatScript"`
+}
+
+// Simulated point, values are generated each period (seconds) and sent as spontaneous
+type PointSim struct {
+	Address int     `json:"address"`
+	Asdu    int     `json:"asdu"`   // 1,2,30 single; 3,4,31 double; 5,32 step; 9,34 normalized; 11,35 scaled; 13,36 float
+	Mode    string  `json:"mode"`   // "constant" (default), "toggle", "ramp", "random", "sine"
+	Period  float64 `json:"period"` // seconds between changes (0 = no changes, sent only on interrogation)
+	Value   float64 `json:"value"`  // initial value
+	Min     float64 `json:"min"`
+	Max     float64 `json:"max"`
+	Step    float64 `json:"step"`
+	Invalid bool    `json:"invalid"`
+	next    time.Time
+	phase   float64
+}
+
+// Scripted change of a point, "at" in seconds from start
+type ScriptStep struct {
+	At          float64 `json:"at"`
+	Address     int     `json:"address"`
+	Value       float64 `json:"value"`
+	Asdu        int     `json:"asdu"` // 0 = ASDU of the point
+	Cause       int     `json:"cause"`
+	Invalid     bool    `json:"invalid"`
+	NotTopical  bool    `json:"notTopical"`
+	Substituted bool    `json:"substituted"`
+	Blocked     bool    `json:"blocked"`
+	Interrogate bool    `json:"interrogate"` // send all points as interrogated (address/value ignored)
+}
+
+type Simulator struct {
+	scenario Scenario
+	loc      *time.Location
+	mutex    sync.Mutex
+	points   map[int]*PointSim
+	auth     *Authenticator
+	send     func(frame []byte) error
+}
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+	log.Println(Version)
+
+	scenarioFile := flag.String("scenario", "scenario.json", "scenario file (JSON)")
+	flag.Parse()
+
+	if err := run(*scenarioFile); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+}
+
+func run(scenarioFile string) error {
+	file, err := ioutil.ReadFile(scenarioFile)
+	if err != nil {
+		return err
+	}
+	sim := &Simulator{points: map[int]*PointSim{}}
+	if err := json.Unmarshal(file, &sim.scenario); err != nil {
+		return fmt.Errorf("error parsing scenario %s: %v", scenarioFile, err)
+	}
+	sc := &sim.scenario
+	if sc.DriverAddress == "" {
+		sc.DriverAddress = "127.0.0.1:8099"
+	}
+	if sc.TimeZone == "" {
+		sc.TimeZone = "UTC"
+	}
+	if sim.loc, err = time.LoadLocation(sc.TimeZone); err != nil {
+		return err
+	}
+	if sim.auth, err = NewAuthenticator(sc.AuthKeyId, sc.AuthKey); err != nil {
+		return err
+	}
+	for i := range sc.Points {
+		p := &sc.Points[i]
+		if _, ok := i104mproto.EncodeInfo(uint32(p.Asdu), i104mproto.Info{}, time.UTC); !ok {
+			return fmt.Errorf("point %d: unsupported ASDU %d", p.Address, p.Asdu)
+		}
+		sim.points[p.Address] = p
+	}
+	sort.SliceStable(sc.Script, func(i, j int) bool { return sc.Script[i].At < sc.Script[j].At })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+
+	var receive func(handle func(frame []byte)) error
+	switch strings.ToLower(sc.Transport) {
+	case "", "udp":
+		laddr, err := net.ResolveUDPAddr("udp", sc.ListenAddress)
+		if err != nil {
+			return err
+		}
+		raddr, err := net.ResolveUDPAddr("udp", sc.DriverAddress)
+		if err != nil {
+			return err
+		}
+		conn, err := net.ListenUDP("udp", laddr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		go func() { <-ctx.Done(); conn.Close() }()
+		sim.send = func(frame []byte) error {
+			_, err := conn.WriteToUDP(frame, raddr)
+			return err
+		}
+		receive = func(handle func(frame []byte)) error {
+			buf := make([]byte, 2048)
+			for {
+				n, _, err := conn.ReadFromUDP(buf)
+				if err != nil {
+					return err
+				}
+				handle(buf[:n])
+			}
+		}
+		log.Println("Sending to ", sc.DriverAddress, " via UDP from ", conn.LocalAddr())
+	case "tcp", "unix":
+		conn, err := net.Dial(strings.ToLower(sc.Transport), sc.DriverAddress)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		go func() { <-ctx.Done(); conn.Close() }()
+		var writeMutex sync.Mutex
+		sim.send = func(frame []byte) error {
+			msg := make([]byte, 4, 4+len(frame))
+			binary.LittleEndian.PutUint32(msg, uint32(len(frame)))
+			writeMutex.Lock()
+			defer writeMutex.Unlock()
+			_, err := conn.Write(append(msg, frame...))
+			return err
+		}
+		receive = func(handle func(frame []byte)) error {
+			var lenBuf [4]byte
+			buf := make([]byte, 65535)
+			for {
+				if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+					return err
+				}
+				size := binary.LittleEndian.Uint32(lenBuf[:])
+				if size > uint32(len(buf)) {
+					return fmt.Errorf("invalid frame size %d", size)
+				}
+				if _, err := io.ReadFull(conn, buf[:size]); err != nil {
+					return err
+				}
+				handle(buf[:size])
+			}
+		}
+		log.Println("Connected to ", sc.DriverAddress, " via ", sc.Transport)
+	default:
+		return fmt.Errorf("invalid transport '%s'", sc.Transport)
+	}
+
+	go func() {
+		err := receive(sim.handleFrame)
+		if ctx.Err() == nil {
+			log.Println("Receive error: ", err)
+			cancel()
+		}
+	}()
+
+	// initial integrity data
+	sim.sendInterrogated()
+	sim.runLoop(ctx)
+	return nil
+}
+
+// generate point changes and execute the script until canceled
+func (sim *Simulator) runLoop(ctx context.Context) {
+	start := time.Now()
+	scriptIndex := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+		now := time.Now()
+
+		sim.mutex.Lock()
+		var changed []*PointSim
+		for _, p := range sim.scenario.Points {
+			p := sim.points[p.Address]
+			if p.Period <= 0 {
+				continue
+			}
+			if p.next.IsZero() {
+				p.next = now.Add(time.Duration(p.Period * float64(time.Second)))
+				continue
+			}
+			if now.Before(p.next) {
+				continue
+			}
+			p.next = p.next.Add(time.Duration(p.Period * float64(time.Second)))
+			p.generate()
+			changed = append(changed, p)
+		}
+		sim.mutex.Unlock()
+		sim.sendPoints(changed, COT_SPONTANEOUS, now)
+
+		script := sim.scenario.Script
+		for scriptIndex < len(script) && now.Sub(start).Seconds() >= script[scriptIndex].At {
+			sim.runStep(script[scriptIndex], now)
+			scriptIndex++
+		}
+		if scriptIndex >= len(script) && len(script) > 0 && sim.scenario.RepeatScript {
+			scriptIndex = 0
+			start = now
+		}
+	}
+}
+
+// next value of a generated point
+func (p *PointSim) generate() {
+	switch p.Mode {
+	case "toggle":
+		if p.Value == 0 {
+			p.Value = 1
+		} else {
+			p.Value = 0
+		}
+	case "ramp":
+		step := p.Step
+		if step == 0 {
+			step = 1
+		}
+		p.Value += step
+		if p.Value > p.Max {
+			p.Value = p.Min
+		}
+	case "random":
+		p.Value = p.Min + rand.Float64()*(p.Max-p.Min)
+	case "sine":
+		step := p.Step
+		if step == 0 {
+			step = 0.1
+		}
+		p.phase += step
+		p.Value = p.Min + (p.Max-p.Min)*(1+math.Sin(p.phase))/2
+	}
+}
+
+func (sim *Simulator) runStep(step ScriptStep, now time.Time) {
+	if step.Interrogate {
+		sim.sendInterrogated()
+		return
+	}
+	sim.mutex.Lock()
+	p, ok := sim.points[step.Address]
+	if !ok {
+		p = &PointSim{Address: step.Address, Asdu: step.Asdu}
+		sim.points[step.Address] = p
+	}
+	p.Value = step.Value
+	p.Invalid = step.Invalid
+	upd := *p
+	sim.mutex.Unlock()
+
+	asdu := step.Asdu
+	if asdu == 0 {
+		asdu = upd.Asdu
+	}
+	cause := step.Cause
+	if cause == 0 {
+		cause = COT_SPONTANEOUS
+	}
+	info, ok := i104mproto.EncodeInfo(uint32(asdu), i104mproto.Info{
+		Value:       upd.Value,
+		Invalid:     step.Invalid,
+		NotTopical:  step.NotTopical,
+		Substituted: step.Substituted,
+		Blocked:     step.Blocked,
+		Time:        now,
+		TimeOk:      true,
+	}, sim.loc)
+	if !ok {
+		log.Printf("Script step: unsupported ASDU %d", asdu)
+		return
+	}
+	log.Printf("Script: address %d asdu %d value %g cause %d", step.Address, asdu, step.Value, cause)
+	sim.sendFrame(i104mproto.SinglePacket(uint32(step.Address), uint32(asdu), uint32(sim.scenario.CommonAddress), uint32(cause), info))
+}
+
+// send all points with cause interrogated (20), sequence packets grouped by ASDU
+func (sim *Simulator) sendInterrogated() {
+	sim.mutex.Lock()
+	var points []*PointSim
+	for _, p := range sim.points {
+		points = append(points, p)
+	}
+	sim.mutex.Unlock()
+	sort.Slice(points, func(i, j int) bool { return points[i].Address < points[j].Address })
+	log.Printf("Sending %d points as interrogated", len(points))
+	sim.sendPoints(points, COT_INTERROGATED, time.Now())
+}
+
+func (sim *Simulator) sendPoints(points []*PointSim, cause int, now time.Time) {
+	// copy the point state, changed by the script and by command feedback
+	sim.mutex.Lock()
+	byAsdu := map[int][]PointSim{}
+	for _, p := range points {
+		byAsdu[p.Asdu] = append(byAsdu[p.Asdu], PointSim{Address: p.Address, Asdu: p.Asdu, Value: p.Value, Invalid: p.Invalid})
+	}
+	sim.mutex.Unlock()
+
+	for asdu, list := range byAsdu {
+		for len(list) > 0 {
+			n := len(list)
+			if n > MaxPointsPerPacket {
+				n = MaxPointsPerPacket
+			}
+			var objs bytes.Buffer
+			encoded := 0 // objects declared in the header
+			for _, p := range list[:n] {
+				info, ok := i104mproto.EncodeInfo(uint32(asdu), i104mproto.Info{Value: p.Value, Invalid: p.Invalid, Time: now, TimeOk: true}, sim.loc)
+				if !ok {
+					log.Printf("Point %d: unsupported ASDU %d", p.Address, asdu)
+					continue
+				}
+				binary.Write(&objs, binary.LittleEndian, uint32(p.Address))
+				objs.Write(info)
+				encoded++
+			}
+			if encoded > 0 {
+				sim.sendFrame(i104mproto.SequencePacket(uint32(encoded), uint32(asdu), uint32(sim.scenario.CommonAddress), uint32(cause), objs.Bytes()))
+			}
+			list = list[n:]
+		}
+	}
+}
+
+func (sim *Simulator) sendFrame(frame []byte) {
+	if err := sim.send(sim.auth.Seal(frame, time.Now())); err != nil {
+		log.Println("Send error: ", err)
+	}
+}
+
+// handle a frame received from the driver (command frames)
+func (sim *Simulator) handleFrame(frame []byte) {
+	frame, err := sim.auth.Open(frame)
+	if err != nil {
+		log.Println("Frame discarded: ", err)
+		return
+	}
+	cmd, ok := i104mproto.ParseCommandFrame(frame)
+	if !ok {
+		log.Printf("Ignored frame with %d bytes", len(frame))
+		return
+	}
+	addr, tiType, value, sbo, qu, ca := cmd.Addr, cmd.TiType, cmd.Value, cmd.Sbo, cmd.Qu, cmd.Ca
+	log.Printf("Command received: address %d type %d value %d sbo %d qu %d ca %d", addr, tiType, value, sbo, qu, ca)
+
+	if sim.scenario.ConfirmCommands != nil && !*sim.scenario.ConfirmCommands {
+		return
+	}
+	negative := false
+	for _, a := range sim.scenario.RejectAddresses {
+		if uint32(a) == addr {
+			negative = true
+		}
+	}
+
+	go func() {
+		time.Sleep(time.Duration(sim.scenario.CommandResponseDelay) * time.Millisecond)
+		cause := uint32(COT_ACTCON)
+		if negative {
+			cause |= COT_NEGATIVE_FLAG
+		} else if sbo != 0 && tiType >= 45 && tiType <= 47 {
+			// select confirmation (S/E bit) before the execute confirmation
+			sim.sendFrame(i104mproto.SinglePacket(addr, tiType, ca, cause, []byte{byte(value) | 0x80}))
+		}
+		sim.sendFrame(i104mproto.SinglePacket(addr, tiType, ca, cause, []byte{byte(value)}))
+		if negative {
+			return
+		}
+		switch tiType {
+		case C_IC_NA_1:
+			sim.sendInterrogated()
+			sim.sendFrame(i104mproto.SinglePacket(addr, tiType, ca, COT_ACTTERM, []byte{byte(value)}))
+		case C_CS_NA_1:
+		default:
+			if feedback, ok := sim.scenario.CommandFeedback[fmt.Sprint(addr)]; ok {
+				sim.runStep(ScriptStep{Address: feedback, Value: commandFeedbackValue(tiType, value)}, time.Now())
+			}
+		}
+	}()
+}
+
+// value of the feedback point for a command (double commands: 1=off, 2=on)
+func commandFeedbackValue(tiType uint32, value uint32) float64 {
+	switch tiType {
+	case 46, 59:
+		if value&0x03 == 2 {
+			return 1
+		}
+		return 0
+	}
+	return float64(value)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"i104mproto"
+)
+
+// simulator recording the frames sent
+func newTestSimulator(points ...PointSim) (*Simulator, *[][]byte) {
+	sim := &Simulator{points: map[int]*PointSim{}, loc: time.UTC}
+	for i := range points {
+		sim.points[points[i].Address] = &points[i]
+	}
+	var mutex sync.Mutex
+	var sent [][]byte
+	sim.send = func(frame []byte) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		sent = append(sent, append([]byte(nil), frame...))
+		return nil
+	}
+	return sim, &sent
+}
+
+// the number of objects in the header matches the objects encoded
+func TestSendPoints(t *testing.T) {
+	var points []PointSim
+	for addr := 1; addr <= MaxPointsPerPacket+1; addr++ {
+		points = append(points, PointSim{Address: addr, Asdu: 13, Value: float64(addr)})
+	}
+	points = append(points, PointSim{Address: 5000, Value: 1}) // created by a script step without ASDU, not encoded
+	sim, sent := newTestSimulator(points...)
+	sim.sendInterrogated()
+
+	if len(*sent) != 2 {
+		t.Fatalf("want 2 packets, got %d", len(*sent))
+	}
+	total := 0
+	for _, packet := range *sent {
+		n := int(binary.LittleEndian.Uint32(packet[4:]))
+		if size, _ := i104mproto.ObjectSize(13); len(packet) != 28+n*int(size) {
+			t.Errorf("packet with %d bytes for %d objects", len(packet), n)
+		}
+		total += n
+	}
+	if total != MaxPointsPerPacket+1 {
+		t.Errorf("%d objects sent", total)
+	}
+}
+
+// points are changed by the script and by command feedback while sent (run with -race)
+func TestSendPointsConcurrent(t *testing.T) {
+	sim, _ := newTestSimulator(PointSim{Address: 1000, Asdu: 31}, PointSim{Address: 2000, Asdu: 13})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			sim.runStep(ScriptStep{Address: 2000, Value: float64(i)}, time.Now())
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		sim.sendInterrogated()
+	}
+	<-done
+}
+
+func TestAuthenticator(t *testing.T) {
+	now := time.Now()
+	a, err := NewAuthenticator(3, "000102030405060708090a0b0c0d0e0f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := i104mproto.SinglePacket(1000, 1, 1, COT_SPONTANEOUS, []byte{0x01})
+	first := a.Seal(frame, now)
+	second := a.Seal(frame, now)
+	if binary.LittleEndian.Uint32(first) != i104mproto.AuthSignature || binary.LittleEndian.Uint32(first[4:]) != 3 {
+		t.Errorf("header % x", first[:i104mproto.AuthHeaderSize])
+	}
+	if binary.LittleEndian.Uint64(second[8:]) <= binary.LittleEndian.Uint64(first[8:]) {
+		t.Error("sequence not increased")
+	}
+	if payload, err := a.Open(first); err != nil || !bytes.Equal(payload, frame) {
+		t.Errorf("round trip: %v % x", err, payload)
+	}
+	first[len(first)-1] ^= 1
+	if _, err := a.Open(first); err == nil {
+		t.Error("bad HMAC accepted")
+	}
+	if payload, err := a.Open(frame); err != nil || !bytes.Equal(payload, frame) {
+		t.Error("unsigned frame not accepted")
+	}
+
+	// sent unsigned without key
+	var none *Authenticator
+	if !bytes.Equal(none.Seal(frame, now), frame) {
+		t.Error("frame signed without key")
+	}
+	if _, err := none.Open(second); err == nil {
+		t.Error("signed frame accepted without key")
+	}
+	if a, err := NewAuthenticator(1, ""); a != nil || err != nil {
+		t.Error("authenticator without key")
+	}
+	for _, key := range []string{"0011", "xyz"} {
+		if _, err := NewAuthenticator(1, key); err == nil {
+			t.Errorf("key %s accepted", key)
+		}
+	}
+}
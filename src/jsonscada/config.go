@@ -0,0 +1,87 @@
+// Package jsonscada has the configuration and MongoDB connection code shared by the {json:scada} Go processes.
+// {json:scada} - Copyright 2020 - Ricardo L. Olsen
+package jsonscada
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// default config file, relative to the bin folder
+var DefaultConfigFile = filepath.Join("..", "conf", "json-scada.json")
+
+// Contents of the json-scada.json config file
+type Config struct {
+	NodeName                 string `json:"nodeName"`
+	MongoConnectionString    string `json:"mongoConnectionString"`
+	MongoDatabaseName        string `json:"mongoDatabaseName"`
+	TlsCaPemFile             string `json:"tlsCaPemFile"`
+	TlsClientPemFile         string `json:"tlsClientPemFile"`
+	TlsClientPfxFile         string `json:"tlsClientPfxFile"`
+	TlsClientKeyPassword     string `json:"tlsClientKeyPassword"`
+	TlsAllowInvalidHostnames bool   `json:"tlsAllowInvalidHostnames"`
+	TlsAllowChainErrors      bool   `json:"tlsAllowChainErrors"`
+	TlsInsecure              bool   `json:"tlsInsecure"`
+}
+
+// Read the config file. The environment variables JS_NODE_NAME, JS_MONGO_CONNECTION_STRING and JS_MONGO_DATABASE_NAME
+// override the file (for containers).
+func ReadConfig(fileName string) (Config, error) {
+	cfg := Config{}
+	file, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return cfg, fmt.Errorf("can not read config file: %v", err)
+	}
+	if err := json.Unmarshal(file, &cfg); err != nil {
+		return cfg, fmt.Errorf("error parsing config file %s: %v", fileName, err)
+	}
+
+	cfg.NodeName = strings.TrimSpace(EnvString("JS_NODE_NAME", cfg.NodeName))
+	cfg.MongoConnectionString = strings.TrimSpace(EnvString("JS_MONGO_CONNECTION_STRING", cfg.MongoConnectionString))
+	cfg.MongoDatabaseName = strings.TrimSpace(EnvString("JS_MONGO_DATABASE_NAME", cfg.MongoDatabaseName))
+	cfg.TlsCaPemFile = strings.TrimSpace(cfg.TlsCaPemFile)
+	cfg.TlsClientPemFile = strings.TrimSpace(cfg.TlsClientPemFile)
+	cfg.TlsClientPfxFile = strings.TrimSpace(cfg.TlsClientPfxFile)
+
+	var missing []string
+	if cfg.NodeName == "" {
+		missing = append(missing, "nodeName (or env JS_NODE_NAME)")
+	}
+	if cfg.MongoConnectionString == "" {
+		missing = append(missing, "mongoConnectionString (or env JS_MONGO_CONNECTION_STRING)")
+	}
+	if cfg.MongoDatabaseName == "" {
+		missing = append(missing, "mongoDatabaseName (or env JS_MONGO_DATABASE_NAME)")
+	}
+	if len(missing) > 0 {
+		return cfg, errors.New("missing in config file " + fileName + ": " + strings.Join(missing, ", "))
+	}
+	return cfg, nil
+}
+
+// value of environment variable or default when not set
+func EnvString(name string, def string) string {
+	if v, ok := os.LookupEnv(name); ok && strings.TrimSpace(v) != "" {
+		return v
+	}
+	return def
+}
+
+// integer value of environment variable or default when not set
+func EnvInt(name string, def int) (int, error) {
+	v := strings.TrimSpace(EnvString(name, ""))
+	if v == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return def, fmt.Errorf("invalid value '%s' for %s", v, name)
+	}
+	return i, nil
+}
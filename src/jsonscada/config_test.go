@@ -0,0 +1,110 @@
+package jsonscada
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, name string, data string) string {
+	t.Helper()
+	fileName := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(fileName, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func TestReadConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		want Config
+		err  string // part of the error message, "" if no error
+	}{
+		{"complete", `{"nodeName": " mainNode ", "mongoConnectionString": "mongodb://localhost/", "mongoDatabaseName": "json_scada", "tlsCaPemFile": " ca.pem "}`,
+			nil, Config{NodeName: "mainNode", MongoConnectionString: "mongodb://localhost/", MongoDatabaseName: "json_scada", TlsCaPemFile: "ca.pem"}, ""},
+		{"environment overrides", `{"nodeName": "mainNode", "mongoConnectionString": "mongodb://localhost/", "mongoDatabaseName": "json_scada"}`,
+			map[string]string{"JS_NODE_NAME": "node2", "JS_MONGO_CONNECTION_STRING": "mongodb://other/", "JS_MONGO_DATABASE_NAME": "db2"},
+			Config{NodeName: "node2", MongoConnectionString: "mongodb://other/", MongoDatabaseName: "db2"}, ""},
+		{"blank environment ignored", `{"nodeName": "mainNode", "mongoConnectionString": "mongodb://localhost/", "mongoDatabaseName": "json_scada"}`,
+			map[string]string{"JS_NODE_NAME": " "},
+			Config{NodeName: "mainNode", MongoConnectionString: "mongodb://localhost/", MongoDatabaseName: "json_scada"}, ""},
+		{"from environment only", `{}`,
+			map[string]string{"JS_NODE_NAME": "node2", "JS_MONGO_CONNECTION_STRING": "mongodb://other/", "JS_MONGO_DATABASE_NAME": "db2"},
+			Config{NodeName: "node2", MongoConnectionString: "mongodb://other/", MongoDatabaseName: "db2"}, ""},
+		{"missing", `{"nodeName": "mainNode"}`, nil, Config{},
+			"mongoConnectionString (or env JS_MONGO_CONNECTION_STRING), mongoDatabaseName (or env JS_MONGO_DATABASE_NAME)"},
+		{"invalid json", `{"nodeName": `, nil, Config{}, "error parsing config file"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, name := range []string{"JS_NODE_NAME", "JS_MONGO_CONNECTION_STRING", "JS_MONGO_DATABASE_NAME"} {
+				t.Setenv(name, test.env[name])
+			}
+			cfg, err := ReadConfig(writeFile(t, "json-scada.json", test.file))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg != test.want {
+				t.Errorf("got %+v, want %+v", cfg, test.want)
+			}
+		})
+	}
+
+	if _, err := ReadConfig(filepath.Join(t.TempDir(), "none.json")); err == nil || !strings.Contains(err.Error(), "can not read config file") {
+		t.Errorf("missing file: %v", err)
+	}
+}
+
+func TestEnvString(t *testing.T) {
+	tests := []struct {
+		value string
+		set   bool
+		want  string
+	}{
+		{"", false, "default"},
+		{"", true, "default"},
+		{"  ", true, "default"},
+		{"value", true, "value"},
+		{" value ", true, " value "}, // not trimmed
+	}
+	for _, test := range tests {
+		os.Unsetenv("JS_TEST_STRING")
+		if test.set {
+			t.Setenv("JS_TEST_STRING", test.value)
+		}
+		if got := EnvString("JS_TEST_STRING", "default"); got != test.want {
+			t.Errorf("EnvString(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestEnvInt(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+		err   bool
+	}{
+		{"", 7, false},
+		{" 12 ", 12, false},
+		{"-3", -3, false},
+		{"1.5", 7, true},
+		{"abc", 7, true},
+	}
+	for _, test := range tests {
+		t.Setenv("JS_TEST_INT", test.value)
+		got, err := EnvInt("JS_TEST_INT", 7)
+		if got != test.want || (err != nil) != test.err {
+			t.Errorf("EnvInt(%q) = %d, %v, want %d error %v", test.value, got, err, test.want, test.err)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package jsonscada
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/youmark/pkcs8"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/pkcs12"
+)
+
+// names of the collections used by the Go processes
+const (
+	RealtimeDataCollectionName            = "realtimeData"
+	ProtocolDriverInstancesCollectionName = "protocolDriverInstances"
+	ProtocolConnectionsCollectionName     = "protocolConnections"
+	CommandsQueueCollectionName           = "commandsQueue"
+)
+
+// build MongoDB client options from the config, TLS settings are applied programmatically
+// (not appended to the connection string)
+func ClientOptions(cfg Config) (*options.ClientOptions, error) {
+	opts := options.Client().ApplyURI(cfg.MongoConnectionString)
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid mongoConnectionString: %v", err)
+	}
+	tlsConfig, err := TLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		if opts.TLSConfig != nil { // keep CA and client certificate given on the connection string
+			if tlsConfig.RootCAs == nil {
+				tlsConfig.RootCAs = opts.TLSConfig.RootCAs
+			}
+			if tlsConfig.Certificates == nil {
+				tlsConfig.Certificates = opts.TLSConfig.Certificates
+			}
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+	return opts, nil
+}
+
+// connect to the MongoDB server
+func Connect(ctx context.Context, cfg Config) (*mongo.Client, error) {
+	opts, err := ClientOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return mongo.Connect(ctx, opts)
+}
+
+// TLS config from CA and client certificate files (PEM or PFX) and verification flags, nil when no TLS option is configured.
+// System CAs are used when no CA file is configured.
+func TLSConfig(cfg Config) (*tls.Config, error) {
+	if cfg.TlsCaPemFile == "" && cfg.TlsClientPemFile == "" && cfg.TlsClientPfxFile == "" &&
+		!cfg.TlsInsecure && !cfg.TlsAllowChainErrors && !cfg.TlsAllowInvalidHostnames {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{}
+
+	if cfg.TlsCaPemFile != "" {
+		caPem, err := ioutil.ReadFile(cfg.TlsCaPemFile)
+		if err != nil {
+			return nil, fmt.Errorf("can not read tlsCaPemFile: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caPem) {
+			return nil, errors.New("no certificates found in tlsCaPemFile " + cfg.TlsCaPemFile)
+		}
+	}
+
+	var certPem, keyPem []byte
+	var err error
+	switch {
+	case cfg.TlsClientPfxFile != "":
+		certPem, keyPem, err = readPfx(cfg.TlsClientPfxFile, cfg.TlsClientKeyPassword)
+	case cfg.TlsClientPemFile != "":
+		certPem, keyPem, err = readPem(cfg.TlsClientPemFile, cfg.TlsClientKeyPassword)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if certPem != nil {
+		cert, err := tls.X509KeyPair(certPem, keyPem)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	switch {
+	case cfg.TlsInsecure || cfg.TlsAllowChainErrors:
+		tlsConfig.InsecureSkipVerify = true
+	case cfg.TlsAllowInvalidHostnames:
+		// verify the certificate chain but not the host name
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyChain(rawCerts, tlsConfig.RootCAs)
+		}
+	}
+	return tlsConfig, nil
+}
+
+func verifyChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no server certificate")
+	}
+	intermediates := x509.NewCertPool()
+	var leaf *x509.Certificate
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			leaf = cert
+		} else {
+			intermediates.AddCert(cert)
+		}
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+	return err
+}
+
+// read PKCS#12 (PFX) file, return certificates and key as PEM
+func readPfx(fileName string, password string) (certPem []byte, keyPem []byte, err error) {
+	pfx, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can not read tlsClientPfxFile: %v", err)
+	}
+	blocks, err := pkcs12.ToPEM(pfx, password)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can not decode tlsClientPfxFile: %v", err)
+	}
+	for _, block := range blocks {
+		if block.Type == "CERTIFICATE" {
+			certPem = append(certPem, pem.EncodeToMemory(block)...)
+		} else {
+			keyPem = append(keyPem, pem.EncodeToMemory(block)...)
+		}
+	}
+	return certPem, keyPem, nil
+}
+
+// read PEM file with certificate and key, the key can be encrypted with PKCS#8.
+// Legacy PEM encryption (Proc-Type header) is insecure and refused.
+func readPem(fileName string, password string) (certPem []byte, keyPem []byte, err error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can not read tlsClientPemFile: %v", err)
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch {
+		case block.Type == "CERTIFICATE":
+			certPem = append(certPem, pem.EncodeToMemory(block)...)
+		case block.Type == "ENCRYPTED PRIVATE KEY":
+			key, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, []byte(password))
+			if err != nil {
+				return nil, nil, fmt.Errorf("can not decrypt client key: %v", err)
+			}
+			der, err := x509.MarshalPKCS8PrivateKey(key)
+			if err != nil {
+				return nil, nil, err
+			}
+			keyPem = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		case strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED"):
+			return nil, nil, errors.New("legacy PEM encryption of the client key is not supported, convert the key to PKCS#8 (openssl pkcs8 -topk8)")
+		case strings.HasSuffix(block.Type, "PRIVATE KEY"):
+			keyPem = pem.EncodeToMemory(block)
+		}
+	}
+	return certPem, keyPem, nil
+}
@@ -0,0 +1,177 @@
+package jsonscada
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/youmark/pkcs8"
+)
+
+// CA certificate, and a client certificate and key signed by the CA, as PEM
+func testCertificates(t *testing.T) (caPem string, certPem string, key *ecdsa.PrivateKey, certDer []byte) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "mongodb"},
+		DNSNames:     []string{"mongodb"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	caCert, err := x509.ParseCertificate(caDer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certDer, err = x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPem = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDer}))
+	certPem = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer}))
+	return caPem, certPem, key, certDer
+}
+
+func TestTLSConfig(t *testing.T) {
+	caPem, certPem, key, certDer := testCertificates(t)
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPem := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}))
+	encryptedDer, err := pkcs8.MarshalPrivateKey(key, []byte("secret"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedPem := string(pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: encryptedDer}))
+	legacyPem := string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Headers: map[string]string{
+		"Proc-Type": "4,ENCRYPTED", "DEK-Info": "AES-256-CBC,00000000000000000000000000000000"}, Bytes: []byte{1, 2, 3}}))
+
+	caFile := writeFile(t, "ca.pem", caPem)
+	tests := []struct {
+		name        string
+		cfg         Config
+		isNil       bool
+		skipVerify  bool
+		verifyChain bool // only the chain is verified (VerifyPeerCertificate)
+		rootCAs     bool
+		clientCert  bool
+		err         string
+	}{
+		{"no TLS option", Config{}, true, false, false, false, false, ""},
+		{"insecure without files", Config{TlsInsecure: true}, false, true, false, false, false, ""},
+		{"chain errors without files", Config{TlsAllowChainErrors: true}, false, true, false, false, false, ""},
+		{"invalid hostnames without files", Config{TlsAllowInvalidHostnames: true}, false, true, true, false, false, ""},
+		{"CA file", Config{TlsCaPemFile: caFile}, false, false, false, true, false, ""},
+		{"CA file, invalid hostnames", Config{TlsCaPemFile: caFile, TlsAllowInvalidHostnames: true}, false, true, true, true, false, ""},
+		{"CA file, insecure wins", Config{TlsCaPemFile: caFile, TlsInsecure: true, TlsAllowInvalidHostnames: true}, false, true, false, true, false, ""},
+		{"client PEM", Config{TlsClientPemFile: writeFile(t, "client.pem", certPem+keyPem)}, false, false, false, false, true, ""},
+		{"client PEM, PKCS#8 encrypted key", Config{TlsClientPemFile: writeFile(t, "client.pem", certPem+encryptedPem), TlsClientKeyPassword: "secret"},
+			false, false, false, false, true, ""},
+		{"client PEM, wrong password", Config{TlsClientPemFile: writeFile(t, "client.pem", certPem+encryptedPem), TlsClientKeyPassword: "wrong"},
+			false, false, false, false, false, "can not decrypt client key"},
+		{"client PEM, legacy encryption", Config{TlsClientPemFile: writeFile(t, "client.pem", certPem+legacyPem), TlsClientKeyPassword: "secret"},
+			false, false, false, false, false, "legacy PEM encryption"},
+		{"client PEM without key", Config{TlsClientPemFile: writeFile(t, "client.pem", certPem)}, false, false, false, false, false, "invalid client certificate"},
+		{"missing CA file", Config{TlsCaPemFile: caFile + ".none"}, false, false, false, false, false, "can not read tlsCaPemFile"},
+		{"CA file without certificates", Config{TlsCaPemFile: writeFile(t, "empty.pem", "none")}, false, false, false, false, false, "no certificates found"},
+		{"missing PFX file", Config{TlsClientPfxFile: caFile + ".pfx"}, false, false, false, false, false, "can not read tlsClientPfxFile"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tlsConfig, err := TLSConfig(test.cfg)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (tlsConfig == nil) != test.isNil {
+				t.Fatalf("config %+v, want nil %v", tlsConfig, test.isNil)
+			}
+			if tlsConfig == nil {
+				return
+			}
+			if tlsConfig.InsecureSkipVerify != test.skipVerify {
+				t.Errorf("InsecureSkipVerify %v", tlsConfig.InsecureSkipVerify)
+			}
+			if (tlsConfig.VerifyPeerCertificate != nil) != test.verifyChain {
+				t.Errorf("VerifyPeerCertificate set %v", tlsConfig.VerifyPeerCertificate != nil)
+			}
+			if (tlsConfig.RootCAs != nil) != test.rootCAs {
+				t.Errorf("RootCAs set %v", tlsConfig.RootCAs != nil)
+			}
+			if (len(tlsConfig.Certificates) == 1) != test.clientCert {
+				t.Errorf("%d client certificates", len(tlsConfig.Certificates))
+			}
+		})
+	}
+
+	// chain verification without host name check
+	tlsConfig, err := TLSConfig(Config{TlsCaPemFile: caFile, TlsAllowInvalidHostnames: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tlsConfig.VerifyPeerCertificate([][]byte{certDer}, nil); err != nil {
+		t.Errorf("certificate signed by the CA rejected: %v", err)
+	}
+	_, _, _, otherDer := testCertificates(t)
+	if err := tlsConfig.VerifyPeerCertificate([][]byte{otherDer}, nil); err == nil {
+		t.Error("certificate of other CA accepted")
+	}
+}
+
+func TestClientOptions(t *testing.T) {
+	if _, err := ClientOptions(Config{MongoConnectionString: "localhost"}); err == nil {
+		t.Error("invalid connection string accepted")
+	}
+
+	opts, err := ClientOptions(Config{MongoConnectionString: "mongodb://localhost/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.TLSConfig != nil {
+		t.Error("TLS enabled without options")
+	}
+
+	// TLS enabled on the connection string with system CAs, flags from the config still apply
+	opts, err = ClientOptions(Config{MongoConnectionString: "mongodb://localhost/?tls=true", TlsAllowInvalidHostnames: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.TLSConfig == nil || !opts.TLSConfig.InsecureSkipVerify || opts.TLSConfig.VerifyPeerCertificate == nil {
+		t.Errorf("tlsAllowInvalidHostnames not applied: %+v", opts.TLSConfig)
+	}
+}